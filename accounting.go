@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// realmAccountingFormat is "csv" or "json".
+var realmAccountingFormat = "csv"
+
+// realmAccountingReport counts the signaling volume exchanged between
+// realms per application, for checking interconnect invoices of roaming
+// partners: a request and its answer are counted against the same
+// (requesting realm, answering realm, application) row.
+type realmAccountingReport struct {
+	format string
+	rows   map[conversationKey]*RealmTraffic
+}
+
+// RealmTraffic is the traffic of one (origin realm, destination realm,
+// application) triple. The origin realm sends the requests, the
+// destination realm answers them.
+type RealmTraffic struct {
+	OriginRealm      string    `json:"origin_realm"`
+	DestinationRealm string    `json:"destination_realm"`
+	ApplicationID    uint32    `json:"application_id"`
+	ApplicationName  string    `json:"application_name,omitempty"`
+	Requests         int       `json:"requests"`
+	Answers          int       `json:"answers"`
+	Errors           int       `json:"errors"`
+	RequestBytes     uint64    `json:"request_bytes"`
+	AnswerBytes      uint64    `json:"answer_bytes"`
+	FirstSeen        Timestamp `json:"first_seen"`
+	LastSeen         Timestamp `json:"last_seen"`
+}
+
+func newRealmAccountingReport() (report, error) {
+	switch realmAccountingFormat {
+	case "csv", "json":
+	default:
+		return nil, fmt.Errorf("unknown format %q (available: csv, json)", realmAccountingFormat)
+	}
+	return &realmAccountingReport{
+		format: realmAccountingFormat,
+		rows:   make(map[conversationKey]*RealmTraffic),
+	}, nil
+}
+
+func (r *realmAccountingReport) add(mi *MessageInfo, req *MessageInfo) {
+	var origin, dest string
+	switch {
+	case mi.isRequest():
+		origin, dest = mi.str("Origin-Realm"), mi.str("Destination-Realm")
+	case req != nil:
+		origin, dest = req.str("Origin-Realm"), req.str("Destination-Realm")
+	default:
+		// Without the request, the answering realm is known but not the
+		// requesting one.
+		dest = mi.str("Origin-Realm")
+	}
+	t := r.row(or(origin, "unknown"), or(dest, "unknown"), mi)
+	if mi.isRequest() {
+		t.Requests++
+		t.RequestBytes += uint64(mi.MessageLength)
+	} else {
+		t.Answers++
+		t.AnswerBytes += uint64(mi.MessageLength)
+		if rc, ok := mi.resultCode(); ok && rc.isError() {
+			t.Errors++
+		}
+	}
+	if mi.Timestamp.Before(t.FirstSeen.Time) {
+		t.FirstSeen = mi.Timestamp
+	}
+	if mi.Timestamp.After(t.LastSeen.Time) {
+		t.LastSeen = mi.Timestamp
+	}
+}
+
+func (r *realmAccountingReport) row(origin, dest string, mi *MessageInfo) *RealmTraffic {
+	k := conversationKey{origin, dest, mi.ApplicationID}
+	t := r.rows[k]
+	if t == nil {
+		t = &RealmTraffic{
+			OriginRealm:      origin,
+			DestinationRealm: dest,
+			ApplicationID:    mi.ApplicationID,
+			ApplicationName:  applicationName(mi.ApplicationID),
+			FirstSeen:        mi.Timestamp,
+		}
+		r.rows[k] = t
+	}
+	return t
+}
+
+// sorted returns the rows in origin realm, destination realm, application
+// order.
+func (r *realmAccountingReport) sorted() []*RealmTraffic {
+	rows := make([]*RealmTraffic, 0, len(r.rows))
+	for _, t := range r.rows {
+		rows = append(rows, t)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.OriginRealm != b.OriginRealm {
+			return a.OriginRealm < b.OriginRealm
+		}
+		if a.DestinationRealm != b.DestinationRealm {
+			return a.DestinationRealm < b.DestinationRealm
+		}
+		return a.ApplicationID < b.ApplicationID
+	})
+	return rows
+}
+
+func (r *realmAccountingReport) write(w io.Writer) error {
+	rows := r.sorted()
+	if r.format == "json" {
+		return writeJSON(w, struct {
+			Labels   map[string]string `json:"labels,omitempty"`
+			Warnings []string          `json:"warnings,omitempty"`
+			Realms   []*RealmTraffic   `json:"realms"`
+		}{runLabels, reportWarnings(), rows})
+	}
+
+	// The warnings have no place in CSV.
+	for _, warning := range reportWarnings() {
+		log.Println("realm-accounting:", warning)
+	}
+	cw := csv.NewWriter(w)
+	labelKeys := runLabels.keys()
+	cw.Write(append([]string{"origin_realm", "destination_realm", "application_id", "application", "requests", "answers", "errors", "request_bytes", "answer_bytes", "first_seen", "last_seen"}, labelKeys...))
+	for _, t := range rows {
+		rec := []string{
+			t.OriginRealm,
+			t.DestinationRealm,
+			strconv.FormatUint(uint64(t.ApplicationID), 10),
+			appLabel(t.ApplicationID, t.ApplicationName),
+			strconv.Itoa(t.Requests),
+			strconv.Itoa(t.Answers),
+			strconv.Itoa(t.Errors),
+			strconv.FormatUint(t.RequestBytes, 10),
+			strconv.FormatUint(t.AnswerBytes, 10),
+			formatTime(t.FirstSeen.UTC()),
+			formatTime(t.LastSeen.UTC()),
+		}
+		for _, l := range labelKeys {
+			rec = append(rec, runLabels[l])
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+	return cw.Error()
+}
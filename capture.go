@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// captureQueue is the number of packets a live capture holds for decoding.
+var captureQueue = 10000
+
+// CaptureStats counts the packets of a live capture and where they were
+// lost. Captured are the packets read from the capture buffer, and
+// QueueDropped those of them dropped because the capture queue was full,
+// when decoding falls behind the capture. KernelDropped and
+// InterfaceDropped are the counts of libpcap: packets the kernel dropped
+// because the capture buffer was full, and packets dropped by the network
+// interface or its driver, which libpcap can only report on some systems.
+type CaptureStats struct {
+	Captured         uint64 `json:"captured"`
+	KernelDropped    uint64 `json:"kernel_dropped"`
+	InterfaceDropped uint64 `json:"interface_dropped"`
+	QueueDropped     uint64 `json:"queue_dropped"`
+}
+
+// sub returns the counts since prev. Those of libpcap are 32-bit and wrap
+// around; poll widens them, so the counts only grow.
+func (c CaptureStats) sub(prev CaptureStats) CaptureStats {
+	return CaptureStats{
+		Captured:         c.Captured - prev.Captured,
+		KernelDropped:    c.KernelDropped - prev.KernelDropped,
+		InterfaceDropped: c.InterfaceDropped - prev.InterfaceDropped,
+		QueueDropped:     c.QueueDropped - prev.QueueDropped,
+	}
+}
+
+// widen returns the 64-bit count following prev of which the 32-bit
+// counter reads n, the counter having wrapped if needed.
+func widen(prev uint64, n int) uint64 {
+	return prev + uint64(uint32(n)-uint32(prev))
+}
+
+// dropped is the number of packets lost, by the kernel, the interface or
+// the queue.
+func (c CaptureStats) dropped() uint64 {
+	return c.KernelDropped + c.InterfaceDropped + c.QueueDropped
+}
+
+// dropRatio is the part of the packets reaching the capture buffer that
+// were dropped, by the kernel or the queue, and so are missing from the
+// records, reports and metrics.
+func (c CaptureStats) dropRatio() float64 {
+	if c.Captured+c.KernelDropped == 0 {
+		return 0
+	}
+	return float64(c.KernelDropped+c.QueueDropped) / float64(c.Captured+c.KernelDropped)
+}
+
+// liveStream reads a live capture on its own goroutine into the capture
+// queue. When decoding falls behind, packets are dropped from the queue
+// and counted instead of leaving them in the capture buffer, where the
+// kernel would drop the newest ones: the counts then tell the two apart.
+type liveStream struct {
+	hs      *handleStream
+	packets chan *rawPacket
+	err     error // that ended the reading, set before packets is closed
+
+	mu     sync.Mutex
+	stats  CaptureStats
+	closed bool // the handle, under the lock of the canceller
+}
+
+func openLiveStream(in *input, c *canceller) (*liveStream, error) {
+	hs, err := openHandleStream(in, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &liveStream{hs: hs, packets: make(chan *rawPacket, captureQueue)}
+	c.beforeStop(s.pollOpen)
+	go s.read()
+	return s, nil
+}
+
+// read queues the packets of the capture, reading the libpcap counters at
+// most once a second; they are also read by logCaptureDrops, and when the
+// capture is stopped.
+func (s *liveStream) read() {
+	defer close(s.packets)
+	var polled time.Time
+	for {
+		p, err := s.hs.next()
+		if err != nil {
+			s.err = err
+			return
+		}
+		if now := time.Now(); now.Sub(polled) >= time.Second {
+			polled = now
+			s.poll()
+		}
+		s.mu.Lock()
+		s.stats.Captured++
+		select {
+		case s.packets <- p:
+		default:
+			s.stats.QueueDropped++
+		}
+		s.mu.Unlock()
+	}
+}
+
+// poll reads the libpcap counters, unless the handle is being or was
+// closed: the canceller serializes the reads with closing it.
+func (s *liveStream) poll() {
+	s.hs.c.whileOpen(s.pollOpen)
+}
+
+// pollOpen reads the libpcap counters, the canceller locked.
+func (s *liveStream) pollOpen() {
+	if s.closed {
+		return
+	}
+	ps, err := s.hs.handle.Stats()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.stats.KernelDropped = widen(s.stats.KernelDropped, ps.PacketsDropped)
+	s.stats.InterfaceDropped = widen(s.stats.InterfaceDropped, ps.PacketsIfDropped)
+	s.mu.Unlock()
+}
+
+func (s *liveStream) next() (*rawPacket, error) {
+	p, ok := <-s.packets
+	if !ok {
+		return nil, s.err
+	}
+	return p, nil
+}
+
+func (s *liveStream) close() {
+	s.hs.c.whileOpen(func() { s.closed = true })
+	s.hs.close()
+}
+
+// captureStats returns the counts so far. Those of libpcap are as of the
+// last poll, and final once the capture is stopped.
+func (s *liveStream) captureStats() CaptureStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// logCaptureDrops logs, at each interval in which packets were lost, how
+// many and where, reading the libpcap counters first. The returned
+// function stops it after logging the totals of the run.
+func logCaptureDrops(s *liveStream, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		var last CaptureStats
+		for {
+			select {
+			case <-t.C:
+				s.poll()
+				cur := s.captureStats()
+				if d := cur.sub(last); d.dropped() > 0 {
+					log.Printf("capture: in the last %v, %s", interval, d.summary())
+				}
+				last = cur
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		s.poll()
+		log.Printf("capture: %s", s.captureStats().summary())
+	}
+}
+
+func (c CaptureStats) summary() string {
+	return fmt.Sprintf("%d packets captured, %d dropped by the kernel, %d by the interface, %d by the capture queue (%.2f%% lost)",
+		c.Captured, c.KernelDropped, c.InterfaceDropped, c.QueueDropped, 100*c.dropRatio())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+// liveConfig holds the settings that can be changed without a restart.
+// They come from the command line, overridden by the settings present in
+// the -config file.
+type liveConfig struct {
+	AllowList string            `json:"allow_list"`
+	DenyList  string            `json:"deny_list"`
+	Redact    []string          `json:"redact"`
+	Influx    string            `json:"influx"`
+	Graphite  string            `json:"graphite"`
+	OTLP      string            `json:"otlp"`
+	Derived   map[string]string `json:"derived"` // field name -> expression, config file only
+}
+
+// loadLiveConfig reads path (JSON) over the settings of base. An empty
+// path returns base.
+func loadLiveConfig(path string, base liveConfig) (liveConfig, error) {
+	c := base
+	if path == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// liveSettings are the objects built from a liveConfig.
+type liveSettings struct {
+	config  liveConfig
+	filter  *subscriberFilter
+	redact  redactor
+	derived derivedFields
+	sinks   []metricsSink
+}
+
+// newLiveSettings loads the subscriber lists and creates the sinks of c.
+func newLiveSettings(c liveConfig) (*liveSettings, error) {
+	s := &liveSettings{config: c, redact: newRedactor(c.Redact)}
+	var err error
+	if s.derived, err = newDerivedFields(c.Derived); err != nil {
+		return nil, err
+	}
+	if c.AllowList != "" || c.DenyList != "" {
+		f, err := newSubscriberFilter(c.AllowList, c.DenyList)
+		if err != nil {
+			return nil, fmt.Errorf("subscriber list: %v", err)
+		}
+		s.filter = f
+	}
+	if c.Influx != "" {
+		s.sinks = append(s.sinks, newInfluxSink(c.Influx))
+	}
+	if c.Graphite != "" {
+		s.sinks = append(s.sinks, newGraphiteSink(c.Graphite))
+	}
+	return s, nil
+}
+
+// watchConfig reloads the settings on SIGHUP and, when path is set,
+// whenever the file changes. Subscriber lists are read again on each
+// reload. Settings that fail to load are logged and the current ones kept.
+func watchConfig(path string, base liveConfig, reload func(*liveSettings)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	var last os.FileInfo
+	if path != "" {
+		t := time.NewTicker(configPollInterval)
+		tick = t.C
+		last, _ = os.Stat(path)
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-tick:
+				fi, err := os.Stat(path)
+				if err != nil || (last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size()) {
+					continue
+				}
+				last = fi
+			}
+			sdNotify("RELOADING=1")
+			c, err := loadLiveConfig(path, base)
+			if err == nil {
+				var s *liveSettings
+				if s, err = newLiveSettings(c); err == nil {
+					log.Println("config reloaded")
+					reload(s)
+				}
+			}
+			if err != nil {
+				log.Println("config reload failed, keeping the current settings:", err)
+			}
+			sdNotify("READY=1")
+		}
+	}()
+}
+
+// redactor replaces the values of the named AVPs, at any depth, with a
+// hash of the value: records stay joinable on them without showing them.
+type redactor map[string]bool
+
+func newRedactor(names []string) redactor {
+	if len(names) == 0 {
+		return nil
+	}
+	r := make(redactor)
+	for _, n := range names {
+		r[n] = true
+	}
+	return r
+}
+
+// apply returns a copy of mi with the values redacted, or mi itself when
+// there is nothing to redact. mi is left unchanged, so that the requests
+// held by the correlator keep their values for the subscriber lists; they
+// are redacted again when passed on with their answer.
+func (r redactor) apply(mi *MessageInfo) *MessageInfo {
+	if len(r) == 0 || mi == nil {
+		return mi
+	}
+	out := *mi
+	out.AVPs = r.avps(mi.AVPs)
+	return &out
+}
+
+func (r redactor) avps(avps []AVPInfo) []AVPInfo {
+	out := make([]AVPInfo, len(avps))
+	for i, a := range avps {
+		switch g := a.Data.(type) {
+		case GroupedData:
+			a.Data = GroupedData{AVPs: r.avps(g.AVPs)}
+		default:
+			if r[a.Name] {
+				a.Data, a.Human = redactedValue(a.Data), ""
+			}
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// redactedValue is "redacted:" and the first 8 bytes of the SHA-256 of
+// the JSON value.
+func redactedValue(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return "redacted:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"sort"
+)
+
+// conversationReport lists the traffic between each requesting host,
+// answering host and application, like Wireshark's Conversations window.
+type conversationReport struct {
+	convs map[conversationKey]*Conversation
+	// pending holds requests without Destination-Host until their answer
+	// tells which host served them.
+	pending map[txKey]*MessageInfo
+}
+
+type conversationKey struct {
+	origin, destination string
+	appID               uint32
+}
+
+// Conversation is the traffic of one (origin, destination, application)
+// triple. Origin is the host sending the requests, destination the host
+// answering them.
+type Conversation struct {
+	OriginHost      string    `json:"origin_host"`
+	DestinationHost string    `json:"destination_host"`
+	ApplicationID   uint32    `json:"application_id"`
+	ApplicationName string    `json:"application_name,omitempty"`
+	Messages        int       `json:"messages"`
+	Bytes           uint64    `json:"bytes"`
+	Requests        int       `json:"requests"`
+	Answers         int       `json:"answers"`
+	Errors          int       `json:"errors"`
+	FirstSeen       Timestamp `json:"first_seen"`
+	LastSeen        Timestamp `json:"last_seen"`
+}
+
+func newConversationReport() (report, error) {
+	return &conversationReport{
+		convs:   make(map[conversationKey]*Conversation),
+		pending: make(map[txKey]*MessageInfo),
+	}, nil
+}
+
+func (r *conversationReport) add(mi *MessageInfo, req *MessageInfo) {
+	if mi.isRequest() {
+		if dest := mi.str("Destination-Host"); dest != "" {
+			r.count(mi, mi.str("Origin-Host"), dest)
+		} else {
+			r.pending[txKey{mi.HopByHopID, mi.EndToEndID}] = mi
+			for _, old := range evictOldest(r.pending, messageTime) {
+				r.count(old, old.str("Origin-Host"), "")
+			}
+		}
+		return
+	}
+
+	origin := mi.str("Destination-Host")
+	if req != nil {
+		origin = req.str("Origin-Host")
+		k := txKey{req.HopByHopID, req.EndToEndID}
+		if p, ok := r.pending[k]; ok && p == req {
+			delete(r.pending, k)
+			r.count(req, origin, mi.str("Origin-Host"))
+		}
+	}
+	r.count(mi, origin, mi.str("Origin-Host"))
+}
+
+func (r *conversationReport) count(mi *MessageInfo, origin, dest string) {
+	if origin == "" {
+		origin = "unknown"
+	}
+	if dest == "" {
+		dest = "unknown"
+	}
+	k := conversationKey{origin, dest, mi.ApplicationID}
+	c := r.convs[k]
+	if c == nil {
+		c = &Conversation{
+			OriginHost:      origin,
+			DestinationHost: dest,
+			ApplicationID:   mi.ApplicationID,
+			ApplicationName: applicationName(mi.ApplicationID),
+			FirstSeen:       mi.Timestamp,
+		}
+		r.convs[k] = c
+	}
+	c.Messages++
+	c.Bytes += uint64(mi.MessageLength)
+	if mi.isRequest() {
+		c.Requests++
+	} else {
+		c.Answers++
+		if rc, ok := mi.resultCode(); ok && rc.isError() {
+			c.Errors++
+		}
+	}
+	if mi.Timestamp.Before(c.FirstSeen.Time) {
+		c.FirstSeen = mi.Timestamp
+	}
+	if mi.Timestamp.After(c.LastSeen.Time) {
+		c.LastSeen = mi.Timestamp
+	}
+}
+
+func (r *conversationReport) write(w io.Writer) error {
+	// Requests never answered keep an unknown destination.
+	for k, req := range r.pending {
+		r.count(req, req.str("Origin-Host"), "")
+		delete(r.pending, k)
+	}
+
+	convs := make([]*Conversation, 0, len(r.convs))
+	for _, c := range r.convs {
+		convs = append(convs, c)
+	}
+	sort.Slice(convs, func(i, j int) bool {
+		a, b := convs[i], convs[j]
+		if a.Messages != b.Messages {
+			return a.Messages > b.Messages
+		}
+		if a.OriginHost != b.OriginHost {
+			return a.OriginHost < b.OriginHost
+		}
+		if a.DestinationHost != b.DestinationHost {
+			return a.DestinationHost < b.DestinationHost
+		}
+		return a.ApplicationID < b.ApplicationID
+	})
+	return writeJSON(w, struct {
+		Labels        map[string]string `json:"labels,omitempty"`
+		Warnings      []string          `json:"warnings,omitempty"`
+		Conversations []*Conversation   `json:"conversations"`
+	}{runLabels, reportWarnings(), convs})
+}
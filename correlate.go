@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// maxPending bounds the messages held waiting for their match, by the
+// correlator and by each report, so that traffic left unanswered cannot
+// grow memory without limit; with -max-avps it bounds the memory held
+// across messages (0 = no limit).
+var maxPending = 1000000
+
+// pendingMaxAge is the age, behind the latest request, beyond which the
+// correlator takes a request as never answered and drops it (0 = no
+// limit).
+var pendingMaxAge = 5 * time.Minute
+
+// evictOldest removes from pending, once it holds more than maxPending
+// entries, the tenth with the oldest times, and returns them.
+func evictOldest[K comparable, V any](pending map[K]V, at func(V) time.Time) []V {
+	if maxPending <= 0 || len(pending) <= maxPending {
+		return nil
+	}
+	keys := make([]K, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return at(pending[keys[i]]).Before(at(pending[keys[j]])) })
+	out := make([]V, 0, len(keys)/10+1)
+	for _, k := range keys[:len(keys)/10+1] {
+		out = append(out, pending[k])
+		delete(pending, k)
+	}
+	return out
+}
+
+// messageTime is the capture time of a held message.
+func messageTime(mi *MessageInfo) time.Time {
+	return mi.Timestamp.Time
+}
+
+// txKey identifies a Diameter transaction. Answers carry the same
+// Hop-by-Hop and End-to-End identifiers as the request they answer.
+type txKey struct {
+	HopByHopID uint32
+	EndToEndID uint32
+}
+
+// correlator pairs answers with the requests seen earlier in the capture.
+type correlator struct {
+	pending map[txKey]*MessageInfo
+	added   int       // requests, to sweep the expired ones every 10000
+	latest  time.Time // of the latest request
+}
+
+func newCorrelator() *correlator {
+	return &correlator{pending: make(map[txKey]*MessageInfo)}
+}
+
+// match records requests and returns the pending request for an answer.
+// It returns nil for requests and for answers whose request was not seen.
+func (c *correlator) match(mi *MessageInfo) *MessageInfo {
+	k := txKey{mi.HopByHopID, mi.EndToEndID}
+	if mi.isRequest() {
+		c.pending[k] = mi
+		evictOldest(c.pending, messageTime)
+		if mi.Timestamp.After(c.latest) {
+			c.latest = mi.Timestamp.Time
+		}
+		if c.added++; c.added%10000 == 0 && pendingMaxAge > 0 {
+			for k, req := range c.pending {
+				if c.latest.Sub(req.Timestamp.Time) > pendingMaxAge {
+					delete(c.pending, k)
+				}
+			}
+		}
+		return nil
+	}
+	req, ok := c.pending[k]
+	if !ok {
+		return nil
+	}
+	delete(c.pending, k)
+	return req
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// derivedFields are the fields the -config file computes from the AVPs of
+// every message and adds to its record under "derived", e.g.
+//
+//	"derived": {
+//	  "apn_class": "first_label(Service-Selection)",
+//	  "mccmnc": "concat(Visited-PLMN-Id.mcc, Visited-PLMN-Id.mnc)"
+//	}
+//
+// An expression is an AVP reference, a 'literal' or integer, or a function
+// of expressions. References name a top-level AVP, or a member of a
+// grouped AVP as Subscription-Id/Subscription-Id-Data, and may select a
+// field of a decoded value after a dot. Answers take the AVPs missing from
+// them from their request.
+type derivedFields []derivedField
+
+type derivedField struct {
+	name string
+	expr derivedExpr
+}
+
+// derivedExpr evaluates to "" when the AVPs it needs are missing.
+type derivedExpr func(mi, req *MessageInfo) string
+
+// derivedFuncs are the functions of expressions, by name: they check
+// their arguments when the config is loaded.
+var derivedFuncs = map[string]func(args []derivedArg) (derivedExpr, error){
+	"concat":      concatFunc,
+	"coalesce":    coalesceFunc,
+	"first_label": labelFunc(func(l []string) string { return l[0] }),
+	"last_label":  labelFunc(func(l []string) string { return l[len(l)-1] }),
+	"lower":       stringFunc(strings.ToLower),
+	"upper":       stringFunc(strings.ToUpper),
+	"prefix":      prefixFunc,
+}
+
+// derivedArg is a parsed argument; literal is set for literals, to check
+// constant arguments such as the length of prefix.
+type derivedArg struct {
+	expr    derivedExpr
+	literal *string
+}
+
+// newDerivedFields compiles the expressions of the config, by field name.
+func newDerivedFields(exprs map[string]string) (derivedFields, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(exprs))
+	for n := range exprs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fields := make(derivedFields, 0, len(names))
+	for _, n := range names {
+		if n == "" {
+			return nil, fmt.Errorf("derived field without a name")
+		}
+		p := &exprParser{s: exprs[n]}
+		a, err := p.parse()
+		if err != nil {
+			return nil, fmt.Errorf("derived field %s: %v", n, err)
+		}
+		fields = append(fields, derivedField{n, a.expr})
+	}
+	return fields, nil
+}
+
+// apply sets the derived fields of mi, leaving out those evaluating to "".
+func (f derivedFields) apply(mi, req *MessageInfo) {
+	if len(f) == 0 {
+		return
+	}
+	var out map[string]string
+	for _, d := range f {
+		if v := d.expr(mi, req); v != "" {
+			if out == nil {
+				out = make(map[string]string, len(f))
+			}
+			out[d.name] = v
+		}
+	}
+	mi.Derived = out
+}
+
+// exprParser reads an expression: a reference, a 'literal', an integer,
+// or NAME(ARG, ...).
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) parse() (derivedArg, error) {
+	a, err := p.expr()
+	if err != nil {
+		return a, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return a, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos:], p.pos)
+	}
+	return a, nil
+}
+
+func (p *exprParser) expr() (derivedArg, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return derivedArg{}, fmt.Errorf("missing expression at offset %d", p.pos)
+	}
+	if p.s[p.pos] == '\'' {
+		end := strings.IndexByte(p.s[p.pos+1:], '\'')
+		if end < 0 {
+			return derivedArg{}, fmt.Errorf("unterminated literal at offset %d", p.pos)
+		}
+		lit := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return literalArg(lit), nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune("(),' \t", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	word := p.s[start:p.pos]
+	if word == "" {
+		return derivedArg{}, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos:], p.pos)
+	}
+	if _, err := strconv.Atoi(word); err == nil {
+		return literalArg(word), nil
+	}
+	p.skipSpace()
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		return derivedArg{expr: referenceExpr(word)}, nil
+	}
+
+	fn, ok := derivedFuncs[word]
+	if !ok {
+		return derivedArg{}, fmt.Errorf("unknown function %s (available: %s)", word, strings.Join(derivedFuncNames(), ", "))
+	}
+	p.pos++ // (
+	var args []derivedArg
+	for {
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == ')' && len(args) == 0 {
+			p.pos++
+			break
+		}
+		a, err := p.expr()
+		if err != nil {
+			return a, err
+		}
+		args = append(args, a)
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			return derivedArg{}, fmt.Errorf("missing ) after the arguments of %s", word)
+		}
+		c := p.s[p.pos]
+		p.pos++
+		if c == ')' {
+			break
+		}
+		if c != ',' {
+			return derivedArg{}, fmt.Errorf("unexpected %q in the arguments of %s", c, word)
+		}
+	}
+	e, err := fn(args)
+	if err != nil {
+		return derivedArg{}, fmt.Errorf("%s: %v", word, err)
+	}
+	return derivedArg{expr: e}, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func derivedFuncNames() []string {
+	names := make([]string, 0, len(derivedFuncs))
+	for n := range derivedFuncs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func literalArg(s string) derivedArg {
+	return derivedArg{expr: func(mi, req *MessageInfo) string { return s }, literal: &s}
+}
+
+// referenceExpr looks up AVP/MEMBER/...[.FIELD] in the message, else in
+// its request.
+func referenceExpr(ref string) derivedExpr {
+	path, field, _ := strings.Cut(ref, ".")
+	names := strings.Split(path, "/")
+	return func(mi, req *MessageInfo) string {
+		for _, m := range []*MessageInfo{mi, req} {
+			if m == nil {
+				continue
+			}
+			if a := findAVPPath(m.AVPs, names); a != nil {
+				return derivedValue(a.Data, field)
+			}
+		}
+		return ""
+	}
+}
+
+// findAVPPath returns the AVP reached by following names through grouped
+// AVPs, or nil.
+func findAVPPath(avps []AVPInfo, names []string) *AVPInfo {
+	a := findAVP(avps, names[0])
+	if a == nil || len(names) == 1 {
+		return a
+	}
+	return findAVPPath(a.children(), names[1:])
+}
+
+// derivedValue is the value of an AVP as a string, or of one field of its
+// decoded value, by JSON name.
+func derivedValue(v interface{}, field string) string {
+	if field == "" {
+		return valueLabel(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(b, &fields) != nil {
+		return ""
+	}
+	switch x := fields[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	default:
+		return valueLabel(x)
+	}
+}
+
+func concatFunc(args []derivedArg) (derivedExpr, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("needs arguments")
+	}
+	return func(mi, req *MessageInfo) string {
+		var b strings.Builder
+		for _, a := range args {
+			v := a.expr(mi, req)
+			if v == "" && a.literal == nil {
+				return "" // a missing AVP leaves the whole value out
+			}
+			b.WriteString(v)
+		}
+		return b.String()
+	}, nil
+}
+
+func coalesceFunc(args []derivedArg) (derivedExpr, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("needs arguments")
+	}
+	return func(mi, req *MessageInfo) string {
+		for _, a := range args {
+			if v := a.expr(mi, req); v != "" {
+				return v
+			}
+		}
+		return ""
+	}, nil
+}
+
+// stringFunc applies f to its single argument.
+func stringFunc(f func(string) string) func([]derivedArg) (derivedExpr, error) {
+	return func(args []derivedArg) (derivedExpr, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument, got %d", len(args))
+		}
+		return func(mi, req *MessageInfo) string {
+			return f(args[0].expr(mi, req))
+		}, nil
+	}
+}
+
+// labelFunc picks one of the dot-separated labels of its argument, as in
+// an APN or a DiameterIdentity.
+func labelFunc(pick func([]string) string) func([]derivedArg) (derivedExpr, error) {
+	return stringFunc(func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return pick(strings.Split(s, "."))
+	})
+}
+
+func prefixFunc(args []derivedArg) (derivedExpr, error) {
+	if len(args) != 2 || args[1].literal == nil {
+		return nil, fmt.Errorf("takes an expression and a length, e.g. prefix(User-Name, 5)")
+	}
+	n, err := strconv.Atoi(*args[1].literal)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid length %q", *args[1].literal)
+	}
+	return func(mi, req *MessageInfo) string {
+		s := args[0].expr(mi, req)
+		if len(s) > n {
+			s = s[:n]
+		}
+		return s
+	}, nil
+}
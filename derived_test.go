@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func derivedMessages() (answer, request *MessageInfo) {
+	request = &MessageInfo{CommandFlags: 0x80, AVPs: []AVPInfo{
+		{Code: 1, Name: "User-Name", Data: "001010123456789"},
+		{Code: 493, Name: "Service-Selection", Data: "ims"},
+	}}
+	answer = &MessageInfo{AVPs: []AVPInfo{
+		{Code: 264, Name: "Origin-Host", Data: "hss01.epc.mnc001.mcc001.3gppnetwork.org"},
+		{Code: 493, Name: "Service-Selection", Data: "Internet.mnc001.mcc001.gprs"},
+		{Code: 1407, Name: "Visited-PLMN-Id", Data: &PLMN{MCC: "001", MNC: "01", Hex: "00f110"}},
+		{Code: 1032, Name: "RAT-Type", Data: uint32(1004)},
+		{Code: 443, Name: "Subscription-Id", Data: GroupedData{AVPs: []AVPInfo{
+			{Code: 450, Name: "Subscription-Id-Type", Data: int32(0)},
+			{Code: 444, Name: "Subscription-Id-Data", Data: "393331234567"},
+		}}},
+	}}
+	return answer, request
+}
+
+func TestDerivedFieldValues(t *testing.T) {
+	mi, req := derivedMessages()
+	for _, tc := range []struct {
+		expr, want string
+	}{
+		{"Origin-Host", "hss01.epc.mnc001.mcc001.3gppnetwork.org"},
+		{"RAT-Type", "1004"},
+		{"Visited-PLMN-Id", "001-01"},
+		{"Visited-PLMN-Id.mnc", "01"},
+		{"Visited-PLMN-Id.unknown", ""},
+		{"Subscription-Id/Subscription-Id-Data", "393331234567"},
+		{"Subscription-Id/Missing", ""},
+		{"User-Name", "001010123456789"}, // from the request
+		{"Service-Selection", "Internet.mnc001.mcc001.gprs"},
+		{"'literal'", "literal"},
+		{"42", "42"},
+		{"first_label(Service-Selection)", "Internet"},
+		{"last_label(Origin-Host)", "org"},
+		{"lower(first_label(Service-Selection))", "internet"},
+		{"upper( last_label( Service-Selection ) )", "GPRS"},
+		{"prefix(User-Name, 5)", "00101"},
+		{"prefix(User-Name, 50)", "001010123456789"},
+		{"concat(Visited-PLMN-Id.mcc, '-', Visited-PLMN-Id.mnc)", "001-01"},
+		{"concat(Missing, '-', RAT-Type)", ""},
+		{"coalesce(Missing, Subscription-Id/Subscription-Id-Data, User-Name)", "393331234567"},
+		{"coalesce(Missing, Other)", ""},
+		{"first_label(Missing)", ""},
+		{"concat('a', '', 'b')", "ab"},
+	} {
+		p := &exprParser{s: tc.expr}
+		a, err := p.parse()
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := a.expr(mi, req); got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestDerivedFieldErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr, err string
+	}{
+		{"", "missing expression at offset 0"},
+		{"'open", "unterminated literal at offset 0"},
+		{"lower(User-Name", "missing ) after the arguments of lower"},
+		{"lower(User-Name x)", "unexpected 'x' in the arguments of lower"},
+		{"nosuch(User-Name)", "unknown function nosuch (available: coalesce, concat, first_label, last_label, lower, prefix, upper)"},
+		{"lower(User-Name, User-Name)", "lower: takes 1 argument, got 2"},
+		{"lower()", "lower: takes 1 argument, got 0"},
+		{"concat()", "concat: needs arguments"},
+		{"prefix(User-Name, RAT-Type)", "prefix: takes an expression and a length"},
+		{"prefix(User-Name, -1)", "prefix: invalid length \"-1\""},
+		{"User-Name Origin-Host", "unexpected \"Origin-Host\" at offset 10"},
+		{"lower(User-Name))", "unexpected \")\" at offset 16"},
+		{",", "unexpected \",\" at offset 0"},
+	} {
+		p := &exprParser{s: tc.expr}
+		_, err := p.parse()
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("%q: error %v, want %s", tc.expr, err, tc.err)
+		}
+	}
+}
+
+func TestDerivedFieldsApply(t *testing.T) {
+	if _, err := newDerivedFields(map[string]string{"": "User-Name"}); err == nil {
+		t.Error("a field without a name accepted")
+	}
+	if _, err := newDerivedFields(map[string]string{"apn": "lower("}); err == nil || !strings.HasPrefix(err.Error(), "derived field apn: ") {
+		t.Errorf("error %v, want one naming the field", err)
+	}
+	f, err := newDerivedFields(map[string]string{
+		"apn":     "lower(first_label(Service-Selection))",
+		"mccmnc":  "concat(Visited-PLMN-Id.mcc, Visited-PLMN-Id.mnc)",
+		"missing": "Missing",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, req := derivedMessages()
+	f.apply(mi, req)
+	if len(mi.Derived) != 2 || mi.Derived["apn"] != "internet" || mi.Derived["mccmnc"] != "00101" {
+		t.Errorf("derived %v, want apn internet and mccmnc 00101", mi.Derived)
+	}
+}
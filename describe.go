@@ -0,0 +1,382 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// runDescribe implements "describe": it prints the definition of an AVP or
+// a command from the loaded dictionaries, e.g.
+//
+//	diameter-parser describe avp Visited-PLMN-Id
+//	diameter-parser describe cmd 316
+//
+// AVPs are given by name or code, commands by name, abbreviation (ULR) or
+// code. Names are matched regardless of case.
+func runDescribe(args []string) {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	dictDir := fs.String("dict-dir", "", "Directory of extra XML dictionaries")
+	asJSON := fs.Bool("json", false, "Print the definitions as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: diameter-parser describe [flags] avp NAME|CODE\n       diameter-parser describe [flags] cmd NAME|ABBREVIATION|CODE\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	d, err := loadAllDictionaries(*dictDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kind, query := fs.Arg(0), fs.Arg(1)
+	var found interface{}
+	var n int
+	switch kind {
+	case "avp":
+		avps := describeAVPs(d, query)
+		found, n = avps, len(avps)
+		if !*asJSON {
+			for _, a := range avps {
+				a.write(os.Stdout)
+			}
+		}
+	case "cmd", "command":
+		cmds := describeCommands(d, query)
+		found, n = cmds, len(cmds)
+		if !*asJSON {
+			for _, c := range cmds {
+				c.write(os.Stdout)
+			}
+		}
+	default:
+		log.Fatalf("describe avp or cmd, not %q", kind)
+	}
+	if n == 0 {
+		msg := fmt.Sprintf("no %s %q in the dictionaries", kind, query)
+		if similar := similarNames(d, kind, query); len(similar) > 0 {
+			msg += "; similar: " + strings.Join(similar, ", ")
+		}
+		log.Println(msg)
+		os.Exit(exitRuntime)
+	}
+	if *asJSON {
+		if err := writeJSON(os.Stdout, found); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// AVPDescription is the definition of an AVP, merged from the
+// applications defining it, and where the command and grouped AVP rules
+// use it. Rules are written as in RFC 6733, 3.2: {required}, [optional],
+// and qualifiers for the number of occurrences, e.g. *[Route-Record].
+type AVPDescription struct {
+	Name      string         `json:"name"`
+	Code      uint32         `json:"code"`
+	VendorID  uint32         `json:"vendor_id,omitempty"`
+	Vendor    string         `json:"vendor,omitempty"`
+	Type      string         `json:"type"`
+	Must      string         `json:"must,omitempty"`
+	May       string         `json:"may,omitempty"`
+	MustNot   string         `json:"must_not,omitempty"`
+	Values    []EnumValue    `json:"values,omitempty"`
+	Members   []string       `json:"members,omitempty"`
+	DefinedIn []string       `json:"defined_in"`
+	UsedIn    []AVPUse       `json:"used_in,omitempty"`
+	MemberOf  []GroupedUsage `json:"member_of,omitempty"`
+}
+
+// EnumValue is one of the values of an Enumerated AVP.
+type EnumValue struct {
+	Code int32  `json:"code"`
+	Name string `json:"name"`
+}
+
+// AVPUse is the rule of a command for an AVP.
+type AVPUse struct {
+	Application string `json:"application"`
+	Command     string `json:"command"`
+	Rule        string `json:"rule"`
+}
+
+// GroupedUsage is the rule of a grouped AVP for one of its members.
+type GroupedUsage struct {
+	AVP  string `json:"avp"`
+	Rule string `json:"rule"`
+}
+
+// CommandDescription is a command of one application, with the rules of
+// its request and answer.
+type CommandDescription struct {
+	Name        string   `json:"name"`
+	Request     string   `json:"request"`
+	Answer      string   `json:"answer"`
+	Code        uint32   `json:"code"`
+	Application string   `json:"application"`
+	RequestAVPs []string `json:"request_avps"`
+	AnswerAVPs  []string `json:"answer_avps"`
+}
+
+type avpIdentity struct {
+	code, vendorID uint32
+}
+
+func describeAVPs(d *dict.Parser, query string) []*AVPDescription {
+	code, byCode := parseCode(query)
+	var order []avpIdentity
+	descs := make(map[avpIdentity]*AVPDescription)
+	for _, app := range d.Apps() {
+		for _, a := range app.AVP {
+			if !(byCode && a.Code == code || strings.EqualFold(a.Name, query)) {
+				continue
+			}
+			id := avpIdentity{a.Code, a.VendorID}
+			desc := descs[id]
+			if desc == nil {
+				desc = &AVPDescription{
+					Name:     a.Name,
+					Code:     a.Code,
+					VendorID: a.VendorID,
+					Vendor:   vendorName(d, a.VendorID),
+					Type:     a.Data.TypeName,
+					Must:     a.Must,
+					May:      a.May,
+					MustNot:  a.MustNot,
+				}
+				for _, r := range a.Data.Rule {
+					desc.Members = append(desc.Members, ruleABNF(r))
+				}
+				descs[id] = desc
+				order = append(order, id)
+			}
+			desc.DefinedIn = appendNew(desc.DefinedIn, dictAppLabel(app.ID, app.Name))
+			for _, e := range a.Data.Enum {
+				if !hasEnumValue(desc.Values, e.Code) {
+					desc.Values = append(desc.Values, EnumValue{e.Code, e.Name})
+				}
+			}
+		}
+	}
+
+	out := make([]*AVPDescription, 0, len(order))
+	for _, id := range order {
+		desc := descs[id]
+		sort.Slice(desc.Values, func(i, j int) bool { return desc.Values[i].Code < desc.Values[j].Code })
+		for _, app := range d.Apps() {
+			for _, cmd := range app.Command {
+				for _, half := range []struct {
+					abbr  string
+					rules []*dict.Rule
+				}{{cmd.Short + "R", cmd.Request.Rule}, {cmd.Short + "A", cmd.Answer.Rule}} {
+					for _, r := range half.rules {
+						if r.AVP == desc.Name {
+							desc.UsedIn = append(desc.UsedIn, AVPUse{dictAppLabel(app.ID, app.Name), half.abbr, ruleABNF(r)})
+						}
+					}
+				}
+			}
+			for _, g := range app.AVP {
+				for _, r := range g.Data.Rule {
+					if r.AVP == desc.Name && !hasGroupedUsage(desc.MemberOf, g.Name) {
+						desc.MemberOf = append(desc.MemberOf, GroupedUsage{g.Name, ruleABNF(r)})
+					}
+				}
+			}
+		}
+		out = append(out, desc)
+	}
+	return out
+}
+
+func describeCommands(d *dict.Parser, query string) []*CommandDescription {
+	code, byCode := parseCode(query)
+	var out []*CommandDescription
+	for _, app := range d.Apps() {
+		for _, cmd := range app.Command {
+			q := strings.ToUpper(query)
+			if !(byCode && cmd.Code == code || strings.EqualFold(cmd.Name, query) ||
+				q == strings.ToUpper(cmd.Short) || q == strings.ToUpper(cmd.Short)+"R" || q == strings.ToUpper(cmd.Short)+"A") {
+				continue
+			}
+			c := &CommandDescription{
+				Name:        cmd.Name,
+				Request:     cmd.Short + "R",
+				Answer:      cmd.Short + "A",
+				Code:        cmd.Code,
+				Application: dictAppLabel(app.ID, app.Name),
+				RequestAVPs: []string{},
+				AnswerAVPs:  []string{},
+			}
+			for _, r := range cmd.Request.Rule {
+				c.RequestAVPs = append(c.RequestAVPs, ruleABNF(r))
+			}
+			for _, r := range cmd.Answer.Rule {
+				c.AnswerAVPs = append(c.AnswerAVPs, ruleABNF(r))
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (a *AVPDescription) write(w io.Writer) {
+	fmt.Fprintf(w, "AVP %s, code %d", a.Name, a.Code)
+	if a.VendorID != 0 {
+		fmt.Fprintf(w, ", vendor %d %s", a.VendorID, a.Vendor)
+	}
+	fmt.Fprintf(w, "\n    Type: %s\n", a.Type)
+	fmt.Fprintf(w, "    Flags: must %s; may %s; must not %s\n", or(a.Must, "-"), or(a.May, "-"), or(a.MustNot, "-"))
+	fmt.Fprintf(w, "    Defined in: %s\n", strings.Join(a.DefinedIn, "; "))
+	if len(a.Values) > 0 {
+		fmt.Fprintln(w, "    Values:")
+		for _, v := range a.Values {
+			fmt.Fprintf(w, "        %d %s\n", v.Code, v.Name)
+		}
+	}
+	if len(a.Members) > 0 {
+		fmt.Fprintln(w, "    Members:")
+		for _, m := range a.Members {
+			fmt.Fprintf(w, "        %s\n", m)
+		}
+	}
+	if len(a.UsedIn) > 0 {
+		fmt.Fprintln(w, "    Used in:")
+		for _, u := range a.UsedIn {
+			fmt.Fprintf(w, "        %s %s: %s\n", u.Application, u.Command, u.Rule)
+		}
+	}
+	if len(a.MemberOf) > 0 {
+		fmt.Fprintln(w, "    Member of:")
+		for _, g := range a.MemberOf {
+			fmt.Fprintf(w, "        %s: %s\n", g.AVP, g.Rule)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func (c *CommandDescription) write(w io.Writer) {
+	fmt.Fprintf(w, "Command %s (%s/%s), code %d, application %s\n", c.Name, c.Request, c.Answer, c.Code, c.Application)
+	for _, half := range []struct {
+		name  string
+		rules []string
+	}{{c.Request, c.RequestAVPs}, {c.Answer, c.AnswerAVPs}} {
+		fmt.Fprintf(w, "    %s:\n", half.name)
+		for _, r := range half.rules {
+			fmt.Fprintf(w, "        %s\n", r)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// ruleABNF writes a rule as the command definitions of RFC 6733 do: a
+// required AVP between braces, an optional one between brackets, preceded
+// by min*max when it may occur other than once.
+func ruleABNF(r *dict.Rule) string {
+	s := "[" + r.AVP + "]"
+	min := r.Min
+	if r.Required {
+		s, min = "{"+r.AVP+"}", max(min, 1)
+	}
+	switch {
+	case r.Max == 1:
+		return s
+	case r.Max == 0 && min <= 1:
+		return "*" + s
+	case r.Max == 0:
+		return strconv.Itoa(min) + "*" + s
+	case min <= 1:
+		return "*" + strconv.Itoa(r.Max) + s
+	}
+	return strconv.Itoa(min) + "*" + strconv.Itoa(r.Max) + s
+}
+
+// parseCode reads a query given as a code.
+func parseCode(q string) (uint32, bool) {
+	n, err := strconv.ParseUint(q, 10, 32)
+	return uint32(n), err == nil
+}
+
+func vendorName(d *dict.Parser, id uint32) string {
+	for _, app := range d.Apps() {
+		for _, v := range app.Vendor {
+			if v.ID == id {
+				return v.Name
+			}
+		}
+	}
+	return ""
+}
+
+// dictAppLabel is the ID of an application followed by its dictionary
+// name, such as 16777251 TGPP S6A.
+func dictAppLabel(id uint32, name string) string {
+	if name == "" {
+		return strconv.FormatUint(uint64(id), 10)
+	}
+	return fmt.Sprintf("%d %s", id, name)
+}
+
+func appendNew(list []string, s string) []string {
+	for _, x := range list {
+		if x == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func hasEnumValue(values []EnumValue, code int32) bool {
+	for _, v := range values {
+		if v.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func hasGroupedUsage(uses []GroupedUsage, avp string) bool {
+	for _, u := range uses {
+		if u.AVP == avp {
+			return true
+		}
+	}
+	return false
+}
+
+// similarNames returns up to ten AVP or command names containing the
+// query, for a query that matched nothing.
+func similarNames(d *dict.Parser, kind, query string) []string {
+	q := strings.ToLower(query)
+	var names []string
+	for _, app := range d.Apps() {
+		if kind == "avp" {
+			for _, a := range app.AVP {
+				if strings.Contains(strings.ToLower(a.Name), q) {
+					names = appendNew(names, a.Name)
+				}
+			}
+			continue
+		}
+		for _, c := range app.Command {
+			if strings.Contains(strings.ToLower(c.Name), q) {
+				names = appendNew(names, c.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	return names
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/google/gopacket"
+)
+
+// dictPlugins are the extra dictionary files of -dict-dir. Only the files
+// defining applications seen in the capture are loaded, instead of every
+// 3GPP dictionary up front.
+type dictPlugins struct {
+	d      *dict.Parser
+	files  map[uint32][]string // application ID -> files defining it
+	loaded map[string]bool
+}
+
+// avpDefCacheSize bounds the AVP definition cache, so that AVP codes of
+// junk traffic cannot grow it without limit.
+const avpDefCacheSize = 1 << 16
+
+// avpDefs caches the AVP definitions found in the dictionaries, nil when
+// not found, by avpDefKey: each lookup otherwise tries up to three
+// application and vendor combinations. Decode workers share it; entries
+// are written once per key and then only read, the case sync.Map is for.
+var (
+	avpDefs     sync.Map
+	avpDefCount atomic.Int64
+)
+
+type avpDefKey struct {
+	d                     *dict.Parser
+	appID, code, vendorID uint32
+}
+
+// resetAVPDefs empties the cache after a dictionary is loaded, when AVPs
+// not found before may now be defined.
+func resetAVPDefs() {
+	avpDefs.Clear()
+	avpDefCount.Store(0)
+}
+
+// newDictPlugins indexes the *.xml dictionaries of dir by the application
+// IDs they define, without loading them.
+func newDictPlugins(d *dict.Parser, dir string) (*dictPlugins, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	p := &dictPlugins{d: d, files: make(map[uint32][]string), loaded: make(map[string]bool)}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var file dict.File
+		err = xml.NewDecoder(f).Decode(&file)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, app := range file.App {
+			p.files[app.ID] = append(p.files[app.ID], path)
+		}
+	}
+	return p, nil
+}
+
+// require loads the files defining an application, if not loaded yet.
+func (p *dictPlugins) require(appID uint32) error {
+	for _, path := range p.files[appID] {
+		if p.loaded[path] {
+			continue
+		}
+		p.loaded[path] = true
+		err := p.d.LoadFile(path)
+		resetAVPDefs()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		log.Printf("loaded dictionary %s", path)
+	}
+	return nil
+}
+
+// defines reports whether a file of the directory defines appID.
+func (p *dictPlugins) defines(appID uint32) bool {
+	return len(p.files[appID]) > 0
+}
+
+// requireAll loads every file of the directory.
+func (p *dictPlugins) requireAll() error {
+	ids := make([]uint32, 0, len(p.files))
+	for id := range p.files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err := p.require(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAllDictionaries loads the built-in dictionaries and every file of
+// dir, if given, for the subcommands that cannot tell the applications
+// they need up front.
+func loadAllDictionaries(dir string) (*dict.Parser, error) {
+	d := dict.Default
+	rxCommands := true
+	var plugins *dictPlugins
+	if dir != "" {
+		var err error
+		if plugins, err = newDictPlugins(d, dir); err != nil {
+			return nil, err
+		}
+		rxCommands = !plugins.defines(rxApplicationID)
+	}
+	if err := loadChargingDictionary(d, rxCommands); err != nil {
+		return nil, err
+	}
+	if plugins != nil {
+		if err := plugins.requireAll(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// requireFor loads the dictionaries of the application of the message
+// carried by packet, so that live captures load them on first use.
+func (p *dictPlugins) requireFor(packet gopacket.Packet) error {
+	if id, ok := applicationIDOf(diameterPayload(packet)); ok {
+		return p.require(id)
+	}
+	return nil
+}
+
+// prescanApplications reads the Diameter headers of every packet of the
+// inputs and returns the application IDs seen.
+func prescanApplications(inputs []*input, c *canceller) (map[uint32]bool, error) {
+	ids := make(map[uint32]bool)
+	for _, in := range inputs {
+		s, err := openHandleStream(in, c)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			p, err := s.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				s.close()
+				return nil, err
+			}
+			if id, ok := applicationIDOf(diameterPayload(p.decode())); ok {
+				ids[id] = true
+			}
+		}
+		s.close()
+	}
+	return ids, nil
+}
+
+// applicationIDOf reads the Application-ID of a Diameter header
+// (RFC 6733, 3) without decoding the message.
+func applicationIDOf(payload []byte) (uint32, bool) {
+	if len(payload) < 20 || payload[0] != 1 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(payload[8:12]), true
+}
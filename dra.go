@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// draMaxDelay is how far apart the ingress and egress copies of a message
+// may be captured to be matched.
+const draMaxDelay = 30 * time.Second
+
+// draAuditReport audits relay behavior from captures taken on both sides
+// of a DRA. The first copy of a message is taken as the ingress one; a
+// later copy with the same Origin-Host, End-to-End ID and direction but a
+// new Hop-by-Hop ID is its relayed egress copy. The AVPs the relay added,
+// removed or modified are then aggregated per relay.
+type draAuditReport struct {
+	pending   map[draKey]*MessageInfo
+	added     int
+	matched   int
+	unmatched int
+	changes   map[draChangeKey]*DRAChange
+}
+
+type draKey struct {
+	originHost string
+	e2e        uint32
+	request    bool
+}
+
+type draChangeKey struct {
+	relay, change, avp string
+}
+
+// DRAChange counts one kind of change made by a relay.
+type DRAChange struct {
+	Relay    string       `json:"relay"`  // Route-Record the relay added, if any
+	Change   string       `json:"change"` // "added", "removed" or "modified"
+	AVP      string       `json:"avp"`
+	Count    int          `json:"count"`
+	Examples []DRAExample `json:"examples"`
+}
+
+// DRAExample is a matched pair of frames showing a change.
+type DRAExample struct {
+	Command      string      `json:"command"`
+	IngressFrame int         `json:"ingress_frame"`
+	IngressInput string      `json:"ingress_input,omitempty"`
+	EgressFrame  int         `json:"egress_frame"`
+	EgressInput  string      `json:"egress_input,omitempty"`
+	Before       interface{} `json:"before,omitempty"`
+	After        interface{} `json:"after,omitempty"`
+}
+
+func newDRAAuditReport() (report, error) {
+	return &draAuditReport{
+		pending: make(map[draKey]*MessageInfo),
+		changes: make(map[draChangeKey]*DRAChange),
+	}, nil
+}
+
+func (r *draAuditReport) add(mi *MessageInfo, req *MessageInfo) {
+	k := draKey{mi.str("Origin-Host"), mi.EndToEndID, mi.isRequest()}
+	in, ok := r.pending[k]
+	if ok && in.HopByHopID != mi.HopByHopID && mi.Timestamp.Sub(in.Timestamp.Time) <= draMaxDelay {
+		delete(r.pending, k)
+		r.matched++
+		r.compare(in, mi)
+	} else {
+		if ok {
+			r.unmatched++
+		}
+		r.pending[k] = mi
+		r.unmatched += len(evictOldest(r.pending, messageTime))
+	}
+
+	r.added++
+	if r.added%10000 == 0 {
+		for k, p := range r.pending {
+			if mi.Timestamp.Sub(p.Timestamp.Time) > draMaxDelay {
+				delete(r.pending, k)
+				r.unmatched++
+			}
+		}
+	}
+}
+
+// compare records the differences between the top-level AVPs of the two
+// copies. Repeated AVPs are compared by position.
+func (r *draAuditReport) compare(in, out *MessageInfo) {
+	before, after := avpValuesByName(in.AVPs), avpValuesByName(out.AVPs)
+
+	relay := "unknown"
+	if rr := after["Route-Record"]; len(rr) > len(before["Route-Record"]) {
+		relay, _ = rr[len(rr)-1].(string)
+	}
+	ex := DRAExample{
+		Command:      commandLabel(out.CommandCode),
+		IngressFrame: in.Frame,
+		IngressInput: in.Input,
+		EgressFrame:  out.Frame,
+		EgressInput:  out.Input,
+	}
+
+	names := make(map[string]bool)
+	for n := range before {
+		names[n] = true
+	}
+	for n := range after {
+		names[n] = true
+	}
+	for name := range names {
+		b, a := before[name], after[name]
+		for i := 0; i < len(b) || i < len(a); i++ {
+			e := ex
+			switch {
+			case i >= len(b):
+				e.After = a[i]
+				r.record(relay, "added", name, e)
+			case i >= len(a):
+				e.Before = b[i]
+				r.record(relay, "removed", name, e)
+			case !sameJSON(b[i], a[i]):
+				e.Before, e.After = b[i], a[i]
+				r.record(relay, "modified", name, e)
+			}
+		}
+	}
+}
+
+func (r *draAuditReport) record(relay, change, avp string, ex DRAExample) {
+	k := draChangeKey{relay, change, avp}
+	c := r.changes[k]
+	if c == nil {
+		c = &DRAChange{Relay: relay, Change: change, AVP: avp}
+		r.changes[k] = c
+	}
+	c.Count++
+	if len(c.Examples) < reportTop {
+		c.Examples = append(c.Examples, ex)
+	}
+}
+
+// avpValuesByName groups the values of avps by AVP name, in order.
+func avpValuesByName(avps []AVPInfo) map[string][]interface{} {
+	m := make(map[string][]interface{})
+	for _, a := range avps {
+		name := a.Name
+		if name == "" {
+			name = "unknown"
+		}
+		m[name] = append(m[name], a.Data)
+	}
+	return m
+}
+
+// sameJSON compares decoded AVP values by their JSON encoding.
+func sameJSON(a, b interface{}) bool {
+	x, err1 := json.Marshal(a)
+	y, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(x) == string(y)
+}
+
+func (r *draAuditReport) write(w io.Writer) error {
+	changes := make([]*DRAChange, 0, len(r.changes))
+	for _, c := range r.changes {
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Relay != b.Relay {
+			return a.Relay < b.Relay
+		}
+		if a.AVP != b.AVP {
+			return a.AVP < b.AVP
+		}
+		return a.Change < b.Change
+	})
+	return writeJSON(w, struct {
+		Labels    map[string]string `json:"labels,omitempty"`
+		Warnings  []string          `json:"warnings,omitempty"`
+		Matched   int               `json:"matched"`
+		Unmatched int               `json:"unmatched"`
+		Changes   []*DRAChange      `json:"changes"`
+	}{runLabels, reportWarnings(), r.matched, r.unmatched + len(r.pending), changes})
+}
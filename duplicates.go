@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// e2eWindow is how long an End-to-End ID must stay unique per Origin-Host.
+// RFC 6733, section 3, recommends at least 4 minutes.
+var e2eWindow = 4 * time.Minute
+
+// duplicateE2EReport finds distinct requests from the same Origin-Host
+// reusing an End-to-End ID within e2eWindow. Such clients cause answers to
+// be matched to the wrong request by DRAs. Retransmissions, which repeat
+// the command, Session-Id and subscriber of the original, are not
+// reported.
+type duplicateE2EReport struct {
+	window  time.Duration
+	seen    map[e2eKey]*e2eUse
+	added   int
+	dups    []*DuplicateE2E
+	origins counter
+}
+
+type e2eKey struct {
+	originHost string
+	e2e        uint32
+}
+
+// e2eUse is the last request seen with an End-to-End ID.
+type e2eUse struct {
+	frame     int
+	input     string
+	ts        time.Time
+	command   uint32
+	sessionID string
+	sub       string
+}
+
+// DuplicateE2E is one reuse of an End-to-End ID by a different request.
+type DuplicateE2E struct {
+	OriginHost string       `json:"origin_host"`
+	EndToEndID uint32       `json:"end_to_end_id"`
+	Gap        string       `json:"gap"`
+	First      DuplicateUse `json:"first"`
+	Second     DuplicateUse `json:"second"`
+}
+
+// DuplicateUse describes one of the requests sharing the identifier.
+type DuplicateUse struct {
+	Input     string    `json:"input,omitempty"`
+	Frame     int       `json:"frame"`
+	Timestamp Timestamp `json:"timestamp"`
+	Command   string    `json:"command"`
+	SessionID string    `json:"session_id,omitempty"`
+}
+
+func newDuplicateE2EReport() (report, error) {
+	return &duplicateE2EReport{
+		window:  e2eWindow,
+		seen:    make(map[e2eKey]*e2eUse),
+		dups:    []*DuplicateE2E{},
+		origins: counter{},
+	}, nil
+}
+
+func (r *duplicateE2EReport) add(mi *MessageInfo, req *MessageInfo) {
+	if !mi.isRequest() {
+		return
+	}
+	k := e2eKey{mi.str("Origin-Host"), mi.EndToEndID}
+	use := &e2eUse{
+		frame:     mi.Frame,
+		input:     mi.Input,
+		ts:        mi.Timestamp.Time,
+		command:   mi.CommandCode,
+		sessionID: mi.str("Session-Id"),
+		sub:       mi.subscriberID(),
+	}
+	if prev, ok := r.seen[k]; ok && use.ts.Sub(prev.ts) < r.window && !use.sameRequest(prev) {
+		r.dups = append(r.dups, &DuplicateE2E{
+			OriginHost: k.originHost,
+			EndToEndID: k.e2e,
+			Gap:        use.ts.Sub(prev.ts).String(),
+			First:      prev.describe(),
+			Second:     use.describe(),
+		})
+		r.origins.inc(k.originHost)
+	}
+	r.seen[k] = use
+
+	// Forget identifiers older than the window now and then, so that
+	// memory stays bounded on long captures.
+	r.added++
+	if r.added%10000 == 0 {
+		for k, u := range r.seen {
+			if mi.Timestamp.Sub(u.ts) >= r.window {
+				delete(r.seen, k)
+			}
+		}
+	}
+}
+
+// sameRequest reports whether u looks like a retransmission of prev.
+func (u *e2eUse) sameRequest(prev *e2eUse) bool {
+	return u.command == prev.command && u.sessionID == prev.sessionID && u.sub == prev.sub
+}
+
+func (u *e2eUse) describe() DuplicateUse {
+	return DuplicateUse{
+		Input:     u.input,
+		Frame:     u.frame,
+		Timestamp: Timestamp{u.ts},
+		Command:   commandLabel(u.command),
+		SessionID: u.sessionID,
+	}
+}
+
+func (r *duplicateE2EReport) write(w io.Writer) error {
+	sort.SliceStable(r.dups, func(i, j int) bool {
+		return r.dups[i].Second.Timestamp.Before(r.dups[j].Second.Timestamp.Time)
+	})
+	return writeJSON(w, struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Warnings    []string          `json:"warnings,omitempty"`
+		Window      string            `json:"window"`
+		OriginHosts []NameCount       `json:"origin_hosts"`
+		Duplicates  []*DuplicateE2E   `json:"duplicates"`
+	}{runLabels, reportWarnings(), r.window.String(), r.origins.top(0), r.dups})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+// E164Number is a TBCD-encoded number AVP (MSISDN, SGSN-Number, ...) as
+// decoded from the wire and normalized to international format.
+type E164Number struct {
+	Digits  string `json:"digits"`
+	E164    string `json:"e164,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// subscriberNumbers are the number AVPs of a subscriber, normalized in
+// the country of the IMSI; nodeNumbers are numbers of network nodes,
+// normalized in the country of the visited PLMN.
+var (
+	subscriberNumbers = map[string]bool{"MSISDN": true}
+	nodeNumbers       = map[string]bool{
+		"SGSN-Number":           true,
+		"MME-Number-for-MT-SMS": true,
+		"GMLC-Number":           true,
+		"VLR-Number":            true,
+	}
+)
+
+// numberContext is the country context of the numbers of a message.
+type numberContext struct {
+	homeMCC, visitedMCC string
+}
+
+// newNumberContext takes the home MCC from an IMSI in User-Name and the
+// visited MCC from Visited-PLMN-Id.
+func newNumberContext(msg *diam.Message) numberContext {
+	var c numberContext
+	for _, a := range msg.AVP {
+		switch {
+		case a.Code == avp.UserName && a.VendorID == 0:
+			if s, ok := a.Data.(datatype.UTF8String); ok && len(s) >= 6 && isDigits(string(s)) {
+				c.homeMCC = string(s[:3])
+			}
+		case a.Code == avp.VisitedPLMNID:
+			if os, ok := a.Data.(datatype.OctetString); ok {
+				if plmn := decodePLMN([]byte(os)); plmn != nil {
+					c.visitedMCC = plmn.MCC
+				}
+			}
+		}
+	}
+	return c
+}
+
+// number decodes the number AVP name, or returns nil if it is not one.
+func (c numberContext) number(name string, data datatype.Type) *E164Number {
+	mcc := c.homeMCC
+	switch {
+	case subscriberNumbers[name]:
+		if mcc == "" {
+			mcc = c.visitedMCC
+		}
+	case nodeNumbers[name]:
+		if c.visitedMCC != "" {
+			mcc = c.visitedMCC
+		}
+	default:
+		return nil
+	}
+	os, ok := data.(datatype.OctetString)
+	if !ok {
+		return nil
+	}
+	n := normalizeE164(decodeTBCD([]byte(os)), mcc)
+	return &n
+}
+
+// normalizeE164 formats digits as +CC..., keeping numbers already in
+// international format and completing national ones with the country code
+// of mcc, after removing its trunk prefix. In a country without a trunk
+// prefix, a number starting with its country code is national when only
+// the whole number has the length of a national one, as for the Italian
+// mobiles 39...
+// The country is the one of mcc when the number belongs to it, otherwise
+// the one of the country code when unambiguous.
+func normalizeE164(digits, mcc string) E164Number {
+	n := E164Number{Digits: digits}
+	if !isDigits(digits) || len(digits) > 15 {
+		return n
+	}
+	home, hasHome := mccCountries[mcc]
+	intl := digits
+	switch {
+	case hasHome && strings.HasPrefix(digits, home.cc):
+		n.E164, n.Country = "+"+digits, home.iso
+		if home.trunk() == "" && !home.national(digits[len(home.cc):]) && home.national(digits) {
+			n.E164 = "+" + home.cc + digits
+		}
+		return n
+	case strings.HasPrefix(digits, "00"):
+		intl = digits[2:]
+	case hasHome && home.trunk() != "" && strings.HasPrefix(digits, home.trunk()):
+		n.E164, n.Country = "+"+home.cc+digits[len(home.trunk()):], home.iso
+		return n
+	case strings.HasPrefix(digits, "0"):
+		// Without a trunk prefix the leading 0 is part of the national
+		// number, as for the Italian fixed lines.
+		if hasHome && home.trunk() == "" {
+			n.E164, n.Country = "+"+home.cc+digits, home.iso
+		}
+		return n
+	}
+	// Country codes are prefix-free, so the first match is the one.
+	for l := 1; l <= 3 && l < len(intl); l++ {
+		if iso, ok := ccCountries[intl[:l]]; ok {
+			n.E164, n.Country = "+"+intl, iso
+			return n
+		}
+	}
+	return n
+}
+
+type country struct {
+	cc, iso string
+}
+
+// trunk returns the prefix of national numbers dialled within the country
+// ("0" unless listed in trunkPrefixes).
+func (c country) trunk() string {
+	if p, ok := trunkPrefixes[c.iso]; ok {
+		return p
+	}
+	return "0"
+}
+
+// national reports whether nsn has a length valid for a national
+// significant number of the country, always true for the countries not
+// listed in nationalLengths.
+func (c country) national(nsn string) bool {
+	lengths, ok := nationalLengths[c.iso]
+	if !ok {
+		return true
+	}
+	for _, l := range lengths {
+		if strings.HasPrefix(nsn, l.prefix) {
+			return len(nsn) >= l.min && len(nsn) <= l.max
+		}
+	}
+	return false
+}
+
+// nsnLength is the length of the national significant numbers starting
+// with prefix.
+type nsnLength struct {
+	prefix   string
+	min, max int
+}
+
+// nationalLengths are the lengths of national significant numbers (ITU-T
+// E.164 national numbering plans) of some countries of mccCountries, by
+// ISO 3166 code; the first matching prefix applies.
+var nationalLengths = map[string][]nsnLength{
+	"IT": {{"0", 6, 11}, {"3", 9, 10}, {"", 6, 11}},
+	"GB": {{"7", 10, 10}, {"", 9, 10}},
+	"BE": {{"4", 9, 9}, {"", 8, 8}},
+	"CN": {{"1", 11, 11}, {"", 9, 11}},
+	"CA": {{"", 10, 10}}, "US": {{"", 10, 10}}, "RU": {{"", 10, 10}}, "KZ": {{"", 10, 10}},
+	"FR": {{"", 9, 9}}, "ES": {{"", 9, 9}}, "PT": {{"", 9, 9}}, "NL": {{"", 9, 9}},
+	"CH": {{"", 9, 9}}, "PL": {{"", 9, 9}}, "CZ": {{"", 9, 9}}, "SK": {{"", 9, 9}},
+	"RO": {{"", 9, 9}}, "AU": {{"", 9, 9}}, "ZA": {{"", 9, 9}}, "GR": {{"", 10, 10}},
+	"IN": {{"", 10, 10}}, "TR": {{"", 10, 10}}, "MX": {{"", 10, 10}}, "DK": {{"", 8, 8}},
+	"NO": {{"", 8, 8}}, "JP": {{"", 9, 10}},
+}
+
+// trunkPrefixes are the countries of mccCountries whose trunk prefix is
+// not "0", by ISO 3166 code; "" when national numbers have none.
+var trunkPrefixes = map[string]string{
+	"AD": "", "BH": "", "BZ": "", "CR": "", "CY": "", "DK": "", "EE": "", "ES": "",
+	"FO": "", "GL": "", "GR": "", "GT": "", "HK": "", "HN": "", "IS": "", "IT": "",
+	"KW": "", "LI": "", "LU": "", "LV": "", "MC": "", "MO": "", "MT": "", "MX": "",
+	"NI": "", "NO": "", "OM": "", "PA": "", "PT": "", "QA": "", "SG": "", "SM": "",
+	"SV": "", "UY": "", "VA": "",
+	"BY": "8", "KZ": "8", "RU": "8",
+	"CA": "1", "US": "1",
+	"HU": "06",
+}
+
+// mccCountries maps Mobile Country Codes (ITU-T E.212) to country calling
+// codes (ITU-T E.164) and ISO 3166 country codes.
+var mccCountries = map[string]country{
+	"202": {"30", "GR"}, "204": {"31", "NL"}, "206": {"32", "BE"}, "208": {"33", "FR"},
+	"212": {"377", "MC"}, "213": {"376", "AD"}, "214": {"34", "ES"}, "216": {"36", "HU"},
+	"225": {"379", "VA"},
+	"218": {"387", "BA"}, "219": {"385", "HR"}, "220": {"381", "RS"}, "222": {"39", "IT"},
+	"226": {"40", "RO"}, "228": {"41", "CH"}, "230": {"420", "CZ"}, "231": {"421", "SK"},
+	"232": {"43", "AT"}, "234": {"44", "GB"}, "235": {"44", "GB"}, "238": {"45", "DK"},
+	"240": {"46", "SE"}, "242": {"47", "NO"}, "244": {"358", "FI"}, "246": {"370", "LT"},
+	"247": {"371", "LV"}, "248": {"372", "EE"}, "250": {"7", "RU"}, "255": {"380", "UA"},
+	"257": {"375", "BY"}, "259": {"373", "MD"}, "260": {"48", "PL"}, "262": {"49", "DE"},
+	"266": {"350", "GI"}, "268": {"351", "PT"}, "270": {"352", "LU"}, "272": {"353", "IE"},
+	"274": {"354", "IS"}, "276": {"355", "AL"}, "278": {"356", "MT"}, "280": {"357", "CY"},
+	"282": {"995", "GE"}, "283": {"374", "AM"}, "284": {"359", "BG"}, "286": {"90", "TR"},
+	"288": {"298", "FO"}, "290": {"299", "GL"}, "292": {"378", "SM"}, "293": {"386", "SI"},
+	"294": {"389", "MK"}, "295": {"423", "LI"}, "297": {"382", "ME"},
+	"302": {"1", "CA"}, "310": {"1", "US"}, "311": {"1", "US"}, "312": {"1", "US"},
+	"313": {"1", "US"}, "314": {"1", "US"}, "315": {"1", "US"}, "316": {"1", "US"},
+	"334": {"52", "MX"},
+	"400": {"994", "AZ"}, "401": {"7", "KZ"}, "404": {"91", "IN"}, "405": {"91", "IN"},
+	"410": {"92", "PK"}, "412": {"93", "AF"}, "413": {"94", "LK"}, "414": {"95", "MM"},
+	"415": {"961", "LB"}, "416": {"962", "JO"}, "417": {"963", "SY"}, "418": {"964", "IQ"},
+	"419": {"965", "KW"}, "420": {"966", "SA"}, "421": {"967", "YE"}, "422": {"968", "OM"},
+	"424": {"971", "AE"}, "425": {"972", "IL"}, "426": {"973", "BH"}, "427": {"974", "QA"},
+	"428": {"976", "MN"}, "429": {"977", "NP"}, "430": {"971", "AE"}, "431": {"971", "AE"},
+	"432": {"98", "IR"}, "434": {"998", "UZ"}, "436": {"992", "TJ"}, "437": {"996", "KG"},
+	"438": {"993", "TM"}, "440": {"81", "JP"}, "441": {"81", "JP"}, "450": {"82", "KR"},
+	"452": {"84", "VN"}, "454": {"852", "HK"}, "455": {"853", "MO"}, "456": {"855", "KH"},
+	"457": {"856", "LA"}, "460": {"86", "CN"}, "466": {"886", "TW"}, "470": {"880", "BD"},
+	"472": {"960", "MV"},
+	"502": {"60", "MY"}, "505": {"61", "AU"}, "510": {"62", "ID"}, "515": {"63", "PH"},
+	"520": {"66", "TH"}, "525": {"65", "SG"}, "528": {"673", "BN"}, "530": {"64", "NZ"},
+	"602": {"20", "EG"}, "603": {"213", "DZ"}, "604": {"212", "MA"}, "605": {"216", "TN"},
+	"606": {"218", "LY"}, "608": {"221", "SN"}, "612": {"225", "CI"}, "620": {"233", "GH"},
+	"621": {"234", "NG"}, "624": {"237", "CM"}, "630": {"243", "CD"}, "636": {"251", "ET"},
+	"639": {"254", "KE"}, "640": {"255", "TZ"}, "641": {"256", "UG"}, "645": {"260", "ZM"},
+	"648": {"263", "ZW"}, "655": {"27", "ZA"},
+	"702": {"501", "BZ"}, "704": {"502", "GT"}, "706": {"503", "SV"}, "708": {"504", "HN"},
+	"710": {"505", "NI"}, "712": {"506", "CR"}, "714": {"507", "PA"}, "716": {"51", "PE"},
+	"722": {"54", "AR"}, "724": {"55", "BR"}, "730": {"56", "CL"}, "732": {"57", "CO"},
+	"734": {"58", "VE"}, "736": {"591", "BO"}, "740": {"593", "EC"}, "744": {"595", "PY"},
+	"748": {"598", "UY"},
+}
+
+// ccCountries maps the country codes of mccCountries to their country, or
+// to "" when shared by several countries (+1, +7).
+var ccCountries = func() map[string]string {
+	m := make(map[string]string)
+	for _, c := range mccCountries {
+		if iso, ok := m[c.cc]; ok && iso != c.iso {
+			m[c.cc] = ""
+			continue
+		}
+		m[c.cc] = c.iso
+	}
+	return m
+}()
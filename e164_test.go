@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestNormalizeE164(t *testing.T) {
+	for _, tc := range []struct {
+		digits, mcc   string
+		e164, country string
+	}{
+		// International format, with or without 00.
+		{"393312345678", "222", "+393312345678", "IT"},
+		{"00393312345678", "222", "+393312345678", "IT"},
+		{"447700900123", "222", "+447700900123", "GB"},
+		{"0033612345678", "222", "+33612345678", "FR"},
+		// Italian mobiles starting with the country code: national when
+		// only the whole number has the length of a national one.
+		{"3931234567", "222", "+393931234567", "IT"},
+		{"393931234567", "222", "+393931234567", "IT"},
+		// Italian fixed lines keep their leading 0.
+		{"0612345678", "222", "+390612345678", "IT"},
+		// Trunk prefixes: 0, 8 in Russia, 1 in the United States.
+		{"0612345678", "208", "+33612345678", "FR"},
+		{"07700900123", "234", "+447700900123", "GB"},
+		{"89161234567", "250", "+79161234567", "RU"},
+		{"12025550123", "310", "+12025550123", "US"},
+		{"0620123456", "216", "+3620123456", "HU"},
+		// The country code of the MCC is taken as such where national
+		// numbers have a trunk prefix, whatever the length.
+		{"3361234", "208", "+3361234", "FR"},
+		// Without an MCC, only international numbers.
+		{"393312345678", "", "+393312345678", "IT"},
+		{"0612345678", "", "", ""},
+		// Shared country codes give no country.
+		{"12025550123", "", "+12025550123", ""},
+		// Not a number.
+		{"39331234567a", "222", "", ""},
+		{"3933123456789012", "222", "", ""},
+	} {
+		n := normalizeE164(tc.digits, tc.mcc)
+		if n.Digits != tc.digits || n.E164 != tc.e164 || n.Country != tc.country {
+			t.Errorf("normalizeE164(%q, %q) = %+v, want %s %s", tc.digits, tc.mcc, n, tc.e164, tc.country)
+		}
+	}
+}
+
+func TestCountryNational(t *testing.T) {
+	it, us, af := mccCountries["222"], mccCountries["310"], mccCountries["412"]
+	for _, tc := range []struct {
+		c    country
+		nsn  string
+		want bool
+	}{
+		{it, "3312345678", true},
+		{it, "31234567", false}, // mobiles have 9 or 10 digits
+		{it, "061234", true},
+		{it, "061234567890", false},
+		{us, "2025550123", true},
+		{us, "202555012", false},
+		{af, "1", true}, // lengths not listed
+	} {
+		if got := tc.c.national(tc.nsn); got != tc.want {
+			t.Errorf("%s national(%q) = %v, want %v", tc.c.iso, tc.nsn, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// outputFormat selects how records are printed: "json", the indented
+// records, or "ek", the Elasticsearch bulk layout of tshark -T ek.
+var outputFormat = "json"
+
+// writeEK prints a message as tshark -T ek does: an index line, then the
+// packet on one line with its fields per protocol layer. Field names are
+// the Wireshark display filter names prefixed with their layer, dots
+// replaced by underscores (diameter.cmd.code becomes
+// diameter_diameter_cmd_code); values are strings, arrays when a field
+// repeats, as for the members of grouped AVPs. Only the frame and
+// Diameter layers are given; the labels, derived fields, warnings and
+// association of the record follow the layers.
+func writeEK(w io.Writer, mi *MessageInfo, req *MessageInfo) error {
+	frame := ekLayer{}
+	frame.add("frame.number", strconv.Itoa(mi.Frame))
+	frame.add("frame.time_epoch", fmt.Sprintf("%d.%09d", mi.Timestamp.Unix(), mi.Timestamp.Nanosecond()))
+	frame.add("frame.protocols", "diameter")
+
+	d := ekLayer{}
+	d.add("diameter.version", "1")
+	d.add("diameter.length", strconv.FormatUint(uint64(mi.MessageLength), 10))
+	d.add("diameter.flags", fmt.Sprintf("0x%02x", mi.CommandFlags))
+	for _, f := range []struct {
+		name string
+		bit  uint8
+	}{{"request", 0x80}, {"proxyable", 0x40}, {"error", 0x20}, {"T", 0x10}} {
+		d.add("diameter.flags."+f.name, ekBool(mi.CommandFlags&f.bit != 0))
+	}
+	d.add("diameter.cmd.code", strconv.FormatUint(uint64(mi.CommandCode), 10))
+	d.add("diameter.applicationId", strconv.FormatUint(uint64(mi.ApplicationID), 10))
+	d.add("diameter.hopbyhopid", fmt.Sprintf("0x%08x", mi.HopByHopID))
+	d.add("diameter.endtoendid", fmt.Sprintf("0x%08x", mi.EndToEndID))
+	if req != nil {
+		d.add("diameter.answer_to", strconv.Itoa(req.Frame))
+		resp := mi.Timestamp.Sub(req.Timestamp.Time)
+		d.add("diameter.resp_time", strconv.FormatFloat(resp.Seconds(), 'f', 9, 64))
+	}
+	ekAVPs(d, mi.AVPs)
+
+	index := struct {
+		Index struct {
+			Index string `json:"_index"`
+			Type  string `json:"_type"`
+		} `json:"index"`
+	}{}
+	index.Index.Index = "packets-" + mi.Timestamp.Format("2006-01-02")
+	index.Index.Type = "doc"
+	doc := struct {
+		Timestamp   string                 `json:"timestamp"`
+		Layers      map[string]interface{} `json:"layers"`
+		Labels      map[string]string      `json:"labels,omitempty"`
+		Derived     map[string]string      `json:"derived,omitempty"`
+		Warnings    []string               `json:"warnings,omitempty"`
+		Association *AssociationRef        `json:"association,omitempty"`
+	}{
+		Timestamp:   strconv.FormatInt(mi.Timestamp.UnixMilli(), 10),
+		Layers:      map[string]interface{}{"frame": frame, "diameter": d},
+		Labels:      mi.Labels,
+		Derived:     mi.Derived,
+		Warnings:    mi.Warnings,
+		Association: mi.Association,
+	}
+	for _, v := range []interface{}{index, doc} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ekAVPs adds the AVPs at any depth: their code and vendor, and the value
+// under the name of the AVP, as Wireshark names its field.
+func ekAVPs(l ekLayer, avps []AVPInfo) {
+	for _, a := range avps {
+		if _, ok := a.Data.(Truncated); ok {
+			continue
+		}
+		l.add("diameter.avp.code", strconv.FormatUint(uint64(a.Code), 10))
+		if a.VendorID != 0 {
+			l.add("diameter.avp.vendorId", strconv.FormatUint(uint64(a.VendorID), 10))
+		}
+		if g, ok := a.Data.(GroupedData); ok {
+			ekAVPs(l, g.AVPs)
+			continue
+		}
+		if a.Name != "" {
+			l.add("diameter."+a.Name, ekValue(a.Data))
+		}
+	}
+}
+
+// ekValue writes a value as Wireshark displays it: octet strings as
+// colon-separated hex, values this parser decodes (PLMNs, charging
+// identifiers) as their raw octets when it keeps them.
+func ekValue(v interface{}) string {
+	switch x := v.(type) {
+	case []byte:
+		return ekHex(x)
+	case string, int32, uint32, int64, uint64, float32, float64:
+		return valueLabel(x)
+	}
+	if b, err := hex.DecodeString(derivedValue(v, "hex")); err == nil && len(b) > 0 {
+		return ekHex(b)
+	}
+	return valueLabel(v)
+}
+
+func ekHex(b []byte) string {
+	var s strings.Builder
+	for i, x := range b {
+		if i > 0 {
+			s.WriteByte(':')
+		}
+		fmt.Fprintf(&s, "%02x", x)
+	}
+	return s.String()
+}
+
+func ekBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// ekLayer holds the fields of one layer by their ek name; a field seen
+// again becomes an array.
+type ekLayer map[string]interface{}
+
+func (l ekLayer) add(field, v string) {
+	layer, _, _ := strings.Cut(field, ".")
+	k := layer + "_" + strings.ReplaceAll(field, ".", "_")
+	switch old := l[k].(type) {
+	case nil:
+		l[k] = v
+	case string:
+		l[k] = []string{old, v}
+	case []string:
+		l[k] = append(old, v)
+	}
+}
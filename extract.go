@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// runExtract implements "extract": it writes a new pcap holding only the
+// frames that carry messages of one session or subscriber, unmodified, so
+// they can be handed over for vendor escalation.
+func runExtract(args []string) {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	pcapFile := fs.String("pcap", "", "Path to the PCAP file")
+	out := fs.String("o", "", "Path of the PCAP file to write")
+	sessionID := fs.String("session-id", "", "Extract the messages of this Session-Id")
+	imsi := fs.String("imsi", "", "Extract the messages of this IMSI (or MSISDN) and of its sessions")
+	indexPath := fs.String("index", "", "Index of the capture's messages by session and subscriber, built on first use, for quick extractions from large files")
+	fs.Parse(args)
+
+	if *pcapFile == "" || *out == "" {
+		log.Fatal("Please provide the input using -pcap and the output using -o")
+	}
+	if (*sessionID == "") == (*imsi == "") {
+		log.Fatal("Please provide either -session-id or -imsi")
+	}
+
+	var match func(m indexedMessage) bool
+	if *sessionID != "" {
+		match = func(m indexedMessage) bool {
+			return m.Session == *sessionID || m.RequestSession == *sessionID
+		}
+	} else {
+		k, ok := identityKey(*imsi)
+		if !ok {
+			log.Fatalf("%q is not an IMSI or MSISDN of up to 15 digits", *imsi)
+		}
+		filter := &subscriberFilter{allow: &identitySet{keys: []uint64{k}}, sessions: make(map[string]filterSession)}
+		match = func(m indexedMessage) bool {
+			return filter.keepSession(m.IDs, m.Session, m.Ended, time.Unix(0, m.Time))
+		}
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal("Failed to create output:", err)
+	}
+	in := &input{path: *pcapFile}
+	var written, frames int
+	if *indexPath != "" {
+		written, frames = extractIndexed(f, in, *indexPath, match)
+	} else {
+		written, frames = extractScan(f, in, match)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal("Failed to write output:", err)
+	}
+	log.Printf("extracted %d of %d frames to %s", written, frames, *out)
+}
+
+// messageIndex lists the Diameter messages of a capture with the record
+// offset of their frame and what extraction matches them on, so that
+// later extractions from the capture read only the frames they write,
+// and the offset of every frameIndexStep-th record, so that -frame finds
+// a frame without reading the records before it. Messages is nil for an
+// index built by -frame, which reads the record headers only. It is only
+// valid for the capture size and modification time it was built for.
+type messageIndex struct {
+	Version  int              `json:"version"`
+	Size     int64            `json:"size"`
+	ModTime  time.Time        `json:"mod_time"`
+	Frames   int              `json:"frames"`
+	Step     int              `json:"step"`
+	Offsets  []int64          `json:"offsets"` // of frames 1, 1+Step, 1+2*Step...
+	Messages []indexedMessage `json:"messages"`
+}
+
+// indexedMessage is a message as extraction matches it: its Session-Id
+// and, for answers, that of the request when it differs, the identities
+// of the message and its request, and whether it ends the session.
+type indexedMessage struct {
+	Offset         int64    `json:"o"`
+	Time           int64    `json:"t"` // capture time, in nanoseconds since the epoch
+	Session        string   `json:"s,omitempty"`
+	RequestSession string   `json:"r,omitempty"`
+	IDs            []string `json:"i,omitempty"`
+	Ended          bool     `json:"e,omitempty"`
+}
+
+// messageIndexer decodes the frames of a capture into indexed messages.
+type messageIndexer struct {
+	d    *dict.Parser
+	corr *correlator
+}
+
+func newMessageIndexer() *messageIndexer {
+	return &messageIndexer{d: dict.Default, corr: newCorrelator()}
+}
+
+// index returns the message carried by p, false if it carries none.
+func (x *messageIndexer) index(p *rawPacket, off int64) (indexedMessage, bool) {
+	msg, ok := diameterMessage(x.d, p.decode())
+	if !ok {
+		return indexedMessage{}, false
+	}
+	mi := newMessageInfo(x.d, msg)
+	mi.Frame = p.frame
+	mi.Timestamp = Timestamp{p.ts}
+	req := x.corr.match(&mi)
+	m := indexedMessage{Offset: off, Time: p.ts.UnixNano(), Session: mi.str("Session-Id"), IDs: mi.identities()}
+	if req != nil {
+		if s := req.str("Session-Id"); s != m.Session {
+			m.RequestSession = s
+		}
+		m.IDs = append(m.IDs, req.identities()...)
+		m.Ended = sessionEnded(&mi, req)
+	}
+	return m, true
+}
+
+// extractScan decodes the whole capture, through libpcap so that pcapng
+// files are read as well.
+func extractScan(f io.Writer, in *input, match func(indexedMessage) bool) (written, frames int) {
+	var cancel canceller
+	stream, err := openHandleStream(in, &cancel)
+	if err != nil {
+		log.Fatal("Failed to open PCAP file:", err)
+	}
+	defer stream.close()
+
+	w := pcapgo.NewWriterNanos(f)
+	if err := w.WriteFileHeader(uint32(stream.handle.SnapLen()), in.linkType); err != nil {
+		log.Fatal("Failed to write output:", err)
+	}
+	x := newMessageIndexer()
+	for {
+		p, err := stream.next()
+		if err == io.EOF {
+			return written, stream.frame
+		}
+		if err != nil {
+			log.Fatal("read error:", err)
+		}
+		if m, ok := x.index(p, 0); !ok || !match(m) {
+			continue
+		}
+		if err := w.WritePacket(p.ci, p.data); err != nil {
+			log.Fatal("Failed to write output:", err)
+		}
+		written++
+	}
+}
+
+// extractIndexed matches the messages of the index at indexPath, built
+// and written there when missing or out of date, and reads only the
+// frames to write.
+func extractIndexed(f io.Writer, in *input, indexPath string, match func(indexedMessage) bool) (written, frames int) {
+	p, err := openPcapFile(in.path)
+	if err == errNotPcap {
+		log.Printf("%s is not a pcap file (pcapng?), reading it without an index", in.path)
+		return extractScan(f, in, match)
+	}
+	if err != nil {
+		log.Fatal("Failed to open PCAP file:", err)
+	}
+	defer p.f.Close()
+	in.linkType = p.linkType
+
+	fi, err := p.f.Stat()
+	if err != nil {
+		log.Fatal("Failed to open PCAP file:", err)
+	}
+	ix := loadMessageIndex(indexPath, fi, true)
+	if ix == nil {
+		if ix, err = buildMessageIndex(p, in, fi, true); err != nil {
+			log.Fatal("read error:", err)
+		}
+		if err := ix.save(indexPath); err != nil {
+			log.Println("Failed to write message index:", err)
+		}
+	}
+
+	w := pcapgo.NewWriterNanos(f)
+	if err := w.WriteFileHeader(p.snapLen, p.linkType); err != nil {
+		log.Fatal("Failed to write output:", err)
+	}
+	for _, m := range ix.Messages {
+		if !match(m) {
+			continue
+		}
+		if err := p.seek(m.Offset); err != nil {
+			log.Fatal("read error:", err)
+		}
+		ci, data, err := p.read()
+		if err != nil {
+			log.Fatal("read error:", err)
+		}
+		if err := w.WritePacket(ci, data); err != nil {
+			log.Fatal("Failed to write output:", err)
+		}
+		written++
+	}
+	return written, ix.Frames
+}
+
+// loadMessageIndex returns the index of a capture, or nil if the file
+// does not exist, was built for another version of the capture or, with
+// messages, holds no messages.
+func loadMessageIndex(path string, fi os.FileInfo, messages bool) *messageIndex {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var ix messageIndex
+	if err := json.Unmarshal(b, &ix); err != nil || ix.Version != 2 || ix.Step <= 0 ||
+		ix.Size != fi.Size() || !ix.ModTime.Equal(fi.ModTime()) || (messages && ix.Messages == nil) {
+		return nil
+	}
+	return &ix
+}
+
+// buildMessageIndex reads the whole capture, decoding the frames with
+// messages, else only the record headers.
+func buildMessageIndex(p *pcapFile, in *input, fi os.FileInfo, messages bool) (*messageIndex, error) {
+	ix := &messageIndex{Version: 2, Size: fi.Size(), ModTime: fi.ModTime(), Step: frameIndexStep}
+	if err := p.seek(24); err != nil {
+		return nil, err
+	}
+	var x *messageIndexer
+	if messages {
+		x, ix.Messages = newMessageIndexer(), []indexedMessage{}
+	}
+	for {
+		off := p.off
+		var ci gopacket.CaptureInfo
+		var data []byte
+		var err error
+		if messages {
+			ci, data, err = p.read()
+		} else {
+			err = p.skip()
+		}
+		if err == io.EOF {
+			return ix, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ix.Frames%ix.Step == 0 {
+			ix.Offsets = append(ix.Offsets, off)
+		}
+		ix.Frames++
+		if !messages {
+			continue
+		}
+		if m, ok := x.index(&rawPacket{in: in, frame: ix.Frames, ts: ci.Timestamp, ci: ci, data: data}, off); ok {
+			ix.Messages = append(ix.Messages, m)
+		}
+	}
+}
+
+func (ix *messageIndex) save(path string) error {
+	b, err := json.Marshal(ix)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
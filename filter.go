@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sessions of the filter are forgotten after filterSessionIdle of capture
+// time without a message, and beyond maxPending from the least recently
+// active, so that sessions never ended cannot grow memory without limit.
+const filterSessionIdle = time.Hour
+
+// subscriberFilter keeps or drops messages by subscriber identity (IMSI or
+// MSISDN), e.g. to trace test SIMs only or to leave out VIP subscribers.
+// Dropped messages are excluded from every output: records, reports,
+// metrics and spans. The decision taken for a message carrying an
+// identity also applies to the rest of its session, since later messages
+// of a session often only carry the Session-Id.
+type subscriberFilter struct {
+	allow, deny *identitySet // nil when not configured
+	sessions    map[string]filterSession
+	added       int       // decisions remembered, to sweep the idle sessions every 10000
+	latest      time.Time // of the latest message of a session
+}
+
+// filterSession is the decision taken for a session and the time of its
+// latest message.
+type filterSession struct {
+	Keep bool      `json:"keep"`
+	Last Timestamp `json:"last"`
+}
+
+func newSubscriberFilter(allowFile, denyFile string) (*subscriberFilter, error) {
+	f := &subscriberFilter{sessions: make(map[string]filterSession)}
+	var err error
+	if allowFile != "" {
+		if f.allow, err = loadIdentitySet(allowFile); err != nil {
+			return nil, err
+		}
+	}
+	if denyFile != "" {
+		if f.deny, err = loadIdentitySet(denyFile); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// keep reports whether a message passes the lists. For answers, the
+// identities of the matching request are taken into account as well.
+func (f *subscriberFilter) keep(mi *MessageInfo, req *MessageInfo) bool {
+	ids := mi.identities()
+	if req != nil {
+		ids = append(ids, req.identities()...)
+	}
+	return f.keepSession(ids, mi.str("Session-Id"), req != nil && sessionEnded(mi, req), mi.Timestamp.Time)
+}
+
+// keepSession decides for a message of session sid carrying ids, captured
+// at, ended telling whether it is the answer ending the session.
+func (f *subscriberFilter) keepSession(ids []string, sid string, ended bool, at time.Time) bool {
+	keep, decided := f.decide(ids)
+	if !decided {
+		if s, ok := f.sessions[sid]; ok && sid != "" {
+			keep, decided = s.Keep, true
+		}
+	}
+	if !decided {
+		keep = f.allow == nil
+	} else if sid != "" && !ended {
+		f.remember(sid, keep, at)
+	}
+	if ended {
+		delete(f.sessions, sid)
+	}
+	return keep
+}
+
+// remember records the decision for session sid, and forgets the
+// sessions idle for too long.
+func (f *subscriberFilter) remember(sid string, keep bool, at time.Time) {
+	f.sessions[sid] = filterSession{keep, Timestamp{at}}
+	evictOldest(f.sessions, func(s filterSession) time.Time { return s.Last.Time })
+	if at.After(f.latest) {
+		f.latest = at
+	}
+	if f.added++; f.added%10000 == 0 {
+		for sid, s := range f.sessions {
+			if f.latest.Sub(s.Last.Time) > filterSessionIdle {
+				delete(f.sessions, sid)
+			}
+		}
+	}
+}
+
+// decide applies the lists to a set of identities. It returns decided
+// false when the identities alone do not settle the outcome.
+func (f *subscriberFilter) decide(ids []string) (keep, decided bool) {
+	if f.deny != nil {
+		for _, id := range ids {
+			if f.deny.contains(id) {
+				return false, true
+			}
+		}
+	}
+	if f.allow != nil {
+		for _, id := range ids {
+			if f.allow.contains(id) {
+				return true, true
+			}
+		}
+	}
+	return false, false
+}
+
+// identities returns the IMSI and MSISDN values found anywhere in the
+// message, as digit strings.
+func (mi *MessageInfo) identities() []string {
+	var ids []string
+	var walk func(avps []AVPInfo)
+	walk = func(avps []AVPInfo) {
+		for i := range avps {
+			a := &avps[i]
+			switch a.Name {
+			case "User-Name", "Subscription-Id-Data":
+				if s, ok := a.Data.(string); ok && isDigits(s) {
+					ids = append(ids, s)
+				}
+			case "MSISDN":
+				switch n := a.Data.(type) {
+				case *E164Number:
+					ids = append(ids, n.Digits)
+					if e := strings.TrimPrefix(n.E164, "+"); e != "" && e != n.Digits {
+						ids = append(ids, e)
+					}
+				case []byte:
+					ids = append(ids, decodeTBCD(n))
+				}
+			}
+			walk(a.children())
+		}
+	}
+	walk(mi.AVPs)
+	return ids
+}
+
+// identitySet is a compact set of identities of up to 15 digits (the
+// IMSI and E.164 maximum), stored as a sorted slice of packed integers so
+// that millions of entries cost 8 bytes each.
+type identitySet struct {
+	keys []uint64
+}
+
+// identityKey packs a digit string into its length and value, so that
+// identities differing only by leading zeros stay distinct.
+func identityKey(s string) (uint64, bool) {
+	if len(s) == 0 || len(s) > 15 {
+		return 0, false
+	}
+	var v uint64
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		v = v*10 + uint64(c-'0')
+	}
+	return uint64(len(s))<<56 | v, true
+}
+
+// loadIdentitySet reads one IMSI or MSISDN per line. A leading "+" is
+// ignored; blank lines and lines starting with "#" are skipped.
+func loadIdentitySet(path string) (*identitySet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := &identitySet{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, ok := identityKey(strings.TrimPrefix(line, "+"))
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: %q is not an IMSI or MSISDN of up to 15 digits", path, n, line)
+		}
+		set.keys = append(set.keys, k)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(set.keys, func(i, j int) bool { return set.keys[i] < set.keys[j] })
+	return set, nil
+}
+
+func (s *identitySet) contains(id string) bool {
+	k, ok := identityKey(strings.TrimPrefix(id, "+"))
+	if !ok {
+		return false
+	}
+	i := sort.Search(len(s.keys), func(i int) bool { return s.keys[i] >= k })
+	return i < len(s.keys) && s.keys[i] == k
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
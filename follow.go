@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// followInterval is how often a followed capture is checked for new
+// packets once the end of the file is reached.
+var followInterval = 200 * time.Millisecond
+
+// errRotated ends the reading of a followed file when a newer file
+// matches the pattern, or when the file was truncated to be rewritten.
+var errRotated = errors.New("capture file rotated")
+
+// followStream reads a capture that is still being written, as tail -F
+// does: at the end of the file it waits for more packets instead of
+// stopping. A packet whose record is only partly written is read once
+// complete. The path may be a glob matching the files of a ring buffer
+// (tcpdump -C/-G with -W): the newest file is followed, and the stream
+// moves on to the next file when it appears.
+type followStream struct {
+	pattern string
+	c       *canceller
+	in      *input // of the file being read
+	f       *os.File
+	r       *pcapgo.Reader
+	frame   int
+}
+
+func openFollowStream(in *input, c *canceller) (*followStream, error) {
+	if _, err := filepath.Match(in.path, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", in.path, err)
+	}
+	return &followStream{pattern: in.path, c: c, in: in}, nil
+}
+
+// open starts reading the newest file matching the pattern, waiting for
+// one to exist and for its file header to be written. Files are opened on
+// the first read, so that the run starts while waiting for them.
+func (s *followStream) open() error {
+	var path string
+	for {
+		if s.c.isStopped() {
+			return errStopped
+		}
+		var err error
+		if path, err = newestMatch(s.pattern); err != nil {
+			return err
+		}
+		if path != "" {
+			break
+		}
+		time.Sleep(followInterval)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	s.close()
+	in := *s.in
+	in.path = path
+	s.in, s.f, s.frame = &in, f, 0
+	r, err := pcapgo.NewReader(&followReader{s: s})
+	if err != nil {
+		if err == errStopped || err == errRotated {
+			return err
+		}
+		return fmt.Errorf("%s: %v (only pcap files can be followed, not pcapng)", path, err)
+	}
+	s.r = r
+	s.in.linkType = layers.LinkType(r.LinkType())
+	log.Printf("following %s", path)
+	return nil
+}
+
+func (s *followStream) next() (*rawPacket, error) {
+	for {
+		if s.r == nil {
+			if err := s.open(); err == errRotated {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		data, ci, err := s.r.ReadPacketData()
+		if err == nil {
+			s.frame++
+			return &rawPacket{in: s.in, frame: s.frame, ts: ci.Timestamp.Add(s.in.offset), ci: ci, data: data}, nil
+		}
+		if err != errRotated {
+			if err == errStopped {
+				return nil, err
+			}
+			// A corrupt record: the rest of the file cannot be framed.
+			log.Printf("%s: %v, waiting for the next file", s.in.path, err)
+			if err := s.waitRotation(); err != nil {
+				return nil, err
+			}
+		}
+		s.r = nil
+	}
+}
+
+// waitRotation returns once the followed file is replaced.
+func (s *followStream) waitRotation() error {
+	for {
+		if s.c.isStopped() {
+			return errStopped
+		}
+		if s.rotated() {
+			return nil
+		}
+		time.Sleep(followInterval)
+	}
+}
+
+// rotated reports whether reading should move to another file: a newer
+// one matches the pattern, or the current one was truncated.
+func (s *followStream) rotated() bool {
+	cur, err := s.f.Stat()
+	if err != nil {
+		return true
+	}
+	if off, err := s.f.Seek(0, io.SeekCurrent); err == nil && cur.Size() < off {
+		return true
+	}
+	path, err := newestMatch(s.pattern)
+	if err != nil || path == "" {
+		return false
+	}
+	fi, err := os.Stat(path)
+	return err == nil && !os.SameFile(fi, cur)
+}
+
+func (s *followStream) close() {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+// followReader reads the followed file, waiting at its end until more is
+// written, the run is stopped or the file is rotated.
+type followReader struct {
+	s *followStream
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.s.f.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		if r.s.c.isStopped() {
+			return 0, errStopped
+		}
+		if r.s.rotated() {
+			// Whatever was appended before the rotation is read first.
+			if n, err = r.s.f.Read(p); n > 0 {
+				return n, nil
+			}
+			return 0, errRotated
+		}
+		time.Sleep(followInterval)
+	}
+}
+
+// newestMatch returns the most recently modified file matching pattern,
+// or "" if none does yet. Ties go to the last name in order, as ring
+// buffer files are numbered.
+func newestMatch(pattern string) (string, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+	var newest string
+	var newestTime time.Time
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if newest == "" || !fi.ModTime().Before(newestTime) {
+			newest, newestTime = p, fi.ModTime()
+		}
+	}
+	return newest, nil
+}
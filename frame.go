@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// frameIndexStep is the number of frames between two offsets of a
+// messageIndex: the offsets of a capture of ten million frames take about
+// 100 KB, and a lookup reads at most that many record headers.
+const frameIndexStep = 1024
+
+// errNotPcap is returned for files not in the classic pcap format, such
+// as pcapng, which are read through libpcap without an index.
+var errNotPcap = errors.New("not a pcap file")
+
+// pcapFile reads the records of a classic pcap file, skipping the packet
+// data of records that are not wanted.
+type pcapFile struct {
+	f        *os.File
+	r        *bufio.Reader
+	off      int64 // of the next record
+	order    binary.ByteOrder
+	nanos    bool
+	snapLen  uint32
+	linkType layers.LinkType
+}
+
+func openPcapFile(path string) (*pcapFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcapFile{f: f, r: bufio.NewReaderSize(f, 1<<16), off: 24}
+	var hdr [24]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		f.Close()
+		return nil, errNotPcap
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[:]) == 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[:]) == 0xa1b2c3d4:
+		p.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[:]) == 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[:]) == 0xa1b23c4d:
+		p.order, p.nanos = binary.BigEndian, true
+	default:
+		f.Close()
+		return nil, errNotPcap
+	}
+	p.snapLen = p.order.Uint32(hdr[16:])
+	p.linkType = layers.LinkType(p.order.Uint32(hdr[20:]) & 0xffff)
+	return p, nil
+}
+
+func (p *pcapFile) seek(off int64) error {
+	if _, err := p.f.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	p.r.Reset(p.f)
+	p.off = off
+	return nil
+}
+
+// header reads the header of the next record, io.EOF at the end.
+func (p *pcapFile) header() (gopacket.CaptureInfo, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return gopacket.CaptureInfo{}, fmt.Errorf("truncated record header at offset %d", p.off)
+		}
+		return gopacket.CaptureInfo{}, err
+	}
+	frac := time.Duration(p.order.Uint32(hdr[4:]))
+	if !p.nanos {
+		frac *= time.Microsecond
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(int64(p.order.Uint32(hdr[0:])), int64(frac)),
+		CaptureLength: int(p.order.Uint32(hdr[8:])),
+		Length:        int(p.order.Uint32(hdr[12:])),
+	}
+	if ci.CaptureLength > 1<<18 {
+		return ci, fmt.Errorf("invalid record length %d at offset %d", ci.CaptureLength, p.off)
+	}
+	p.off += 16
+	return ci, nil
+}
+
+// skip passes over the next record.
+func (p *pcapFile) skip() error {
+	ci, err := p.header()
+	if err != nil {
+		return err
+	}
+	if _, err := p.r.Discard(ci.CaptureLength); err != nil {
+		return fmt.Errorf("truncated record at offset %d", p.off)
+	}
+	p.off += int64(ci.CaptureLength)
+	return nil
+}
+
+func (p *pcapFile) read() (gopacket.CaptureInfo, []byte, error) {
+	ci, err := p.header()
+	if err != nil {
+		return ci, nil, err
+	}
+	data := make([]byte, ci.CaptureLength)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return ci, nil, fmt.Errorf("truncated record at offset %d", p.off)
+	}
+	p.off += int64(ci.CaptureLength)
+	return ci, data, nil
+}
+
+// readFrame returns frame n (from 1) of a capture file. With an index
+// path, the index is used when it matches the capture, else built and
+// written there for the next lookups.
+func readFrame(in *input, n int, indexPath string) (*rawPacket, error) {
+	p, err := openPcapFile(in.path)
+	if err == errNotPcap {
+		if indexPath != "" {
+			log.Printf("%s is not a pcap file (pcapng?), reading it without an index", in.path)
+		}
+		return scanFrame(in, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer p.f.Close()
+	in.linkType = p.linkType
+
+	frame := 1
+	if indexPath != "" {
+		fi, err := p.f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		ix := loadMessageIndex(indexPath, fi, false)
+		if ix == nil {
+			if ix, err = buildMessageIndex(p, in, fi, false); err != nil {
+				return nil, err
+			}
+			if err := ix.save(indexPath); err != nil {
+				log.Println("Failed to write frame index:", err)
+			}
+		}
+		if n > ix.Frames {
+			return nil, fmt.Errorf("%s has %d frames", in.path, ix.Frames)
+		}
+		i := (n - 1) / ix.Step
+		if err := p.seek(ix.Offsets[i]); err != nil {
+			return nil, err
+		}
+		frame = 1 + i*ix.Step
+	}
+	for ; frame < n; frame++ {
+		if err := p.skip(); err == io.EOF {
+			return nil, fmt.Errorf("%s has %d frames", in.path, frame-1)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	ci, data, err := p.read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s has %d frames", in.path, n-1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rawPacket{in: in, frame: n, ts: ci.Timestamp.Add(in.offset), ci: ci, data: data}, nil
+}
+
+// scanFrame reads the frames up to n through libpcap.
+func scanFrame(in *input, n int) (*rawPacket, error) {
+	var c canceller
+	s, err := openHandleStream(in, &c)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	for {
+		p, err := s.next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s has %d frames", in.path, s.frame)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.frame == n {
+			return p, nil
+		}
+	}
+}
+
+// showFrame prints one frame in full: its Diameter message as a tree with
+// the offset and length of every AVP in the frame, the protocol
+// violations, and a hex dump of the frame.
+func showFrame(w io.Writer, d *dict.Parser, p *rawPacket, plugins *dictPlugins, utc bool) error {
+	packet := p.decode()
+	if plugins != nil {
+		if err := plugins.requireFor(packet); err != nil {
+			return err
+		}
+	}
+	ts := p.ts
+	if utc {
+		ts = ts.UTC()
+	}
+	fmt.Fprintf(w, "Frame %d: %d bytes captured (%d on the wire), %s, %s\n",
+		p.frame, p.ci.CaptureLength, p.ci.Length, formatTime(ts), p.in.path)
+	if msg, ok := diameterMessage(d, packet); ok {
+		mi := newMessageInfo(d, msg)
+		frameOffset := payloadOffset(packet)
+		setFrameOffsets(mi.AVPs, frameOffset)
+		kind := "Answer"
+		if mi.isRequest() {
+			kind = "Request"
+		}
+		fmt.Fprintf(w, "Diameter %s %s, at offset %d\n", or(mi.CommandCodeName, commandLabel(mi.CommandCode)), kind, frameOffset)
+		fmt.Fprintf(w, "    Version: %d, Length: %d\n", msg.Header.Version, mi.MessageLength)
+		fmt.Fprintf(w, "    Flags: 0x%02x %s\n", mi.CommandFlags, mi.CommandFlagsName)
+		fmt.Fprintf(w, "    Command Code: %d\n", mi.CommandCode)
+		fmt.Fprintf(w, "    Application Id: %d %s\n", mi.ApplicationID, mi.ApplicationName)
+		fmt.Fprintf(w, "    Hop-by-Hop Id: 0x%08x\n", mi.HopByHopID)
+		fmt.Fprintf(w, "    End-to-End Id: 0x%08x\n", mi.EndToEndID)
+		writeAVPTree(w, mi.ApplicationID, mi.AVPs, 1)
+
+		if warnings := checkMessage(d, msg); len(warnings) > 0 {
+			fmt.Fprintf(w, "Violations: %d\n", len(warnings))
+			for _, v := range warnings {
+				fmt.Fprintf(w, "    %s\n", v)
+			}
+		} else {
+			fmt.Fprintln(w, "Violations: none")
+		}
+	} else {
+		fmt.Fprintln(w, "No Diameter message in this frame")
+	}
+	fmt.Fprintln(w)
+	_, err := io.WriteString(w, hex.Dump(p.data))
+	return err
+}
+
+// writeAVPTree writes one line per AVP, members indented below grouped
+// AVPs: [offset+length] in the frame, name, code, vendor and value.
+func writeAVPTree(w io.Writer, appID uint32, avps []AVPInfo, depth int) {
+	indent := strings.Repeat("    ", depth)
+	for i := range avps {
+		a := &avps[i]
+		// -max-avps leaves one entry in place of the AVPs left out.
+		t, truncated := a.Data.(Truncated)
+		if truncated && t.Truncated == "max-avps" {
+			fmt.Fprintf(w, "%s... %d AVPs not expanded (%s)\n", indent, t.Omitted, t.Truncated)
+			continue
+		}
+		id := fmt.Sprintf("%d", a.Code)
+		if a.VendorID != 0 {
+			id += fmt.Sprintf(", vendor %d", a.VendorID)
+		}
+		head := fmt.Sprintf("%s[%d+%d] %s (%s)", indent, a.FrameOffset, a.Length, or(a.Name, "Unknown AVP"), id)
+		if truncated {
+			fmt.Fprintf(w, "%s: ... %d AVPs not expanded (%s)\n", head, t.Omitted, t.Truncated)
+			continue
+		}
+		if g, ok := a.Data.(GroupedData); ok {
+			fmt.Fprintln(w, head)
+			writeAVPTree(w, appID, g.AVPs, depth+1)
+			continue
+		}
+		v := valueLabel(a.Data)
+		if name := valueName(appID, a); name != "" {
+			v += " (" + name + ")"
+		} else if h := humanAVP(a); h != "" {
+			v += " (" + h + ")"
+		}
+		fmt.Fprintf(w, "%s: %s\n", head, v)
+	}
+}
@@ -2,10 +2,12 @@ module diameter-parser
 
 go 1.24.3
 
-require github.com/fiorix/go-diameter/v4 v4.0.4
+require (
+	github.com/fiorix/go-diameter/v4 v4.0.4
+	github.com/google/gopacket v1.1.19
+)
 
 require (
-	github.com/google/gopacket v1.1.19 // indirect
 	github.com/ishidawataru/sctp v0.0.0-20190922091402-408ec287e38c // indirect
 	golang.org/x/net v0.0.0-20191007182048-72f939374954 // indirect
 	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
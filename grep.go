@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/google/gopacket"
+)
+
+// grep exits as grep(1) does: 0 when a message matches, 1 when none does,
+// and 2 or more on errors: 2 for the command line and read errors, and
+// exitInput and exitConfig as the main command.
+const (
+	exitNoMatch   = 1
+	exitGrepError = 2
+)
+
+// runGrep implements "grep": it prints the frames of a capture carrying an
+// AVP whose value matches a regular expression, e.g.
+//
+//	diameter-parser grep -pcap capture.pcap 'Session-Id ~ mme01.*12345'
+//
+// Messages are not decoded: the AVPs are walked in the raw message, and
+// only the values of the AVP searched for are read, so a large capture is
+// searched quickly. Matching messages are then decoded for their summary.
+func runGrep(args []string) {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	pcapFile := fs.String("pcap", "", "Path to the PCAP file")
+	dictDir := fs.String("dict-dir", "", "Directory of extra XML dictionaries")
+	asJSON := fs.Bool("json", false, "Print the matching messages as records instead of one summary line each")
+	count := fs.Bool("count", false, "Only print the number of matching messages")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: diameter-parser grep -pcap FILE [flags] 'AVP ~ REGEXP'\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *pcapFile == "" {
+		fatal(exitUsage, "Please provide the capture using -pcap")
+	}
+	name, re, err := parseGrepQuery(strings.Join(fs.Args(), " "))
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+
+	// Any application may be in the capture.
+	d, err := loadAllDictionaries(*dictDir)
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+
+	var cancel canceller
+	stream, err := openHandleStream(&input{path: *pcapFile}, &cancel)
+	if err != nil {
+		fatal(exitInput, err)
+	}
+	defer stream.close()
+	lazy := gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	matches := 0
+	for {
+		p, err := stream.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatal(exitGrepError, err)
+		}
+		packet := gopacket.NewPacket(p.data, p.in.linkType, lazy)
+		payload := diameterPayload(packet)
+		value, ok := grepMessage(d, payload, name, re)
+		if !ok {
+			continue
+		}
+		matches++
+		if *count {
+			continue
+		}
+		msg, err := diam.ReadMessage(bytes.NewReader(payload), d)
+		if err != nil {
+			fmt.Printf("%d\t%s\t%s=%s\t(%v)\n", p.frame, formatTime(p.ts), name, value, err)
+			continue
+		}
+		mi := newMessageInfo(d, msg)
+		mi.Frame, mi.Timestamp = p.frame, Timestamp{p.ts}
+		if *asJSON {
+			out, err := json.MarshalIndent(mi, "", "  ")
+			if err != nil {
+				fatal(exitGrepError, err)
+			}
+			fmt.Println(string(out))
+			continue
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s=%s\n", p.frame, formatTime(p.ts),
+			shortCommandName(mi.CommandCode, mi.isRequest()), or(mi.str("Origin-Host"), "-"), name, value)
+	}
+	if *count {
+		fmt.Println(matches)
+	}
+	if matches == 0 {
+		os.Exit(exitNoMatch)
+	}
+}
+
+// parseGrepQuery reads "AVP ~ REGEXP"; the AVP is named as in the records,
+// or given by its code.
+func parseGrepQuery(q string) (string, *regexp.Regexp, error) {
+	name, expr, ok := strings.Cut(q, "~")
+	name, expr = strings.TrimSpace(name), strings.TrimSpace(expr)
+	if !ok || name == "" {
+		return "", nil, fmt.Errorf("the query must be AVP ~ REGEXP, e.g. 'Session-Id ~ mme01.*12345', got %q", q)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	return name, re, nil
+}
+
+// grepMessage returns the first value of the AVP name matching re in a
+// raw Diameter message.
+func grepMessage(d *dict.Parser, payload []byte, name string, re *regexp.Regexp) (string, bool) {
+	if len(payload) < diam.HeaderLength || payload[0] != 1 {
+		return "", false
+	}
+	length := int(binary.BigEndian.Uint32(payload[0:4]) & 0xffffff)
+	if length < diam.HeaderLength || length > len(payload) {
+		return "", false
+	}
+	appID := binary.BigEndian.Uint32(payload[8:12])
+	// Numbers are normalized in the country of the message, as in the
+	// records; it is only looked for when a number AVP is found.
+	var numbers *numberContext
+	context := func() numberContext {
+		if numbers == nil {
+			numbers = &numberContext{}
+			if msg, err := diam.ReadMessage(bytes.NewReader(payload[:length]), d); err == nil {
+				*numbers = newNumberContext(msg)
+			}
+		}
+		return *numbers
+	}
+	return grepAVPs(d, appID, payload[diam.HeaderLength:length], name, re, 1, context)
+}
+
+func grepAVPs(d *dict.Parser, appID uint32, b []byte, name string, re *regexp.Regexp, depth int, numbers func() numberContext) (string, bool) {
+	for len(b) >= 8 {
+		code := binary.BigEndian.Uint32(b[0:4])
+		flags := b[4]
+		length := int(binary.BigEndian.Uint32(b[4:8]) & 0xffffff)
+		hdr, vendor := 8, uint32(0)
+		if flags&0x80 != 0 {
+			if len(b) < 12 {
+				return "", false
+			}
+			hdr, vendor = 12, binary.BigEndian.Uint32(b[8:12])
+		}
+		if length < hdr || length > len(b) {
+			return "", false // malformed: the rest cannot be framed
+		}
+		data := b[hdr:length]
+		def := avpDefFromDict(d, appID, code, vendor)
+		switch {
+		case def != nil && def.Data.Type == datatype.GroupedType:
+			if maxDepth == 0 || depth < maxDepth {
+				if v, ok := grepAVPs(d, appID, data, name, re, depth+1, numbers); ok {
+					return v, true
+				}
+			}
+		case grepNameMatches(def, code, name):
+			if v, ok := grepValue(def, data, re, numbers); ok {
+				return v, true
+			}
+		}
+		next := (length + 3) &^ 3
+		if next > len(b) {
+			break
+		}
+		b = b[next:]
+	}
+	return "", false
+}
+
+func grepNameMatches(def *dict.AVP, code uint32, name string) bool {
+	if def != nil && def.Name == name {
+		return true
+	}
+	n, err := strconv.ParseUint(name, 10, 32)
+	return err == nil && uint32(n) == code
+}
+
+// grepValue matches the value as the records print it: strings as such,
+// numbers in decimal or by their enumerated name, octet strings in hex,
+// PLMNs as MCC-MNC and MSISDN and node numbers in E.164 or as sent.
+func grepValue(def *dict.AVP, data []byte, re *regexp.Regexp, numbers func() numberContext) (string, bool) {
+	var values []string
+	if def == nil {
+		values = append(values, valueLabel(data))
+	} else {
+		v, err := datatype.Decode(def.Data.Type, data)
+		if err != nil {
+			return "", false
+		}
+		values = append(values, valueLabel(avpToJSONValue(v)))
+		if e, ok := v.(datatype.Enumerated); ok {
+			for _, en := range def.Data.Enum {
+				if en.Code == int32(e) {
+					values = append(values, en.Name)
+					break
+				}
+			}
+		}
+		if subscriberNumbers[def.Name] || nodeNumbers[def.Name] {
+			if n := numbers().number(def.Name, v); n != nil {
+				values = append(values, valueLabel(n), n.Digits)
+			}
+		}
+		if def.Name == "Visited-PLMN-Id" {
+			if plmn := decodePLMN(data); plmn != nil {
+				values = append(values, valueLabel(plmn))
+			}
+		}
+	}
+	for _, v := range values {
+		if re.MatchString(v) {
+			return v, true
+		}
+	}
+	return "", false
+}
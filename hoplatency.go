@@ -0,0 +1,315 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// hopLatencyReport attributes the answer delay of transactions captured at
+// two points, e.g. on both sides of a DRA or firewall (merge the captures
+// with repeated -pcap). The copies of a request and of its answer share the
+// Session-Id, End-to-End ID and command code; a copy is taken at another
+// point when it comes from another input, or in a single capture when its
+// Hop-by-Hop ID differs, as it does behind a relay. For every transaction
+// seen at both points
+//
+//	client -> near point -> [segment] -> far point -> [beyond] -> server
+//
+// the delay splits into the segment between the points, both ways, and the
+// time beyond the far point. The near point is the one seeing the longer
+// answer delay, and a constant clock offset between the captures cancels
+// out of the segment and beyond times: only the split of the segment into
+// its request and answer legs depends on it. The copies are thus matched
+// in any order, as an offset may reorder them in the merged stream.
+type hopLatencyReport struct {
+	pending    map[hopTxKey]*hopTx
+	groups     map[hopGroupKey]*hopGroup
+	slowest    []HopTransaction
+	added      int
+	matched    int
+	singlePt   int // seen at one point only
+	incomplete int // a copy missing at one of the points
+	skewed     int // a leg of the segment below zero
+}
+
+type hopTxKey struct {
+	sessionID string
+	e2e       uint32
+	code      uint32
+}
+
+// hopTx holds the request and answer copies of a transaction at the point
+// of its first copy and at the other point.
+type hopTx struct {
+	first      time.Time
+	this, next hopCopies
+}
+
+type hopCopies struct {
+	req, ans *MessageInfo
+}
+
+// of returns the copies at the point of mi.
+func (tx *hopTx) of(mi *MessageInfo) *hopCopies {
+	for _, c := range []*MessageInfo{tx.this.req, tx.this.ans} {
+		if c != nil {
+			if sameCapturePoint(mi, c) {
+				return &tx.this
+			}
+			return &tx.next
+		}
+	}
+	return &tx.this
+}
+
+func (tx *hopTx) complete() bool {
+	return tx.this.req != nil && tx.this.ans != nil && tx.next.req != nil && tx.next.ans != nil
+}
+
+type hopGroupKey struct {
+	near, far string
+	code      uint32
+	appID     uint32
+	server    string
+}
+
+type hopGroup struct {
+	transactions           int
+	total, segment, beyond *tdigest // milliseconds
+	requestLeg, answerLeg  *tdigest
+	segmentSum, beyondSum  float64
+}
+
+// HopLatencyStats are the transactions of one command answered by one
+// server between two capture points. Latencies are in milliseconds; the
+// segment share is the part of the total delay spent between the points,
+// and the dominant hop the one contributing most of it.
+type HopLatencyStats struct {
+	NearPoint        string       `json:"near_point,omitempty"`
+	FarPoint         string       `json:"far_point,omitempty"`
+	Command          string       `json:"command"`
+	ApplicationID    uint32       `json:"application_id"`
+	ApplicationName  string       `json:"application_name,omitempty"`
+	Server           string       `json:"server"`
+	Transactions     int          `json:"transactions"`
+	TotalMillis      Distribution `json:"total_ms"`
+	SegmentMillis    Distribution `json:"segment_ms"`
+	BeyondMillis     Distribution `json:"beyond_ms"`
+	RequestLegMillis Distribution `json:"segment_request_ms"`
+	AnswerLegMillis  Distribution `json:"segment_answer_ms"`
+	SegmentShare     float64      `json:"segment_share"`
+	Dominant         string       `json:"dominant"` // "segment" or "beyond"
+}
+
+// HopTransaction is one transaction with its four frames, each numbered
+// in the capture of its point.
+type HopTransaction struct {
+	Command       string  `json:"command"`
+	SessionID     string  `json:"session_id"`
+	NearPoint     string  `json:"near_point,omitempty"`
+	FarPoint      string  `json:"far_point,omitempty"`
+	NearRequest   int     `json:"near_request_frame"`
+	FarRequest    int     `json:"far_request_frame"`
+	FarAnswer     int     `json:"far_answer_frame"`
+	NearAnswer    int     `json:"near_answer_frame"`
+	SegmentMillis float64 `json:"segment_ms"`
+	BeyondMillis  float64 `json:"beyond_ms"`
+}
+
+func newHopLatencyReport() (report, error) {
+	return &hopLatencyReport{
+		pending: make(map[hopTxKey]*hopTx),
+		groups:  make(map[hopGroupKey]*hopGroup),
+		slowest: []HopTransaction{},
+	}, nil
+}
+
+func (r *hopLatencyReport) add(mi *MessageInfo, req *MessageInfo) {
+	// Transactions are told apart by their session; the base protocol
+	// messages without one are not relayed.
+	sid := mi.str("Session-Id")
+	if sid == "" {
+		return
+	}
+	k := hopTxKey{sid, mi.EndToEndID, mi.CommandCode}
+	tx := r.pending[k]
+	if tx != nil && mi.Timestamp.Sub(tx.first) > draMaxDelay {
+		delete(r.pending, k)
+		r.expire(tx)
+		tx = nil
+	}
+	if tx == nil {
+		tx = &hopTx{first: mi.Timestamp.Time}
+		r.pending[k] = tx
+		for _, old := range evictOldest(r.pending, func(tx *hopTx) time.Time { return tx.first }) {
+			r.expire(old)
+		}
+	}
+	// Retransmissions and repeated answers are timed from their first copy.
+	c := tx.of(mi)
+	if mi.isRequest() && c.req == nil {
+		c.req = mi
+	} else if !mi.isRequest() && c.ans == nil {
+		c.ans = mi
+	}
+	if tx.complete() {
+		delete(r.pending, k)
+		r.attribute(tx)
+	}
+
+	r.added++
+	if r.added%10000 == 0 {
+		for k, tx := range r.pending {
+			if mi.Timestamp.Sub(tx.first) > draMaxDelay {
+				delete(r.pending, k)
+				r.expire(tx)
+			}
+		}
+	}
+}
+
+// expire counts a transaction that was not seen in full.
+func (r *hopLatencyReport) expire(tx *hopTx) {
+	if tx.next.req == nil && tx.next.ans == nil {
+		r.singlePt++
+	} else {
+		r.incomplete++
+	}
+}
+
+// sameCapturePoint reports whether two copies of a transaction were taken
+// at the same point: the same input, or in a single capture the same
+// Hop-by-Hop ID.
+func sameCapturePoint(a, b *MessageInfo) bool {
+	if a.Input != "" || b.Input != "" {
+		return a.Input == b.Input
+	}
+	return a.HopByHopID == b.HopByHopID
+}
+
+func (r *hopLatencyReport) attribute(tx *hopTx) {
+	ms := func(from, to *MessageInfo) float64 {
+		return float64(to.Timestamp.Sub(from.Timestamp.Time)) / float64(time.Millisecond)
+	}
+	near, far := tx.this, tx.next
+	if ms(near.req, near.ans) < ms(far.req, far.ans) {
+		near, far = far, near
+	}
+	requestLeg, answerLeg := ms(near.req, far.req), ms(far.ans, near.ans)
+	beyond, total := ms(far.req, far.ans), ms(near.req, near.ans)
+	segment := requestLeg + answerLeg
+	r.matched++
+	if requestLeg < 0 || answerLeg < 0 {
+		r.skewed++
+	}
+
+	k := hopGroupKey{near.req.Input, far.req.Input, near.req.CommandCode, near.req.ApplicationID, or(far.ans.str("Origin-Host"), "unknown")}
+	g := r.groups[k]
+	if g == nil {
+		g = &hopGroup{total: newTDigest(), segment: newTDigest(), beyond: newTDigest(), requestLeg: newTDigest(), answerLeg: newTDigest()}
+		r.groups[k] = g
+	}
+	g.transactions++
+	g.total.add(total)
+	g.segment.add(segment)
+	g.beyond.add(beyond)
+	g.requestLeg.add(requestLeg)
+	g.answerLeg.add(answerLeg)
+	g.segmentSum += segment
+	g.beyondSum += beyond
+
+	r.slowest = append(r.slowest, HopTransaction{
+		Command:       shortCommandName(near.req.CommandCode, true),
+		SessionID:     near.req.str("Session-Id"),
+		NearPoint:     near.req.Input,
+		FarPoint:      far.req.Input,
+		NearRequest:   near.req.Frame,
+		FarRequest:    far.req.Frame,
+		FarAnswer:     far.ans.Frame,
+		NearAnswer:    near.ans.Frame,
+		SegmentMillis: roundMillis(segment),
+		BeyondMillis:  roundMillis(beyond),
+	})
+	if reportTop > 0 && len(r.slowest) >= 2*reportTop {
+		r.trimSlowest()
+	}
+}
+
+// trimSlowest keeps the reportTop transactions with the slowest segments.
+func (r *hopLatencyReport) trimSlowest() {
+	sort.SliceStable(r.slowest, func(i, j int) bool { return r.slowest[i].SegmentMillis > r.slowest[j].SegmentMillis })
+	if reportTop > 0 && len(r.slowest) > reportTop {
+		r.slowest = r.slowest[:reportTop]
+	}
+}
+
+func (r *hopLatencyReport) write(w io.Writer) error {
+	for _, tx := range r.pending {
+		r.expire(tx)
+	}
+	r.pending = make(map[hopTxKey]*hopTx)
+	r.trimSlowest()
+
+	hops := make([]HopLatencyStats, 0, len(r.groups))
+	for k, g := range r.groups {
+		s := HopLatencyStats{
+			NearPoint:        k.near,
+			FarPoint:         k.far,
+			Command:          shortCommandName(k.code, true),
+			ApplicationID:    k.appID,
+			ApplicationName:  applicationName(k.appID),
+			Server:           k.server,
+			Transactions:     g.transactions,
+			TotalMillis:      millisDistribution(g.total),
+			SegmentMillis:    millisDistribution(g.segment),
+			BeyondMillis:     millisDistribution(g.beyond),
+			RequestLegMillis: millisDistribution(g.requestLeg),
+			AnswerLegMillis:  millisDistribution(g.answerLeg),
+			Dominant:         "beyond",
+		}
+		if sum := g.segmentSum + g.beyondSum; sum > 0 {
+			s.SegmentShare = math.Round(g.segmentSum/sum*1000) / 1000
+		}
+		if g.segmentSum > g.beyondSum {
+			s.Dominant = "segment"
+		}
+		hops = append(hops, s)
+	}
+	sort.Slice(hops, func(i, j int) bool {
+		a, b := hops[i], hops[j]
+		if a.Transactions != b.Transactions {
+			return a.Transactions > b.Transactions
+		}
+		if a.Command != b.Command {
+			return a.Command < b.Command
+		}
+		return a.Server < b.Server
+	})
+	return writeJSON(w, struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Warnings    []string          `json:"warnings,omitempty"`
+		Matched     int               `json:"matched"`
+		SinglePoint int               `json:"single_point"`
+		Incomplete  int               `json:"incomplete"`
+		Skewed      int               `json:"skewed,omitempty"`
+		Hops        []HopLatencyStats `json:"hops"`
+		Slowest     []HopTransaction  `json:"slowest_segments"`
+	}{runLabels, reportWarnings(), r.matched, r.singlePt, r.incomplete, r.skewed, hops, r.slowest})
+}
+
+func roundMillis(ms float64) float64 {
+	return math.Round(ms*1000) / 1000
+}
+
+// millisDistribution summarizes a digest of latencies to the microsecond.
+func millisDistribution(t *tdigest) Distribution {
+	return Distribution{
+		Min: roundMillis(t.min),
+		P50: roundMillis(t.quantile(0.50)),
+		P90: roundMillis(t.quantile(0.90)),
+		P99: roundMillis(t.quantile(0.99)),
+		Max: roundMillis(t.max),
+	}
+}
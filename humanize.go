@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// humanize adds to bit rates, octet counts and durations a companion
+// field with the value in readable units, e.g. "150 Mbit/s" or "2.0 GiB".
+var humanize bool
+
+type avpUnit int
+
+const (
+	unitBitrate  avpUnit = iota + 1 // bit/s
+	unitKbitrate                    // kbit/s, the Extended-* rates of TS 29.212
+	unitOctets
+	unitSeconds
+)
+
+// avpUnits are the units of the AVPs humanized, by name.
+var avpUnits = map[string]avpUnit{
+	"Max-Requested-Bandwidth-UL":        unitBitrate,
+	"Max-Requested-Bandwidth-DL":        unitBitrate,
+	"APN-Aggregate-Max-Bitrate-UL":      unitBitrate,
+	"APN-Aggregate-Max-Bitrate-DL":      unitBitrate,
+	"Guaranteed-Bitrate-UL":             unitBitrate,
+	"Guaranteed-Bitrate-DL":             unitBitrate,
+	"Extended-Max-Requested-BW-UL":      unitKbitrate,
+	"Extended-Max-Requested-BW-DL":      unitKbitrate,
+	"Extended-APN-AMBR-UL":              unitKbitrate,
+	"Extended-APN-AMBR-DL":              unitKbitrate,
+	"Extended-GBR-UL":                   unitKbitrate,
+	"Extended-GBR-DL":                   unitKbitrate,
+	"CC-Total-Octets":                   unitOctets,
+	"CC-Input-Octets":                   unitOctets,
+	"CC-Output-Octets":                  unitOctets,
+	"Accounting-Input-Octets":           unitOctets,
+	"Accounting-Output-Octets":          unitOctets,
+	"Volume-Quota-Threshold":            unitOctets,
+	"CC-Time":                           unitSeconds,
+	"Validity-Time":                     unitSeconds,
+	"Session-Timeout":                   unitSeconds,
+	"Authorization-Lifetime":            unitSeconds,
+	"Auth-Grace-Period":                 unitSeconds,
+	"Acct-Interim-Interval":             unitSeconds,
+	"Quota-Holding-Time":                unitSeconds,
+	"Quota-Consumption-Time":            unitSeconds,
+	"Time-Quota-Threshold":              unitSeconds,
+	"Subscribed-Periodic-RAU-TAU-Timer": unitSeconds,
+}
+
+// humanAVP returns the value of a unit AVP in readable units, or "".
+func humanAVP(a *AVPInfo) string {
+	u := avpUnits[a.Name]
+	if u == 0 {
+		return ""
+	}
+	v, ok := a.uint()
+	if !ok {
+		return ""
+	}
+	return humanUnit(u, v)
+}
+
+func humanUnit(u avpUnit, v uint64) string {
+	switch u {
+	case unitBitrate:
+		return humanBitrate(v)
+	case unitKbitrate:
+		return humanBitrate(v * 1000)
+	case unitOctets:
+		return humanOctets(v)
+	case unitSeconds:
+		return humanSeconds(v)
+	}
+	return ""
+}
+
+// humanBitrate uses decimal prefixes, as rates are specified.
+func humanBitrate(bps uint64) string {
+	units := []string{"bit/s", "kbit/s", "Mbit/s", "Gbit/s", "Tbit/s"}
+	f, i := float64(bps), 0
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	return strconv.FormatFloat(float64(int64(f*10+0.5))/10, 'f', -1, 64) + " " + units[i]
+}
+
+// humanOctets uses binary prefixes, as volume quotas usually are.
+func humanOctets(n uint64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
+
+// humanSeconds writes a duration without its zero trailing units: 1h,
+// 1h30m, 45s.
+func humanSeconds(s uint64) string {
+	if s > uint64(time.Duration(1<<63-1)/time.Second) {
+		return fmt.Sprintf("%ds", s)
+	}
+	d := (time.Duration(s) * time.Second).String()
+	if strings.HasSuffix(d, "m0s") {
+		d = d[:len(d)-2]
+	}
+	if strings.HasSuffix(d, "h0m") {
+		d = d[:len(d)-2]
+	}
+	return d
+}
+
+// humanOf is humanUnit for the optional fields of typed output.
+func humanOf(u avpUnit, v uint64) string {
+	if !humanize || v == 0 {
+		return ""
+	}
+	return humanUnit(u, v)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// input is one packet source of a run: a capture file or a live interface.
+type input struct {
+	path   string // file path, or interface name when live
+	live   bool
+	follow bool          // a file still being written, or a glob of them (-follow)
+	offset time.Duration // clock skew correction added to every timestamp
+
+	linkType layers.LinkType // set when the input is opened
+	digest   *inputDigest    // of a capture file, for the -manifest
+}
+
+func (in *input) open() (*pcap.Handle, error) {
+	if in.live {
+		return pcap.OpenLive(in.path, 65535, true, pcap.BlockForever)
+	}
+	return pcap.OpenOffline(in.path)
+}
+
+// listFlag is a flag.Value collecting every occurrence of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// newInputs builds the inputs of a run and applies the -time-offset
+// corrections, given either as DURATION for every input or as
+// PATH=DURATION for a single one.
+func newInputs(files []string, iface string, offsets []string) ([]*input, error) {
+	var inputs []*input
+	for _, f := range files {
+		inputs = append(inputs, &input{path: f})
+	}
+	if iface != "" {
+		inputs = append(inputs, &input{path: iface, live: true})
+	}
+
+	for _, o := range offsets {
+		path, dur := "", o
+		if i := strings.LastIndex(o, "="); i >= 0 {
+			path, dur = o[:i], o[i+1:]
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -time-offset %q: %v", o, err)
+		}
+		found := false
+		for _, in := range inputs {
+			if path == "" || in.path == path {
+				in.offset = d
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid -time-offset %q: no input %q", o, path)
+		}
+	}
+	return inputs, nil
+}
+
+// canceller stops a run from another goroutine. Closing the open handles
+// also unblocks a live capture waiting for packets.
+type canceller struct {
+	mu      sync.Mutex
+	stopped bool
+	handles []*pcap.Handle
+	hooks   []func() // run before closing the handles
+}
+
+// add registers an open handle. It returns false, after closing h, once
+// the run has been stopped.
+func (c *canceller) add(h *pcap.Handle) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		h.Close()
+		return false
+	}
+	c.handles = append(c.handles, h)
+	return true
+}
+
+// beforeStop adds f to what stop runs before closing the handles, with
+// the canceller locked.
+func (c *canceller) beforeStop(f func()) {
+	c.mu.Lock()
+	c.hooks = append(c.hooks, f)
+	c.mu.Unlock()
+}
+
+// whileOpen runs f unless the run was stopped, the handles staying open
+// until it returns.
+func (c *canceller) whileOpen(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopped {
+		f()
+	}
+}
+
+func (c *canceller) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	for _, f := range c.hooks {
+		f()
+	}
+	for _, h := range c.handles {
+		h.Close()
+	}
+}
+
+func (c *canceller) isStopped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopped
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Kafka sink produces one message per record, compact JSON keyed by
+// Session-Id, so that the records of a session go to one partition, the
+// one Java clients would choose (murmur2 of the key). It speaks the wire
+// protocol itself: Metadata v4 to find the partition leaders and Produce
+// v3 with version 2 record batches, supported by brokers since Kafka 0.11,
+// acknowledged by the leader. Batches are sent by a goroutine of their
+// own, as spans are, so that slow brokers do not hold up decoding: when
+// kafkaQueue batches are waiting, further ones are dropped. A batch the
+// brokers do not take is sent again once, after fetching the metadata
+// again, then dropped and logged.
+const (
+	kafkaBatchSize     = 1000
+	kafkaFlushInterval = time.Second
+	kafkaQueue         = 16 // batches waiting to be sent
+	kafkaTimeout       = 10 * time.Second
+	kafkaRetryBackoff  = 500 * time.Millisecond
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaWriter struct {
+	brokers []string
+	topic   string
+
+	mu      sync.Mutex
+	records []kafkaRecord
+	ticker  *flushTicker
+
+	batches chan []kafkaRecord
+	queued  atomic.Int64 // records in batches not yet sent
+	lost    atomic.Int64 // records dropped
+	done    sync.WaitGroup
+
+	// Of the sending goroutine.
+	leaders    []int32          // of each partition, nil until fetched
+	addrs      map[int32]string // broker addresses by node ID
+	conns      map[int32]*kafkaConn
+	roundRobin int
+}
+
+type kafkaRecord struct {
+	key, value []byte
+	ts         time.Time
+}
+
+func newKafkaWriter(brokers []string, topic string) *kafkaWriter {
+	k := &kafkaWriter{
+		brokers: brokers,
+		topic:   topic,
+		batches: make(chan []kafkaRecord, kafkaQueue),
+		conns:   make(map[int32]*kafkaConn),
+	}
+	k.done.Add(1)
+	go func() {
+		defer k.done.Done()
+		for records := range k.batches {
+			k.deliver(records)
+			k.queued.Add(-int64(len(records)))
+		}
+	}()
+	k.ticker = startFlushTicker(kafkaFlushInterval, func() {
+		k.mu.Lock()
+		k.flush()
+		k.mu.Unlock()
+	})
+	return k
+}
+
+func (k *kafkaWriter) write(mi *MessageInfo, req *MessageInfo) error {
+	value, err := json.Marshal(mi.record())
+	if err != nil {
+		return err
+	}
+	var key []byte
+	if sid := mi.str("Session-Id"); sid != "" {
+		key = []byte(sid)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.records = append(k.records, kafkaRecord{key, value, mi.Timestamp.Time})
+	if len(k.records) >= kafkaBatchSize {
+		k.flush()
+	}
+	return nil
+}
+
+func (k *kafkaWriter) backlog() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.records) + int(k.queued.Load())
+}
+
+func (k *kafkaWriter) dropped() int {
+	return int(k.lost.Load())
+}
+
+// close sends the records still buffered and waits for the batches queued
+// to be sent.
+func (k *kafkaWriter) close() error {
+	k.ticker.close()
+	if len(k.records) > 0 {
+		k.queued.Add(int64(len(k.records)))
+		k.batches <- k.records
+		k.records = nil
+	}
+	close(k.batches)
+	k.done.Wait()
+	k.reset()
+	if n := k.dropped(); n > 0 {
+		log.Printf("kafka %s: %d records dropped", k.topic, n)
+	}
+	return nil
+}
+
+// flush queues the records for sending, or drops them if the queue is
+// full. k.mu is held.
+func (k *kafkaWriter) flush() {
+	if len(k.records) == 0 {
+		return
+	}
+	k.queued.Add(int64(len(k.records)))
+	select {
+	case k.batches <- k.records:
+	default:
+		k.queued.Add(-int64(len(k.records)))
+		k.lost.Add(int64(len(k.records)))
+	}
+	k.records = nil
+}
+
+// deliver sends a batch, and once more the records the brokers did not
+// take, with the metadata fetched again: leaders move, and a topic just
+// created has none for a moment.
+func (k *kafkaWriter) deliver(records []kafkaRecord) {
+	left, err := k.send(records)
+	if err != nil {
+		k.reset()
+		time.Sleep(kafkaRetryBackoff)
+		left, err = k.send(left)
+	}
+	if err != nil {
+		k.reset()
+		k.lost.Add(int64(len(left)))
+		log.Printf("kafka %s: %d records dropped: %v", k.topic, len(left), err)
+	}
+}
+
+// reset forgets the metadata and the connections to the leaders.
+func (k *kafkaWriter) reset() {
+	k.leaders = nil
+	for id, c := range k.conns {
+		c.conn.Close()
+		delete(k.conns, id)
+	}
+}
+
+// send produces the records, one request per partition leader, and
+// returns those not produced with the first error.
+func (k *kafkaWriter) send(records []kafkaRecord) ([]kafkaRecord, error) {
+	if k.leaders == nil {
+		if err := k.fetchMetadata(); err != nil {
+			return records, err
+		}
+	}
+	byPartition := make(map[int32][]kafkaRecord)
+	for _, r := range records {
+		p := k.partition(r.key)
+		byPartition[p] = append(byPartition[p], r)
+	}
+	byLeader := make(map[int32]map[int32][]kafkaRecord)
+	for p, rs := range byPartition {
+		l := k.leaders[p]
+		if byLeader[l] == nil {
+			byLeader[l] = make(map[int32][]kafkaRecord)
+		}
+		byLeader[l][p] = rs
+	}
+	var left []kafkaRecord
+	var first error
+	for leader, partitions := range byLeader {
+		failed, err := k.produce(leader, partitions)
+		for _, p := range failed {
+			left = append(left, partitions[p]...)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return left, first
+}
+
+// produce sends the records of the partitions led by a broker, and
+// returns the partitions not produced.
+func (k *kafkaWriter) produce(leader int32, partitions map[int32][]kafkaRecord) ([]int32, error) {
+	c, err := k.conn(leader)
+	if err == nil {
+		var failed []int32
+		if failed, err = c.produce(k.topic, partitions); err == nil || failed != nil {
+			return failed, err
+		}
+	}
+	var all []int32
+	for p := range partitions {
+		all = append(all, p)
+	}
+	return all, err
+}
+
+// partition returns the partition of a key as the default partitioner of
+// the Java client does; records without a key are spread in turn.
+func (k *kafkaWriter) partition(key []byte) int32 {
+	n := int32(len(k.leaders))
+	if key == nil {
+		k.roundRobin++
+		return int32(k.roundRobin) % n
+	}
+	return int32(murmur2(key)&0x7fffffff) % n
+}
+
+func (k *kafkaWriter) conn(node int32) (*kafkaConn, error) {
+	if c := k.conns[node]; c != nil {
+		return c, nil
+	}
+	addr, ok := k.addrs[node]
+	if !ok {
+		return nil, fmt.Errorf("partition leader %d not among the brokers", node)
+	}
+	c, err := dialKafka(addr)
+	if err != nil {
+		return nil, err
+	}
+	k.conns[node] = c
+	return c, nil
+}
+
+// fetchMetadata finds the leader of every partition of the topic from the
+// first broker answering.
+func (k *kafkaWriter) fetchMetadata() error {
+	var err error
+	for _, b := range k.brokers {
+		var c *kafkaConn
+		if c, err = dialKafka(b); err != nil {
+			continue
+		}
+		k.leaders, k.addrs, err = c.metadata(k.topic)
+		c.conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// kafkaConn is a connection to a broker.
+type kafkaConn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	correlationID int32
+}
+
+func dialKafka(addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// roundTrip sends a request and returns the body of its response.
+func (c *kafkaConn) roundTrip(apiKey, version int16, body []byte) (*kafkaReader, error) {
+	c.correlationID++
+	var req kafkaBuffer
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(c.correlationID)
+	req.string("diameter-parser")
+	req.Write(body)
+
+	c.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(req.Len()))
+	if _, err := c.conn.Write(append(size[:], req.Bytes()...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	r := &kafkaReader{b: resp}
+	if id := r.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("kafka: response %d to request %d", id, c.correlationID)
+	}
+	return r, nil
+}
+
+func (c *kafkaConn) metadata(topic string) ([]int32, map[int32]string, error) {
+	var body kafkaBuffer
+	body.int32(1)
+	body.string(topic)
+	body.WriteByte(1) // allow_auto_topic_creation
+	r, err := c.roundTrip(3, 4, body.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	r.int32() // throttle_time_ms
+	addrs := make(map[int32]string)
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id, host, port := r.int32(), r.string(), r.int32()
+		r.string() // rack
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster_id
+	r.int32()  // controller_id
+	var leaders []int32
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code, name := r.int16(), r.string()
+		r.int8() // is_internal
+		if code != 0 {
+			return nil, nil, kafkaError("metadata of "+name, code)
+		}
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			code, index, leader := r.int16(), r.int32(), r.int32()
+			for i := r.int32(); i > 0 && r.err == nil; i-- {
+				r.int32() // replica_nodes
+			}
+			for i := r.int32(); i > 0 && r.err == nil; i-- {
+				r.int32() // isr_nodes
+			}
+			if index < 0 || index >= 1<<16 {
+				return nil, nil, fmt.Errorf("kafka: invalid partition %d", index)
+			}
+			// Without a replica, the leader still takes records.
+			if code != 0 && code != kafkaReplicaNotAvailable && r.err == nil {
+				return nil, nil, kafkaError(fmt.Sprintf("metadata of %s/%d", name, index), code)
+			}
+			for int32(len(leaders)) <= index {
+				leaders = append(leaders, -1)
+			}
+			leaders[index] = leader
+		}
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	if len(leaders) == 0 {
+		return nil, nil, fmt.Errorf("kafka: topic %s has no partitions", topic)
+	}
+	return leaders, addrs, nil
+}
+
+// produce sends the records of partitions and returns those refused by
+// their error code; all were if the error comes without any.
+func (c *kafkaConn) produce(topic string, partitions map[int32][]kafkaRecord) ([]int32, error) {
+	var body kafkaBuffer
+	body.int16(-1) // transactional_id: null
+	body.int16(1)  // acks: the leader
+	body.int32(int32(kafkaTimeout / time.Millisecond))
+	body.int32(1)
+	body.string(topic)
+	body.int32(int32(len(partitions)))
+	for p, records := range partitions {
+		batch := recordBatch(records)
+		body.int32(p)
+		body.int32(int32(len(batch)))
+		body.Write(batch)
+	}
+	r, err := c.roundTrip(0, 3, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var failed []int32
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.string()
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			index, code := r.int32(), r.int16()
+			r.int64() // base_offset
+			r.int64() // log_append_time_ms
+			if code != 0 && r.err == nil {
+				failed = append(failed, index)
+				if err == nil {
+					err = kafkaError(fmt.Sprintf("produce to %s/%d", topic, index), code)
+				}
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return failed, err
+}
+
+// recordBatch encodes records in a version 2 record batch, uncompressed.
+func recordBatch(records []kafkaRecord) []byte {
+	first, last := records[0].ts, records[0].ts
+	for _, r := range records {
+		if r.ts.Before(first) {
+			first = r.ts
+		}
+		if r.ts.After(last) {
+			last = r.ts
+		}
+	}
+	var recs kafkaBuffer
+	for i, r := range records {
+		var rec kafkaBuffer
+		rec.WriteByte(0) // attributes
+		rec.varint(r.ts.UnixMilli() - first.UnixMilli())
+		rec.varint(int64(i))
+		if r.key == nil {
+			rec.varint(-1)
+		} else {
+			rec.varint(int64(len(r.key)))
+			rec.Write(r.key)
+		}
+		rec.varint(int64(len(r.value)))
+		rec.Write(r.value)
+		rec.varint(0) // headers
+		recs.varint(int64(rec.Len()))
+		recs.Write(rec.Bytes())
+	}
+
+	var tail kafkaBuffer // from attributes on, covered by the CRC
+	tail.int16(0)
+	tail.int32(int32(len(records) - 1))
+	tail.int64(first.UnixMilli())
+	tail.int64(last.UnixMilli())
+	tail.int64(-1) // producer_id
+	tail.int16(-1) // producer_epoch
+	tail.int32(-1) // base_sequence
+	tail.int32(int32(len(records)))
+	tail.Write(recs.Bytes())
+
+	var b kafkaBuffer
+	b.int64(0)                             // base_offset
+	b.int32(int32(4 + 1 + 4 + tail.Len())) // batch_length, from the leader epoch on
+	b.int32(-1)                            // partition_leader_epoch
+	b.WriteByte(2)                         // magic
+	b.int32(int32(crc32.Checksum(tail.Bytes(), crc32c)))
+	b.Write(tail.Bytes())
+	return b.Bytes()
+}
+
+// murmur2 is the hash of the Java client's default partitioner.
+func murmur2(data []byte) uint32 {
+	const m, r = 0x5bd1e995, 24
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(data) & 3 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// kafkaReplicaNotAvailable is the error code of partition metadata for a
+// replica down.
+const kafkaReplicaNotAvailable = 9
+
+func kafkaError(op string, code int16) error {
+	return fmt.Errorf("kafka %s: error code %d", op, code)
+}
+
+// kafkaBuffer encodes the big-endian fields of the protocol.
+type kafkaBuffer struct {
+	bytes.Buffer
+}
+
+func (b *kafkaBuffer) int16(v int16) { binary.Write(&b.Buffer, binary.BigEndian, v) }
+func (b *kafkaBuffer) int32(v int32) { binary.Write(&b.Buffer, binary.BigEndian, v) }
+func (b *kafkaBuffer) int64(v int64) { binary.Write(&b.Buffer, binary.BigEndian, v) }
+
+func (b *kafkaBuffer) string(s string) {
+	b.int16(int16(len(s)))
+	b.WriteString(s)
+}
+
+// varint writes a zigzag-encoded variable-length integer.
+func (b *kafkaBuffer) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+// kafkaReader decodes a response; after a short read, every field reads
+// as zero and err is set.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+var errKafkaShort = errors.New("kafka: short response")
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errKafkaShort
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+// string reads a string, nullable ones (length -1) as "".
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is a single Kafka broker leading every partition of its
+// topic, answering Metadata v4 and Produce v3 as kafkaWriter sends them.
+type fakeBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	partitions int32
+
+	mu          sync.Mutex
+	metadataErr []int16 // partition error code of the nth metadata response, then none
+	produceErr  []int16 // partition error code of the nth produce response, then none
+	metadatas   int
+	produces    int
+	records     map[int32][]string // keys received, by partition
+}
+
+func newFakeBroker(t *testing.T, partitions int32) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, ln: ln, partitions: partitions, records: make(map[int32][]string)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		r := &kafkaReader{b: req}
+		apiKey, version, id := r.int16(), r.int16(), r.int32()
+		r.string() // client_id
+		var resp kafkaBuffer
+		resp.int32(id)
+		switch {
+		case apiKey == 3 && version == 4:
+			b.metadata(r, &resp)
+		case apiKey == 0 && version == 3:
+			b.produce(r, &resp)
+		default:
+			b.t.Errorf("unexpected request %d v%d", apiKey, version)
+			return
+		}
+		if r.err != nil {
+			b.t.Errorf("request %d: %v", apiKey, r.err)
+			return
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(resp.Len()))
+		c.Write(append(size[:], resp.Bytes()...))
+	}
+}
+
+func (b *fakeBroker) metadata(r *kafkaReader, resp *kafkaBuffer) {
+	r.int32()
+	topic := r.string()
+	b.mu.Lock()
+	code := nth(b.metadataErr, b.metadatas)
+	b.metadatas++
+	b.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(b.addr())
+	p, _ := strconv.Atoi(port)
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1)
+	resp.int32(0)
+	resp.string(host)
+	resp.int32(int32(p))
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster_id
+	resp.int32(0)  // controller_id
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(topic)
+	resp.WriteByte(0)
+	resp.int32(b.partitions)
+	for i := int32(0); i < b.partitions; i++ {
+		leader := int32(0)
+		if code != 0 && i == 0 {
+			resp.int16(code)
+			leader = -1
+		} else {
+			resp.int16(0)
+		}
+		resp.int32(i)
+		resp.int32(leader)
+		resp.int32(1)
+		resp.int32(0) // replica_nodes
+		resp.int32(1)
+		resp.int32(0) // isr_nodes
+	}
+}
+
+func (b *fakeBroker) produce(r *kafkaReader, resp *kafkaBuffer) {
+	r.string() // transactional_id
+	if acks := r.int16(); acks != 1 {
+		b.t.Errorf("acks %d", acks)
+	}
+	r.int32() // timeout
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	code := nth(b.produceErr, b.produces)
+	b.produces++
+	topics := r.int32()
+	resp.int32(topics)
+	for ; topics > 0; topics-- {
+		resp.string(r.string())
+		n := r.int32()
+		resp.int32(n)
+		for i := int32(0); i < n; i++ {
+			p := r.int32()
+			batch := r.next(int(r.int32()))
+			pcode := int16(0)
+			if i == 0 {
+				pcode = code
+			}
+			if pcode == 0 {
+				b.records[p] = append(b.records[p], b.batchKeys(batch)...)
+			}
+			resp.int32(p)
+			resp.int16(pcode)
+			resp.int64(0)  // base_offset
+			resp.int64(-1) // log_append_time_ms
+		}
+	}
+	resp.int32(0) // throttle_time_ms
+}
+
+// batchKeys checks a version 2 record batch and returns the keys of its
+// records.
+func (b *fakeBroker) batchKeys(batch []byte) []string {
+	r := &kafkaReader{b: batch}
+	r.int64() // base_offset
+	if n := r.int32(); int(n) != len(batch)-12 {
+		b.t.Errorf("batch_length %d of a %d bytes batch", n, len(batch))
+	}
+	r.int32() // partition_leader_epoch
+	if magic := r.int8(); magic != 2 {
+		b.t.Errorf("magic %d", magic)
+	}
+	if crc := uint32(r.int32()); crc != crc32.Checksum(r.b, crc32c) {
+		b.t.Error("batch CRC mismatch")
+	}
+	r.next(2 + 4 + 8 + 8 + 8 + 2 + 4) // attributes to base_sequence
+	var keys []string
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		length, k := binary.Varint(r.b)
+		rec := &kafkaReader{b: r.next(k + int(length))[k:]}
+		rec.int8()  // attributes
+		varint(rec) // timestamp_delta
+		varint(rec) // offset_delta
+		if kl := varint(rec); kl >= 0 {
+			keys = append(keys, string(rec.next(int(kl))))
+		}
+		rec.next(int(varint(rec))) // value
+	}
+	if r.err != nil {
+		b.t.Error(r.err)
+	}
+	return keys
+}
+
+func varint(r *kafkaReader) int64 {
+	v, n := binary.Varint(r.b)
+	r.next(n)
+	return v
+}
+
+func nth(codes []int16, i int) int16 {
+	if i < len(codes) {
+		return codes[i]
+	}
+	return 0
+}
+
+func sessionMessage(sid string) *MessageInfo {
+	return &MessageInfo{
+		Timestamp: Timestamp{time.Now()},
+		AVPs:      []AVPInfo{{Code: 263, Name: "Session-Id", Data: sid}},
+	}
+}
+
+func writeSessions(t *testing.T, k *kafkaWriter, n int) {
+	for i := 0; i < n; i++ {
+		if err := k.write(sessionMessage("mme.example.org;"+strconv.Itoa(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := k.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafkaWriterPartitionsByKey(t *testing.T) {
+	b := newFakeBroker(t, 3)
+	k := newKafkaWriter([]string{b.addr()}, "diameter")
+	writeSessions(t, k, 2500)
+
+	total := 0
+	for p, keys := range b.records {
+		for _, key := range keys {
+			if want := int32(murmur2([]byte(key))&0x7fffffff) % 3; p != want {
+				t.Errorf("%s produced to partition %d, want %d", key, p, want)
+			}
+		}
+		total += len(keys)
+	}
+	if total != 2500 || k.dropped() != 0 {
+		t.Errorf("%d records produced, %d dropped, want 2500 and 0", total, k.dropped())
+	}
+}
+
+// TestMurmur2 checks the hash against values of the Java client's tests.
+func TestMurmur2(t *testing.T) {
+	for key, want := range map[string]int32{"21": -973932308, "foobar": -790332482} {
+		if got := int32(murmur2([]byte(key))); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestKafkaWriterRetriesLeaderNotAvailable(t *testing.T) {
+	b := newFakeBroker(t, 2)
+	b.metadataErr = []int16{5} // LEADER_NOT_AVAILABLE, as for a topic just created
+	k := newKafkaWriter([]string{b.addr()}, "diameter")
+	writeSessions(t, k, 10)
+
+	if b.metadatas != 2 {
+		t.Errorf("%d metadata requests, want 2", b.metadatas)
+	}
+	if n := len(b.records[0]) + len(b.records[1]); n != 10 || k.dropped() != 0 {
+		t.Errorf("%d records produced, %d dropped, want 10 and 0", n, k.dropped())
+	}
+}
+
+func TestKafkaWriterResendsRefusedPartitions(t *testing.T) {
+	b := newFakeBroker(t, 2)
+	b.produceErr = []int16{6} // NOT_LEADER_FOR_PARTITION, for one of the partitions
+	k := newKafkaWriter([]string{b.addr()}, "diameter")
+	writeSessions(t, k, 10)
+
+	if b.metadatas != 2 || b.produces != 2 {
+		t.Errorf("%d metadata and %d produce requests, want 2 and 2", b.metadatas, b.produces)
+	}
+	if n := len(b.records[0]) + len(b.records[1]); n != 10 || k.dropped() != 0 {
+		t.Errorf("%d records produced, %d dropped, want 10 and 0", n, k.dropped())
+	}
+}
+
+func TestKafkaWriterDropsAfterRetry(t *testing.T) {
+	b := newFakeBroker(t, 1)
+	b.produceErr = []int16{6, 6}
+	k := newKafkaWriter([]string{b.addr()}, "diameter")
+	writeSessions(t, k, 10)
+
+	if k.dropped() != 10 || len(b.records[0]) != 0 {
+		t.Errorf("%d records dropped, %d produced, want 10 and 0", k.dropped(), len(b.records[0]))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// runLabels are the static -label key=value pairs of the run. They are
+// added to every output record and metric so that output from several
+// probes can be merged downstream.
+var runLabels labels
+
+var labelKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// labelValueReserved are the characters left out of label values.
+const labelValueReserved = `,;="'\~`
+
+// labels is a flag.Value collecting repeated -label flags.
+type labels map[string]string
+
+func (l *labels) String() string {
+	pairs := make([]string, 0, len(*l))
+	for _, k := range l.keys() {
+		pairs = append(pairs, k+"="+(*l)[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set validates the label so that it renders unchanged in every output:
+// the key is a letter or underscore then letters, digits and underscores,
+// the value a non-empty word without the characters line protocol, Graphite
+// tags and CSV give a meaning to.
+func (l *labels) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" {
+		return fmt.Errorf("label %q is not key=value", s)
+	}
+	if !labelKey.MatchString(k) {
+		return fmt.Errorf("label key %q must be letters, digits and underscores, not starting with a digit", k)
+	}
+	if v == "" || strings.ContainsFunc(v, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) ||
+		strings.ContainsAny(v, labelValueReserved) {
+		return fmt.Errorf("label %s value %q must be non-empty, without spaces or any of %s", k, v, labelValueReserved)
+	}
+	if *l == nil {
+		*l = labels{}
+	}
+	if _, dup := (*l)[k]; dup {
+		return fmt.Errorf("label %q given twice", k)
+	}
+	(*l)[k] = v
+	return nil
+}
+
+// keys returns the label keys in sorted order.
+func (l labels) keys() []string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// influxTags renders the labels as line protocol tags, including the
+// leading comma.
+func (l labels) influxTags() string {
+	var b strings.Builder
+	for _, k := range l.keys() {
+		b.WriteString("," + influxTag(k) + "=" + influxTag(l[k]))
+	}
+	return b.String()
+}
+
+// graphiteTags renders the labels as Graphite series tags, including the
+// leading semicolon.
+func (l labels) graphiteTags() string {
+	var b strings.Builder
+	for _, k := range l.keys() {
+		b.WriteString(";" + graphiteTag(k) + "=" + graphiteTag(l[k]))
+	}
+	return b.String()
+}
+
+// graphiteTag drops the characters Graphite reserves in tag names and values.
+var graphiteTag = strings.NewReplacer(";", "_", "=", "_", " ", "_", "~", "_", "!", "_", "^", "_").Replace
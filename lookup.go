@@ -0,0 +1,144 @@
+package main
+
+// isRequest reports whether the R flag is set.
+func (mi *MessageInfo) isRequest() bool {
+	return mi.CommandFlags&0x80 != 0
+}
+
+// avp returns the first top-level AVP with the given name, or nil.
+func (mi *MessageInfo) avp(name string) *AVPInfo {
+	return findAVP(mi.AVPs, name)
+}
+
+// str returns the value of a top-level string AVP, or "".
+func (mi *MessageInfo) str(name string) string {
+	if a := mi.avp(name); a != nil {
+		s, _ := a.Data.(string)
+		return s
+	}
+	return ""
+}
+
+// findAVP returns the first AVP in avps with the given name, or nil.
+func findAVP(avps []AVPInfo, name string) *AVPInfo {
+	for i := range avps {
+		if avps[i].Name == name {
+			return &avps[i]
+		}
+	}
+	return nil
+}
+
+// children returns the decoded members of a grouped AVP.
+func (a *AVPInfo) children() []AVPInfo {
+	if g, ok := a.Data.(GroupedData); ok {
+		return g.AVPs
+	}
+	return nil
+}
+
+// uint returns the value of an integer AVP.
+func (a *AVPInfo) uint() (uint64, bool) {
+	switch v := a.Data.(type) {
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int32:
+		return uint64(v), v >= 0
+	case int64:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
+
+// ResultCode is the outcome carried by an answer, either in Result-Code or
+// in the Vendor-Id/Experimental-Result-Code pair of Experimental-Result.
+type ResultCode struct {
+	Code         uint32 `json:"code"`
+	Experimental bool   `json:"experimental,omitempty"`
+	VendorID     uint32 `json:"vendor_id,omitempty"`
+}
+
+// isError reports whether the code is in the protocol, transient or
+// permanent failure classes (RFC 6733, 7.1).
+func (rc ResultCode) isError() bool {
+	return rc.Code >= 3000
+}
+
+// resultCode returns the result of an answer.
+func (mi *MessageInfo) resultCode() (ResultCode, bool) {
+	if a := mi.avp("Result-Code"); a != nil {
+		if v, ok := a.uint(); ok {
+			return ResultCode{Code: uint32(v)}, true
+		}
+	}
+	if a := mi.avp("Experimental-Result"); a != nil {
+		rc := ResultCode{Experimental: true}
+		if c := findAVP(a.children(), "Experimental-Result-Code"); c != nil {
+			v, ok := c.uint()
+			if !ok {
+				return ResultCode{}, false
+			}
+			rc.Code = uint32(v)
+		}
+		if c := findAVP(a.children(), "Vendor-Id"); c != nil {
+			v, _ := c.uint()
+			rc.VendorID = uint32(v)
+		}
+		return rc, rc.Code != 0
+	}
+	return ResultCode{}, false
+}
+
+// subscriberID returns the subscriber identity of a message: the IMSI from
+// Subscription-Id (Gx/Gy) or User-Name (S6a), else an E.164 Subscription-Id.
+func (mi *MessageInfo) subscriberID() string {
+	var e164 string
+	for i := range mi.AVPs {
+		if mi.AVPs[i].Name != "Subscription-Id" {
+			continue
+		}
+		members := mi.AVPs[i].children()
+		data, _ := dataOf(findAVP(members, "Subscription-Id-Data")).(string)
+		t := findAVP(members, "Subscription-Id-Type")
+		if t == nil || data == "" {
+			continue
+		}
+		switch v, _ := t.uint(); v {
+		case 1: // END_USER_IMSI
+			return data
+		case 0: // END_USER_E164
+			if e164 == "" {
+				e164 = data
+			}
+		}
+	}
+	if u := mi.str("User-Name"); u != "" {
+		return u
+	}
+	return e164
+}
+
+// dataOf returns the value of a, or nil when a is nil.
+func dataOf(a *AVPInfo) interface{} {
+	if a == nil {
+		return nil
+	}
+	return a.Data
+}
+
+// decodeTBCD decodes telephony BCD digits (3GPP TS 29.002), low nibble
+// first, stopping at the 0xF filler.
+func decodeTBCD(b []byte) string {
+	digits := make([]byte, 0, 2*len(b))
+	for _, x := range b {
+		for _, n := range []byte{x & 0x0F, x >> 4} {
+			if n > 9 {
+				return string(digits)
+			}
+			digits = append(digits, '0'+n)
+		}
+	}
+	return string(digits)
+}
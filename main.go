@@ -2,35 +2,65 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
 	"github.com/fiorix/go-diameter/v4/diam/dict"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 )
 
 type MessageInfo struct {
-	CommandCode      uint32    `json:"command_code"`
-	CommandCodeName  string    `json:"command_code_name,omitempty"`
-	CommandFlags     uint8     `json:"command_flags"`
-	CommandFlagsName string    `json:"command_flags_name,omitempty"`
-	ApplicationID    uint32    `json:"application_id"`
-	ApplicationName  string    `json:"application_name,omitempty"`
-	HopByHopID       uint32    `json:"hop_by_hop_id"`
-	EndToEndID       uint32    `json:"end_to_end_id"`
-	AVPs             []AVPInfo `json:"avps"`
+	Seq              uint64            `json:"seq,omitempty"`
+	Input            string            `json:"input,omitempty"`
+	Frame            int               `json:"frame"`
+	Timestamp        Timestamp         `json:"timestamp"`
+	TimeOffset       string            `json:"time_offset,omitempty"`
+	CommandCode      uint32            `json:"command_code"`
+	CommandCodeName  string            `json:"command_code_name,omitempty"`
+	CommandFlags     uint8             `json:"command_flags"`
+	CommandFlagsName string            `json:"command_flags_name,omitempty"`
+	ApplicationID    uint32            `json:"application_id"`
+	ApplicationName  string            `json:"application_name,omitempty"`
+	HopByHopID       uint32            `json:"hop_by_hop_id"`
+	EndToEndID       uint32            `json:"end_to_end_id"`
+	MessageLength    uint32            `json:"message_length"`
+	ServerInitiated  bool              `json:"server_initiated,omitempty"`
+	FrameOffset      int               `json:"frame_offset,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Derived          map[string]string `json:"derived,omitempty"`
+	Truncated        bool              `json:"truncated,omitempty"`
+	Warnings         []string          `json:"warnings,omitempty"`
+	Association      *AssociationRef   `json:"association,omitempty"`
+	Overload         *OverloadInfo     `json:"overload,omitempty"`
+	AVPs             []AVPInfo         `json:"avps"`
+	*TypedFields
+
+	sctp     *sctpPacket // for the association tracker
+	raw      []byte      // the request as captured, kept for -state
+	rawInput string      // and the input it was captured in
 }
 
 type AVPInfo struct {
-	Code     uint32      `json:"code"`
-	VendorID uint32      `json:"vendor_id,omitempty"`
-	Name     string      `json:"name,omitempty"`
-	Data     interface{} `json:"data"`
+	Code        uint32      `json:"code"`
+	VendorID    uint32      `json:"vendor_id,omitempty"`
+	Name        string      `json:"name,omitempty"`
+	Offset      int         `json:"offset,omitempty"`
+	FrameOffset int         `json:"frame_offset,omitempty"`
+	Length      int         `json:"length,omitempty"`
+	Data        interface{} `json:"data"`
+	Human       string      `json:"data_h,omitempty"` // -humanize
 }
 
 type GroupedData struct {
@@ -43,97 +73,735 @@ type PLMN struct {
 	Hex string `json:"hex"`
 }
 
+// subcommands are selected by the first argument; without one the
+// capture is decoded to JSON.
+var subcommands = map[string]func(args []string){
+	"describe": runDescribe,
+	"extract":  runExtract,
+	"grep":     runGrep,
+	"verify":   runVerify,
+}
+
 func main() {
-	pcapFile := flag.String("pcap", "", "Path to the PCAP file")
+	os.Exit(run())
+}
+
+// run decodes the capture and returns the exit code.
+func run() (code int) {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return exitOK
+		}
+	}
+
+	var pcapFiles, timeOffsets listFlag
+	flag.Var(&pcapFiles, "pcap", "Path to the PCAP file (repeatable; files are merged in capture time order)")
+	iface := flag.String("iface", "", "Capture live from this network interface instead of a PCAP file")
+	follow := flag.Bool("follow", false, "Keep reading the -pcap file as it is written, like tail -F; the path may be a glob of ring buffer files")
+	flag.DurationVar(&followInterval, "follow-interval", 200*time.Millisecond, "How often a followed capture is checked for new packets")
+	reportList := flag.String("report", "", "Comma-separated reports to print instead of messages: "+strings.Join(reportNames(), ", "))
+	flag.IntVar(&reportTop, "top", 5, "Number of entries listed per breakdown in reports")
+	flag.DurationVar(&timeSeriesBucket, "bucket", 10*time.Second, "Interval of the timeseries report")
+	flag.StringVar(&timeSeriesFormat, "timeseries-format", "csv", "Format of the timeseries report: csv or influx")
+	flag.StringVar(&realmAccountingFormat, "realm-accounting-format", "csv", "Format of the realm-accounting report: csv or json")
+	flag.StringVar(&topologyFormat, "topology-format", "json", "Format of the topology report: json or dot (Graphviz)")
+	flag.IntVar(&sizeThreshold, "size-threshold", 1400, "Message length in bytes above which the sizes report lists outliers (0 = none)")
+	flag.StringVar(&histogramAVP, "avp", "", "AVP whose values the values report counts (e.g. RAT-Type)")
+	flag.Float64Var(&quotaMaxRate, "quota-max-rate", 2, "CCR-Updates per minute above which the gy-quota report flags a rating group of a session")
+	flag.IntVar(&quotaStorm, "quota-storm", 10, "CCR-Updates within a minute the gy-quota report flags as a storm")
+	flag.DurationVar(&e2eWindow, "e2e-window", 4*time.Minute, "Window within which End-to-End IDs must be unique (duplicate-e2e report)")
+	influxURL := flag.String("influx", "", "Push metrics to this InfluxDB write URL (e.g. http://localhost:8086/write?db=diameter)")
+	graphiteAddr := flag.String("graphite", "", "Push metrics to this Graphite/Carbon plaintext address (host:port)")
+	metricsInterval := flag.Duration("metrics-interval", 10*time.Second, "Interval between metrics pushes")
+	otlpEndpoint := flag.String("otlp", "", "Export request/answer pairs as spans to this OTLP/HTTP collector (e.g. http://localhost:4318)")
+	otlpSessions := flag.Bool("otlp-sessions", false, "Group the spans of a Session-Id under one session span")
+	otlpHashKeyFile := flag.String("otlp-hash-key-file", "", "File of the secret keying the IMSI hashes of spans (HMAC-SHA256); without it spans carry no IMSI hash")
+	flag.Var(&runLabels, "label", "Static key=value label added to every record and metric (repeatable)")
+	flag.Var(&timeOffsets, "time-offset", "Clock skew correction added to capture timestamps, as DURATION or FILE=DURATION (repeatable)")
+	utc := flag.Bool("utc", false, "Normalize all timestamps to UTC")
+	timeFormatFlag := flag.String("time-format", "rfc3339", "Format of the times in records and reports: rfc3339, epoch-s or epoch-ms")
+	timeZoneFlag := flag.String("time-zone", "", "Time zone of the RFC 3339 times in records and reports, e.g. UTC, Local or Europe/Rome (default: as captured)")
+	dictDir := flag.String("dict-dir", "", "Directory of extra XML dictionaries, loaded for the applications seen in the capture")
+	dictAll := flag.Bool("dict-all", false, "Load every dictionary of -dict-dir instead of selecting them")
+	allowList := flag.String("allow-list", "", "File of IMSIs/MSISDNs (one per line); only their messages are processed")
+	denyList := flag.String("deny-list", "", "File of IMSIs/MSISDNs (one per line) whose messages are left out")
+	flag.StringVar(&outputFormat, "format", "json", "Format of the records: json, ndjson (one record per line), ek for the Elasticsearch layout of tshark -T ek, or summary (one line per message)")
+	var outList, outFilters listFlag
+	flag.Var(&outList, "out", "Destination of the records: stdout, [FORMAT:]FILE or kafka:HOST:PORT[,HOST:PORT]/TOPIC (repeatable; default stdout)")
+	flag.Var(&outFilters, "out-filter", "Only send to an -out destination the messages matching a query, as SINK='AVP ~ REGEXP' (repeatable)")
+	typed := flag.Bool("typed", false, "Print ULR/ULA, AIR/AIA and CCR/CCA in fixed typed fields instead of the avps array")
+	var redactList listFlag
+	flag.Var(&redactList, "redact", "Replace the values of this AVP by a hash in every output (repeatable)")
+	configFile := flag.String("config", "", "JSON file of filter, redaction and sink settings, reloaded when changed or on SIGHUP")
+	flag.IntVar(&maxDepth, "max-depth", 32, "Maximum nesting of grouped AVPs expanded per message (0 = no limit)")
+	flag.IntVar(&maxAVPs, "max-avps", 10000, "Maximum number of AVPs expanded per message (0 = no limit)")
+	flag.DurationVar(&pendingMaxAge, "pending-max-age", pendingMaxAge, "Age beyond which an unanswered request is no longer matched to an answer (0 = no limit)")
+	flag.IntVar(&maxPending, "max-pending", maxPending, "Maximum number of requests held waiting for their answer, by the correlator and each report (0 = no limit)")
+	flag.BoolVar(&humanize, "humanize", false, "Add to bit rates, octet counts and durations a companion field in readable units (e.g. \"150 Mbit/s\")")
+	flag.BoolVar(&avpOffsets, "offsets", false, "Include the byte offset and length of every AVP in the message and frame")
+	workers := flag.Int("workers", 1, "Number of goroutines decoding packets in parallel")
+	ordered := flag.Bool("ordered", false, "With -workers, print records in capture order instead of as soon as decoded")
+	flag.IntVar(&captureQueue, "capture-queue", 10000, "Packets of a live capture queued for decoding; beyond, packets are dropped and counted")
+	flag.IntVar(&sortBuffer, "sort-buffer", 100000, "Packets held in memory per sorted run when merging unordered captures")
+	flag.BoolVar(&serviceMode, "service", false, "Run as a systemd service: sd_notify readiness, reloads and watchdog")
+	healthAddr := flag.String("health", "", "Serve /healthz on this address (e.g. :9102)")
+	healthMaxLag := flag.Duration("health-max-lag", 30*time.Second, "Input lag beyond which a live capture is reported unhealthy")
+	flag.BoolVar(&strictMode, "strict", false, "Send messages violating RFC 6733 or the dictionary rules to -errors instead of the output and reports")
+	errorsFile := flag.String("errors", "", "File the messages rejected by -strict are appended to (default: standard error)")
+	trackAssociations := flag.Bool("associations", false, "Attribute messages to SCTP associations across the addresses of multi-homed peers")
+	stateFile := flag.String("state", "", "File carrying unanswered requests and open sessions from one run to the next, for captures rotated into several files")
+	stateMaxAge := flag.Duration("state-max-age", 5*time.Minute, "Age beyond which an unanswered request is not carried to the next run (0 = no limit)")
+	frameNumber := flag.Int("frame", 0, "Print only this frame of the -pcap file, in full: AVP tree with offsets, violations and hex dump")
+	frameIndex := flag.String("frame-index", "", "With -frame, index of the capture's record offsets, built on first use, for quick lookups in large files")
+	manifestFile := flag.String("manifest", "", "Write to this file a JSON manifest of the run: tool version, dictionaries, flags, input hashes and counts")
+	profileName := flag.String("profile", "full", "Decode profile: minimal (header and raw AVPs), standard (names, grouped AVPs, request matching) or full (standard and value decoders)")
 	flag.Parse()
+	// The manifest is written however the run ends, from here on.
+	var manifest *runManifest
+	var inputs []*input
+	if *manifestFile != "" {
+		manifest = newRunManifest()
+		defer func() {
+			err := manifest.addInputs(inputs)
+			if err == nil {
+				err = manifest.save(*manifestFile, code)
+			}
+			if err != nil {
+				log.Println("Failed to write manifest:", err)
+				code = exitRuntime
+			}
+		}()
+	}
+	if serviceMode {
+		log.SetFlags(0) // the journal adds timestamps
+	}
+	if err := setProfile(*profileName); err != nil {
+		return failed(exitUsage, err)
+	}
 
-	if *pcapFile == "" {
-		log.Fatal("Please provide a PCAP file using -pcap")
+	if (len(pcapFiles) == 0) == (*iface == "") {
+		return failed(exitUsage, "Please provide either a PCAP file using -pcap or an interface using -iface")
 	}
 
-	// Load the default dictionary (Base + common apps).
-	d := dict.Default
+	inputs, err := newInputs(pcapFiles, *iface, timeOffsets)
+	if err != nil {
+		return failed(exitUsage, err)
+	}
+	if *follow {
+		if len(pcapFiles) != 1 {
+			return failed(exitUsage, "-follow reads a single -pcap file or glob")
+		}
+		if followInterval <= 0 {
+			return failed(exitUsage, "-follow-interval must be positive")
+		}
+		inputs[0].follow = true
+	}
+	tailing := *iface != "" || *follow // the input has no end
+	if *frameNumber < 0 || (*frameNumber > 0 && (len(pcapFiles) != 1 || tailing)) {
+		return failed(exitUsage, "-frame takes a positive frame number of a single -pcap file")
+	}
+	if sortBuffer < 1 {
+		return failed(exitUsage, "-sort-buffer must be positive")
+	}
+	if captureQueue < 1 {
+		return failed(exitUsage, "-capture-queue must be positive")
+	}
+	if *frameIndex != "" && *frameNumber == 0 {
+		return failed(exitUsage, "-frame-index is used by -frame")
+	}
+	if *manifestFile != "" && *frameNumber > 0 {
+		return failed(exitUsage, "-manifest records a run over the capture, not -frame")
+	}
 
-	handle, err := pcap.OpenOffline(*pcapFile)
+	if !slices.Contains(recordFormats, outputFormat) {
+		return failed(exitUsage, "-format must be one of", strings.Join(recordFormats, ", "))
+	}
+	sinks, err := newRecordSinks(outList, outFilters, outputFormat)
 	if err != nil {
-		log.Fatal("Failed to open PCAP file:", err)
+		return failed(exitUsage, err)
+	}
+	if sinks.formats("ek") && *typed {
+		return failed(exitUsage, "-typed fields have no equivalent in the ek format")
+	}
+	if *utc && *timeZoneFlag != "" && *timeZoneFlag != "UTC" {
+		return failed(exitUsage, "-utc and -time-zone", *timeZoneFlag, "contradict each other")
+	}
+	if err := setTimeFormat(*timeFormatFlag, *timeZoneFlag); err != nil {
+		return failed(exitUsage, err)
 	}
-	defer handle.Close()
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	for packet := range packetSource.Packets() {
-		appLayer := packet.ApplicationLayer()
-		if appLayer == nil {
-			continue
-		}
-		payload := appLayer.Payload()
-		if len(payload) == 0 {
-			continue
+	reports, err := newReports(*reportList)
+	if err != nil {
+		return failed(exitUsage, err)
+	}
+	if len(reports) > 0 && len(outList) > 0 {
+		return failed(exitUsage, "-out is for records; reports are written to standard output")
+	}
+	if *trackAssociations && associations == nil {
+		associations = newAssociationTracker()
+	}
+	// Everything but the plain records looks AVPs up by name.
+	if !profile.names && (len(reports) > 0 || *typed || humanize || *allowList != "" || *denyList != "" || len(redactList) > 0 ||
+		len(outFilters) > 0 || *configFile != "" || *influxURL != "" || *graphiteAddr != "" || *otlpEndpoint != "") {
+		return failed(exitUsage, "-profile "+*profileName+" leaves out AVP names, needed by -report, -typed, -humanize, subscriber lists, -redact, -out-filter, -config and metrics or trace export")
+	}
+	if *stateFile != "" && len(reports) > 0 {
+		return failed(exitUsage, "-state does not carry the totals of reports, which cover a single run")
+	}
+	if !profile.correlate && *stateFile != "" {
+		return failed(exitUsage, "-profile "+*profileName+" does not match answers to requests, which -state carries over")
+	}
+	var state *runState
+	if *stateFile != "" {
+		if state, err = loadState(*stateFile); err != nil {
+			return failed(exitConfig, "Failed to load state:", err)
 		}
+	}
 
-		// Use dictionary when reading the message.
-		msg, err := diam.ReadMessage(bytes.NewReader(payload), d)
+	// Filters, redaction and sinks can be changed while running, from the
+	// -config file or the command line on SIGHUP.
+	base := liveConfig{
+		AllowList: *allowList,
+		DenyList:  *denyList,
+		Redact:    redactList,
+		Influx:    *influxURL,
+		Graphite:  *graphiteAddr,
+		OTLP:      *otlpEndpoint,
+	}
+	config, err := loadLiveConfig(*configFile, base)
+	if err != nil {
+		return failed(exitConfig, "Failed to load config:", err)
+	}
+	if manifest != nil && *configFile != "" {
+		if err := manifest.addConfig(*configFile); err != nil {
+			return failed(exitConfig, "Failed to load config:", err)
+		}
+	}
+	live, err := newLiveSettings(config)
+	if err != nil {
+		return failed(exitConfig, "Failed to load config:", err)
+	}
+	filter, redact, derived := live.filter, live.redact, live.derived
+	if *otlpHashKeyFile != "" {
+		b, err := os.ReadFile(*otlpHashKeyFile)
 		if err != nil {
-			// Not a Diameter message, or incomplete.
-			continue
+			return failed(exitConfig, "Failed to read the OTLP hash key:", err)
 		}
-
-		// Extract message info.
-		mi := MessageInfo{
-			CommandCode:      msg.Header.CommandCode,
-			CommandCodeName:  commandCodeName(msg.Header.CommandCode),
-			CommandFlags:     msg.Header.CommandFlags,
-			CommandFlagsName: commandFlagsName(msg.Header.CommandFlags),
-			ApplicationID:    msg.Header.ApplicationID,
-			ApplicationName:  applicationName(msg.Header.ApplicationID),
-			HopByHopID:       msg.Header.HopByHopID,
-			EndToEndID:       msg.Header.EndToEndID,
+		if imsiHashKey = bytes.TrimSpace(b); len(imsiHashKey) == 0 {
+			return failed(exitConfig, "Failed to read the OTLP hash key:", *otlpHashKeyFile, "is empty")
 		}
+	}
 
-		for _, a := range msg.AVP {
+	// Load the default dictionary (Base + common apps).
+	d := dict.Default
 
-			// Lookup AVP name from dictionary.
-			name := avpNameFromDict(d, msg.Header.ApplicationID, a.Code, a.VendorID)
-			// Convert AVP data to JSON-friendly value.
-			var data interface{} = avpToJSONValue(a.Data)
+	// Closing the handle ends the packet loop, so reports are still printed
+	// and metrics flushed when a live capture is interrupted.
+	var cancel canceller
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		sdNotify("STOPPING=1")
+		cancel.stop()
+	}()
 
-			// If this is a grouped AVP, decode its children.
-			if g, ok := a.Data.(datatype.Grouped); ok {
-				ga, err := diam.DecodeGrouped(g, msg.Header.ApplicationID, d)
-				if err == nil && ga != nil {
-					data = GroupedData{
-						AVPs: avpsToInfoList(d, msg.Header.ApplicationID, ga.AVP),
-					}
+	// Extra dictionaries are selected from the applications found by a
+	// quick pre-scan of capture files, or on first use when capturing live.
+	var plugins, dictFiles *dictPlugins
+	rxCommands := true
+	if *dictDir != "" {
+		if plugins, err = newDictPlugins(d, *dictDir); err != nil {
+			return failed(exitConfig, "Failed to read dictionaries:", err)
+		}
+		dictFiles = plugins
+		rxCommands = !plugins.defines(rxApplicationID)
+		if state != nil {
+			for _, id := range state.applications() {
+				if err := plugins.require(id); err != nil {
+					return failed(exitConfig, "Failed to load dictionaries:", err)
 				}
-			} else if name == "Visited-PLMN-Id" {
-				// Existing special case for PLMN.
-				if os, ok := a.Data.(datatype.OctetString); ok {
-					if plmn := decodePLMN([]byte(os)); plmn != nil {
-						data = plmn
+			}
+		}
+	}
+	if err := loadChargingDictionary(d, rxCommands); err != nil {
+		return failed(exitConfig, "Failed to load dictionaries:", err)
+	}
+	if *frameNumber > 0 {
+		// Everything there is to show, whatever the other flags.
+		setProfile("full")
+		avpOffsets, humanize = true, true
+		p, err := readFrame(inputs[0], *frameNumber, *frameIndex)
+		if err != nil {
+			return failed(exitInput, "Failed to read frame:", err)
+		}
+		if err := showFrame(os.Stdout, d, p, plugins, *utc); err != nil {
+			log.Println("Failed to show frame:", err)
+			return exitRuntime
+		}
+		return exitOK
+	}
+	if plugins != nil {
+		switch {
+		case *dictAll:
+			err = plugins.requireAll()
+			plugins = nil
+		case !tailing:
+			var ids map[uint32]bool
+			if ids, err = prescanApplications(inputs, &cancel); err == nil {
+				for id := range ids {
+					if err = plugins.require(id); err != nil {
+						break
 					}
 				}
 			}
+			plugins = nil
+		case *workers > 1:
+			// Decode workers share the dictionary, which must not be
+			// loaded into while they read it.
+			err = plugins.requireAll()
+			plugins = nil
+		}
+		if err == errStopped {
+			return exitOK
+		}
+		if err != nil {
+			return failed(exitConfig, "Failed to load dictionaries:", err)
+		}
+	}
+
+	var stats *metrics
+	if len(live.sinks) > 0 || *configFile != "" {
+		stats = newMetrics()
+		stop := stats.pushEvery(*metricsInterval, live.sinks)
+		defer stop()
+	}
 
-			mi.AVPs = append(mi.AVPs, AVPInfo{
-				Code:     a.Code,
-				VendorID: a.VendorID,
-				Name:     name,
-				Data:     data,
-			})
+	var traces *traceExporter
+	if config.OTLP != "" {
+		traces = newTraceExporter(config.OTLP, *otlpSessions)
+	}
+	defer func() {
+		if traces != nil {
+			traces.close()
 		}
+	}()
 
-		// Output as JSON.
-		out, err := json.MarshalIndent(mi, "", "  ")
+	// Reloaded settings take effect with the next message, so that they are
+	// only used by the goroutine handling messages; sinks right away.
+	reloads := make(chan *liveSettings, 1)
+	watchConfig(*configFile, base, func(s *liveSettings) {
+		if manifest != nil {
+			if err := manifest.addReload(*configFile); err != nil {
+				log.Println("Failed to hash config:", err)
+			}
+		}
+		if stats != nil {
+			stats.setSinks(s.sinks)
+		}
+		select {
+		case <-reloads:
+		default:
+		}
+		reloads <- s
+	})
+	applyReload := func() {
+		var s *liveSettings
+		select {
+		case s = <-reloads:
+		default:
+			return
+		}
+		// Sessions keep the decision taken for them, since their later
+		// messages may carry no identity to decide on.
+		if s.filter != nil && filter != nil {
+			s.filter.sessions = filter.sessions
+		}
+		filter, redact, derived = s.filter, s.redact, s.derived
+		if s.config.OTLP != config.OTLP {
+			if traces != nil {
+				traces.close()
+				traces = nil
+			}
+			if s.config.OTLP != "" {
+				traces = newTraceExporter(s.config.OTLP, *otlpSessions)
+			}
+		}
+		config = s.config
+	}
+
+	errorsOut := os.Stderr
+	if *errorsFile != "" {
+		f, err := os.OpenFile(*errorsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
 		if err != nil {
-			log.Println("json marshal error:", err)
-			continue
+			return failed(exitConfig, "Failed to open error output:", err)
+		}
+		defer f.Close()
+		errorsOut = f
+	}
+
+	if len(reports) == 0 {
+		if err := sinks.open(); err != nil {
+			return failed(exitConfig, "Failed to open output:", err)
+		}
+	}
+
+	var hc *health
+	if *healthAddr != "" || serviceMode {
+		hc = newHealth(tailing, *healthMaxLag)
+		watchdog(hc)
+	}
+	if *healthAddr != "" {
+		if err := hc.serve(*healthAddr); err != nil {
+			return failed(exitConfig, "Failed to serve health endpoint:", err)
+		}
+	}
+
+	corr := newCorrelator()
+	if state != nil {
+		// Carried over from the previous file of a rotated capture.
+		requests, err := state.requests(d, *utc)
+		if err != nil {
+			return failed(exitConfig, "Failed to load state:", err)
+		}
+		corr.restore(requests)
+		if filter != nil && state.Filter != nil {
+			filter.sessions = state.Filter
+		}
+		if traces != nil {
+			traces.attachSessions(state.Sessions)
+		}
+	}
+	var last time.Time // of the latest message, to age the state
+	var counts ManifestCounts
+
+	if manifest != nil {
+		for _, in := range inputs {
+			if !in.live && !in.follow {
+				in.digest = &inputDigest{}
+			}
+		}
+	}
+	stream, err := openStream(inputs, &cancel)
+	if err == errStopped {
+		return exitOK
+	}
+	if err != nil {
+		return failed(exitInput, "Failed to open input:", err)
+	}
+	defer stream.close()
+	// Packets lost by a live capture are counted, by the kernel and by
+	// the capture queue.
+	capture, _ := stream.(*liveStream)
+	if capture != nil {
+		if stats != nil {
+			stats.setCapture(capture.captureStats)
+		}
+		if hc != nil {
+			hc.setCapture(capture.captureStats)
+		}
+		stop := logCaptureDrops(capture, *metricsInterval)
+		defer stop()
+	}
+	counted := &countedStream{packetStream: stream}
+	stream = counted
+	if hc != nil {
+		hc.setInput(counted.read)
+	}
+	sdNotify("READY=1")
+
+	decode := func(p *rawPacket) (*MessageInfo, error) {
+		packet := p.decode()
+		if plugins != nil {
+			if err := plugins.requireFor(packet); err != nil {
+				return nil, &exitError{exitConfig, "Failed to load dictionaries:", err}
+			}
+		}
+		var sp *sctpPacket
+		if associations != nil {
+			sp = sctpPacketOf(packet)
+		}
+		msg, ok := diameterMessage(d, packet)
+		if !ok {
+			if sp != nil {
+				// The tracker also needs the SCTP control packets.
+				sp.control = true
+				return &MessageInfo{Frame: p.frame, Timestamp: Timestamp{p.ts}, sctp: sp}, nil
+			}
+			return nil, nil
+		}
+
+		mi := newMessageInfo(d, msg)
+		if profile.validate || strictMode {
+			mi.Warnings = checkMessage(d, msg)
+		}
+		mi.Frame = p.frame
+		mi.Timestamp = Timestamp{p.ts}
+		if *utc {
+			mi.Timestamp = Timestamp{mi.Timestamp.UTC()}
+		}
+		if len(inputs) > 1 || *follow {
+			mi.Input = p.in.path
+		}
+		if p.in.offset != 0 {
+			mi.TimeOffset = p.in.offset.String()
+		}
+		mi.Labels = runLabels
+		mi.sctp = sp
+		if *stateFile != "" && mi.isRequest() {
+			mi.raw = bytes.Clone(diameterPayload(packet)[:msg.Header.MessageLength])
+			mi.rawInput = p.in.path
+		}
+		if avpOffsets {
+			mi.FrameOffset = payloadOffset(packet)
+			setFrameOffsets(mi.AVPs, mi.FrameOffset)
+		}
+		return &mi, nil
+	}
+
+	handle := func(mi *MessageInfo) {
+		if hc != nil {
+			defer hc.done()
+		}
+		if mi == nil {
+			return
+		}
+		applyReload()
+		if mi.sctp != nil {
+			mi.Association = associations.observe(mi.sctp, mi.Frame, mi.Timestamp.Time)
+			if mi.sctp.control {
+				return
+			}
+		}
+		counts.Messages++
+		if mi.Timestamp.After(last) {
+			last = mi.Timestamp.Time
+		}
+		var req *MessageInfo
+		if profile.correlate {
+			req = corr.match(mi)
+		}
+		if filter != nil && !filter.keep(mi, req) {
+			counts.Filtered++
+			return
+		}
+		mi, req = redact.apply(mi), redact.apply(req)
+		derived.apply(mi, req)
+		if strictMode && len(mi.Warnings) > 0 {
+			counts.Rejected++
+			if err := writeJSON(errorsOut, mi); err != nil {
+				log.Println("error output:", err)
+			}
+			return
+		}
+		if stats != nil {
+			stats.observe(mi, req)
+		}
+		if traces != nil {
+			traces.observe(mi, req)
+		}
+		if hc != nil {
+			hc.observe(mi, SinkBacklog{OTLPSpans: traces.pending(), Records: sinks.backlog(), Dropped: sinks.dropped()})
+		}
+
+		counts.Records++
+		if len(reports) > 0 {
+			for _, r := range reports {
+				r.add(mi, req)
+			}
+			return
+		}
+
+		// Output the records, well-known procedures in typed fields if asked.
+		if *typed {
+			if t := typedFields(mi); t != nil {
+				rec := *mi
+				rec.AVPs, rec.TypedFields = nil, t
+				mi = &rec
+			}
+		}
+		if err := sinks.write(mi, req); err != nil {
+			counts.OutputErrors++
+			log.Println("output error:", err)
+		}
+	}
+
+	code = exitOK
+	if *workers > 1 {
+		// Answers are matched to their requests, so everything but the
+		// plain record output needs messages in capture order: the ek and
+		// summary records show the request and the answer time.
+		inOrder := *ordered || len(reports) > 0 || filter != nil || stats != nil || traces != nil || *configFile != "" || associations != nil ||
+			*stateFile != "" || sinks.formats("ek") || sinks.formats("summary")
+		if err := runPipeline(stream, *workers, inOrder, decode, handle); err != nil {
+			code = runError(err)
+		}
+	} else {
+		for {
+			p, err := stream.next()
+			if err == io.EOF || err == errStopped {
+				break
+			}
+			var mi *MessageInfo
+			if err == nil {
+				mi, err = decode(p)
+			}
+			if err != nil {
+				code = runError(err)
+				break
+			}
+			handle(mi)
+		}
+	}
+
+	if state != nil {
+		state.Pending = corr.export(last, *stateMaxAge)
+		state.Filter, state.Sessions = nil, nil
+		if filter != nil {
+			state.Filter = filter.sessions
+		}
+		if traces != nil {
+			state.Sessions = traces.detachSessions()
+		}
+		if err := state.save(*stateFile); err != nil {
+			log.Println("Failed to save state:", err)
+			code = exitRuntime
 		}
-		fmt.Println(string(out))
 	}
+
+	if len(reports) == 0 {
+		if err := sinks.close(); err != nil {
+			log.Println("output error:", err)
+			code = exitRuntime
+		}
+	}
+	if capture != nil {
+		capture.poll()
+		c := capture.captureStats()
+		reportCapture = &c
+	}
+	for _, r := range reports {
+		if err := r.write(os.Stdout); err != nil {
+			log.Println("Failed to write report:", err)
+			code = exitRuntime
+			break
+		}
+	}
+
+	if manifest != nil {
+		counts.Packets = int(counted.read())
+		if capture != nil {
+			c := capture.captureStats()
+			counts.Capture = &c
+		}
+		manifest.Counts = counts
+		err := manifest.addDictionaries(dictFiles, rxCommands)
+		if err == nil && len(reports) == 0 {
+			err = manifest.addOutputs(sinks)
+		}
+		if err != nil {
+			log.Println("Failed to write manifest:", err)
+			code = exitRuntime
+		}
+	}
+	return code
+}
+
+// diameterPayload returns the application payload of a packet, or nil.
+func diameterPayload(packet gopacket.Packet) []byte {
+	appLayer := packet.ApplicationLayer()
+	if appLayer == nil {
+		return nil
+	}
+	return appLayer.Payload()
+}
+
+// payloadOffset returns the offset of the application payload of a packet
+// within its frame.
+func payloadOffset(packet gopacket.Packet) int {
+	n := 0
+	for _, l := range packet.Layers() {
+		if l == packet.ApplicationLayer() {
+			break
+		}
+		n += len(l.LayerContents())
+	}
+	return n
+}
+
+// diameterMessage reads the Diameter message carried by a packet.
+func diameterMessage(d *dict.Parser, packet gopacket.Packet) (*diam.Message, bool) {
+	payload := diameterPayload(packet)
+	if len(payload) == 0 {
+		return nil, false
+	}
+
+	// Use dictionary when reading the message.
+	msg, err := diam.ReadMessage(bytes.NewReader(payload), d)
+	if err != nil {
+		// Not a Diameter message, or incomplete.
+		return nil, false
+	}
+	return msg, true
+}
+
+// newMessageInfo extracts the header fields and decoded AVPs of msg.
+func newMessageInfo(d *dict.Parser, msg *diam.Message) MessageInfo {
+	mi := MessageInfo{
+		CommandCode:   msg.Header.CommandCode,
+		CommandFlags:  msg.Header.CommandFlags,
+		ApplicationID: msg.Header.ApplicationID,
+		HopByHopID:    msg.Header.HopByHopID,
+		EndToEndID:    msg.Header.EndToEndID,
+		MessageLength: msg.Header.MessageLength,
+	}
+	mi.ServerInitiated = serverInitiated(mi.ApplicationID, mi.CommandCode)
+	if profile.names {
+		mi.CommandCodeName = commandCodeName(msg.Header.CommandCode)
+		mi.CommandFlagsName = commandFlagsName(msg.Header.CommandFlags)
+		mi.ApplicationName = applicationName(msg.Header.ApplicationID)
+	}
+
+	b := &avpBudget{left: maxAVPs, numbers: newNumberContext(msg)}
+	mi.AVPs = avpsToInfoList(d, msg.Header.ApplicationID, msg.AVP, diam.HeaderLength, 1, b)
+	mi.Truncated = b.truncated
+	if profile.decoders {
+		mi.Overload = overloadOf(&mi)
+	}
+	return mi
 }
 
 // Lookup AVP name in the loaded dictionary.
 func avpNameFromDict(d *dict.Parser, appID uint32, code uint32, vendorID uint32) string {
+	if def := avpDefFromDict(d, appID, code, vendorID); def != nil {
+		return def.Name
+	}
+	return ""
+}
+
+// avpDefFromDict returns the dictionary definition of an AVP, or nil,
+// from the cache of previous lookups.
+func avpDefFromDict(d *dict.Parser, appID uint32, code uint32, vendorID uint32) *dict.AVP {
+	k := avpDefKey{d, appID, code, vendorID}
+	if def, ok := avpDefs.Load(k); ok {
+		return def.(*dict.AVP)
+	}
+	def := lookupAVPDef(d, appID, code, vendorID)
+	if avpDefCount.Add(1) <= avpDefCacheSize {
+		avpDefs.Store(k, def)
+	}
+	return def
+}
+
+// lookupAVPDef searches the dictionary for the definition of an AVP.
+func lookupAVPDef(d *dict.Parser, appID uint32, code uint32, vendorID uint32) *dict.AVP {
+	// Try the exact vendor first: a vendor-less lookup also matches vendor
+	// AVPs sharing the code (User-Name vs 3GPP TGPP-IMSI are both code 1).
+	if avpDef, err := d.FindAVPWithVendor(appID, int(code), vendorID); err == nil && avpDef != nil {
+		return avpDef
+	}
+
 	// If no vendor, use UndefinedVendorID so the helper does the right thing.
 	v := vendorID
 	if v == 0 {
@@ -142,15 +810,15 @@ func avpNameFromDict(d *dict.Parser, appID uint32, code uint32, vendorID uint32)
 
 	// Try app‑specific AVP first, with vendor.
 	if avpDef, err := d.FindAVPWithVendor(appID, int(code), v); err == nil && avpDef != nil {
-		return avpDef.Name
+		return avpDef
 	}
 
 	// Fallback to base application (appid 0) if not found.
 	if avpDef, err := d.FindAVPWithVendor(0, int(code), v); err == nil && avpDef != nil {
-		return avpDef.Name
+		return avpDef
 	}
 
-	return ""
+	return nil
 }
 
 // avpToJSONValue converts common Diameter datatypes into JSON‑friendly Go values.
@@ -163,9 +831,14 @@ func avpToJSONValue(v datatype.Type) interface{} {
 	case datatype.OctetString:
 		return []byte(x)
 	case datatype.Address:
+		if len(x) == net.IPv4len || len(x) == net.IPv6len {
+			return net.IP(x).String()
+		}
 		return x.String()
 	case datatype.Integer32:
 		return int32(x)
+	case datatype.Enumerated:
+		return int32(x)
 	case datatype.Unsigned32:
 		return uint32(x)
 	case datatype.Integer64:
@@ -180,6 +853,12 @@ func avpToJSONValue(v datatype.Type) interface{} {
 		return x.String()
 	case datatype.IPv6:
 		return x.String()
+	case datatype.Time:
+		// Printed as before unless a time format or zone is asked for.
+		if timesFormatted {
+			return Timestamp{time.Time(x)}
+		}
+		return x.String()
 	case datatype.Grouped:
 		return fmt.Sprintf("%x", []byte(x))
 	default:
@@ -190,6 +869,22 @@ func avpToJSONValue(v datatype.Type) interface{} {
 // commandCodeName returns a string representation of the command code.
 func commandCodeName(code uint32) string {
 	switch code {
+	case 257:
+		return "Capabilities-Exchange (CER/CEA)"
+	case 258:
+		return "Re-Auth (RAR/RAA)"
+	case 271:
+		return "Accounting (ACR/ACA)"
+	case 272:
+		return "Credit-Control (CCR/CCA)"
+	case 274:
+		return "Abort-Session (ASR/ASA)"
+	case 275:
+		return "Session-Termination (STR/STA)"
+	case 280:
+		return "Device-Watchdog (DWR/DWA)"
+	case 282:
+		return "Disconnect-Peer (DPR/DPA)"
 	case 316:
 		return "Update-Location (ULR/ULA)"
 	case 317:
@@ -198,6 +893,14 @@ func commandCodeName(code uint32) string {
 		return "Authentication-Information (AIR/AIA)"
 	case 319:
 		return "Insert-Subscriber-Data (IDR/IDA)"
+	case 320:
+		return "Delete-Subscriber-Data (DSR/DSA)"
+	case 321:
+		return "Purge-UE (PUR/PUA)"
+	case 322:
+		return "Reset (RSR/RSA)"
+	case 323:
+		return "Notify (NOR/NOA)"
 	// Add more as needed from your use cases / RFCs / IANA registry.
 	default:
 		return ""
@@ -209,6 +912,12 @@ func applicationName(id uint32) string {
 	switch id {
 	case 0:
 		return "Diameter Base"
+	case 3:
+		return "Diameter Base Accounting"
+	case 4:
+		return "Diameter Credit Control (Gy/Ro)"
+	case 16777238:
+		return "Gx"
 	case 16777251:
 		return "S6a/S6d"
 	// Add other application IDs you care about.
@@ -273,27 +982,162 @@ func decodePLMN(b []byte) *PLMN {
 	}
 }
 
+// avpLimits bound the expansion of a single message: maxDepth levels of
+// grouped AVPs and maxAVPs AVPs in total (0 disables a limit).
+var (
+	maxDepth = 32
+	maxAVPs  = 10000
+)
+
+// avpBudget tracks how many more AVPs a message may expand into, and the
+// country context of its numbers.
+type avpBudget struct {
+	left      int
+	truncated bool
+	numbers   numberContext
+}
+
+// Truncated replaces the AVPs left out by -max-depth, -max-avps or the
+// decode profile.
+type Truncated struct {
+	Truncated string `json:"truncated"`    // "max-depth", "max-avps" or "profile"
+	Omitted   int    `json:"omitted_avps"` // including the AVPs grouped in them
+}
+
+// countOmitted counts the AVPs left out with avps: those and all the AVPs
+// grouped in them.
+func countOmitted(d *dict.Parser, appID uint32, avps []*diam.AVP) int {
+	n := len(avps)
+	for _, a := range avps {
+		switch g := a.Data.(type) {
+		case *diam.GroupedAVP:
+			n += countOmitted(d, appID, g.AVP)
+		case datatype.Grouped:
+			if ga, err := diam.DecodeGrouped(g, appID, d); err == nil && ga != nil {
+				n += countOmitted(d, appID, ga.AVP)
+			}
+		}
+	}
+	return n
+}
+
 // avpsToInfoList converts a slice of AVPs to a slice of AVPInfo, using the provided dictionary and application ID.
-func avpsToInfoList(d *dict.Parser, appID uint32, avps []*diam.AVP) []AVPInfo {
+// depth is the nesting level of avps (1 for the top level of a message).
+func avpsToInfoList(d *dict.Parser, appID uint32, avps []*diam.AVP, off, depth int, b *avpBudget) []AVPInfo {
 	out := make([]AVPInfo, 0, len(avps))
-	for _, a := range avps {
-		name := avpNameFromDict(d, appID, a.Code, a.VendorID)
-		data := avpToJSONValue(a.Data)
+	for i, a := range avps {
+		at := off
+		off += (a.Length + 3) &^ 3
+
+		if maxAVPs > 0 && b.left <= 0 {
+			b.truncated = true
+			out = append(out, AVPInfo{Data: Truncated{Truncated: "max-avps", Omitted: countOmitted(d, appID, avps[i:])}})
+			break
+		}
+		b.left--
 
-		if name == "Visited-PLMN-Id" {
-			if os, ok := a.Data.(datatype.OctetString); ok {
-				if plmn := decodePLMN([]byte(os)); plmn != nil {
-					data = plmn
+		var def *dict.AVP
+		if profile.names {
+			def = avpDefFromDict(d, appID, a.Code, a.VendorID)
+		}
+		var name string
+		if def != nil {
+			name = def.Name
+		}
+		var data interface{} = avpToJSONValue(a.Data)
+
+		// AVPs sent with a vendor other than the dictionary's (Service-Selection
+		// is IETF on S6a but 3GPP in the dictionary) are left undecoded by
+		// ReadMessage; decode them with the type found by the fallback lookup.
+		if u, ok := a.Data.(datatype.Unknown); ok && def != nil && def.Data.Type != datatype.UnknownType && def.Data.Type != datatype.GroupedType {
+			if v, err := datatype.Decode(def.Data.Type, []byte(u)); err == nil {
+				data = avpToJSONValue(v)
+			}
+		}
+
+		// Grouped AVPs are decoded by the dictionary when it knows them;
+		// otherwise decode the raw children here.
+		var children []*diam.AVP
+		grouped := false
+		switch g := a.Data.(type) {
+		case *diam.GroupedAVP:
+			children, grouped = g.AVP, true
+		case datatype.Grouped:
+			if !profile.grouped {
+				break
+			}
+			if ga, err := diam.DecodeGrouped(g, appID, d); err == nil && ga != nil {
+				children, grouped = ga.AVP, true
+			}
+		}
+		if grouped {
+			if !profile.grouped {
+				data = Truncated{Truncated: "profile", Omitted: countOmitted(d, appID, children)}
+			} else if maxDepth > 0 && depth >= maxDepth {
+				b.truncated = true
+				data = Truncated{Truncated: "max-depth", Omitted: countOmitted(d, appID, children)}
+			} else {
+				data = GroupedData{AVPs: avpsToInfoList(d, appID, children, at+avpHeaderLength(a), depth+1, b)}
+			}
+		}
+
+		if profile.decoders {
+			if n := b.numbers.number(name, a.Data); n != nil {
+				data = n
+			}
+			if c := decodeCharging(name, data); c != nil {
+				data = c
+			}
+			if name == "Visited-PLMN-Id" {
+				if os, ok := a.Data.(datatype.OctetString); ok {
+					if plmn := decodePLMN([]byte(os)); plmn != nil {
+						data = plmn
+					}
 				}
 			}
 		}
 
-		out = append(out, AVPInfo{
+		info := AVPInfo{
 			Code:     a.Code,
 			VendorID: a.VendorID,
 			Name:     name,
 			Data:     data,
-		})
+		}
+		if avpOffsets {
+			info.Offset, info.Length = at, a.Length
+		}
+		if humanize {
+			info.Human = humanAVP(&info)
+		}
+		out = append(out, info)
 	}
 	return out
 }
+
+// avpOffsets includes in every AVP its offset from the start of the
+// message and its length as found on the wire (header included, padding
+// excluded).
+var avpOffsets bool
+
+// avpHeaderLength is the length of the AVP header, which carries a
+// Vendor-ID when the V bit is set (RFC 6733, 4.1).
+func avpHeaderLength(a *diam.AVP) int {
+	if a.Flags&avp.Vbit != 0 {
+		return 12
+	}
+	return 8
+}
+
+// setFrameOffsets sets the frame offsets of AVPs from the offset of their
+// message within the frame.
+func setFrameOffsets(avps []AVPInfo, base int) {
+	for i := range avps {
+		if avps[i].Length == 0 {
+			continue
+		}
+		avps[i].FrameOffset = base + avps[i].Offset
+		if g, ok := avps[i].Data.(GroupedData); ok {
+			setFrameOffsets(g.AVPs, base)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// version is the release of the tool, set when building with
+// -ldflags "-X main.version=v1.2.3"; the module version or VCS revision
+// recorded by the Go toolchain is used otherwise.
+var version string
+
+// runManifest is the -manifest file: what a run read, with which tool,
+// dictionaries and settings, and what it wrote, so that results attached
+// to a ticket can be reproduced and checked. Files are identified by their
+// SHA-256; inputs still being written or captured live are not hashed.
+// Credentials in URLs of the command line are left out.
+type runManifest struct {
+	Tool         ManifestTool         `json:"tool"`
+	Started      Timestamp            `json:"started"`
+	Finished     Timestamp            `json:"finished"`
+	Args         []string             `json:"args"`
+	Flags        map[string]string    `json:"flags"` // the flags set, by name
+	Config       *ManifestFile        `json:"config,omitempty"`
+	Reloads      []ManifestReload     `json:"config_reloads,omitempty"`
+	Dictionaries []ManifestDictionary `json:"dictionaries"`
+	Inputs       []ManifestInput      `json:"inputs"`
+	Outputs      []ManifestOutput     `json:"outputs"`
+	Counts       ManifestCounts       `json:"counts"`
+	ExitCode     int                  `json:"exit_code"`
+
+	mu sync.Mutex // of Reloads, added by the config watcher
+}
+
+// ManifestTool identifies the build of the tool.
+type ManifestTool struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Revision   string `json:"revision,omitempty"`
+	Modified   bool   `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	Go         string `json:"go"`
+	GoDiameter string `json:"go_diameter,omitempty"` // the module version, which fixes the built-in dictionaries
+}
+
+// ManifestFile is a file read by the run.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestReload is the -config file as reloaded on SIGHUP or a change.
+type ManifestReload struct {
+	At Timestamp `json:"at"`
+	ManifestFile
+}
+
+// ManifestDictionary is a dictionary loaded: a built-in one, identified
+// by the go-diameter version or the hash of its XML, or a -dict-dir file.
+type ManifestDictionary struct {
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ManifestInput is a capture file or interface read.
+type ManifestInput struct {
+	Path       string `json:"path"`
+	Live       bool   `json:"live,omitempty"`
+	Follow     bool   `json:"follow,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	TimeOffset string `json:"time_offset,omitempty"`
+}
+
+// ManifestOutput is an -out destination, with the hash of what was
+// written when it is a file.
+type ManifestOutput struct {
+	Spec    string `json:"spec"`
+	Format  string `json:"format"`
+	Records int    `json:"records"`
+	Dropped int    `json:"dropped,omitempty"` // of the records, not sent
+	Size    int64  `json:"size,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// ManifestCounts are the totals of the run: packets read, Diameter
+// messages decoded, those left out by the subscriber lists and the
+// -config filter, those rejected by -strict, and those passed on to the
+// outputs or reports.
+type ManifestCounts struct {
+	Packets      int           `json:"packets"`
+	Messages     int           `json:"messages"`
+	Filtered     int           `json:"filtered"`
+	Rejected     int           `json:"rejected"`
+	Records      int           `json:"records"`
+	OutputErrors int           `json:"output_errors,omitempty"`
+	Capture      *CaptureStats `json:"capture,omitempty"` // packets lost by a live capture
+}
+
+// newRunManifest starts the manifest of a run, after the flags are parsed.
+func newRunManifest() *runManifest {
+	m := &runManifest{
+		Tool:         toolBuild(),
+		Started:      Timestamp{time.Now().UTC()},
+		Flags:        make(map[string]string),
+		Dictionaries: []ManifestDictionary{},
+		Inputs:       []ManifestInput{},
+		Outputs:      []ManifestOutput{},
+	}
+	for _, a := range os.Args[1:] {
+		if name, v, ok := strings.Cut(a, "="); ok && strings.HasPrefix(a, "-") {
+			a = name + "=" + redactURL(v)
+		}
+		m.Args = append(m.Args, redactURL(a))
+	}
+	flag.Visit(func(f *flag.Flag) { m.Flags[f.Name] = redactURL(f.Value.String()) })
+	return m
+}
+
+// redactURL replaces the userinfo and the query string of a URL, where
+// passwords and tokens go (InfluxDB takes u and p in the query), and
+// returns other values as they are.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.User == nil && u.RawQuery == "" {
+		return s
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
+
+// toolBuild reads the version of the tool and of go-diameter from the
+// build information.
+func toolBuild() ManifestTool {
+	t := ManifestTool{Name: "diameter-parser", Version: version, Go: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return t
+	}
+	if t.Version == "" {
+		t.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			t.Revision = s.Value
+		case "vcs.modified":
+			t.Modified = s.Value == "true"
+		}
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/fiorix/go-diameter/v4" {
+			t.GoDiameter = dep.Version
+		}
+	}
+	return t
+}
+
+// addConfig records the -config file as first loaded.
+func (m *runManifest) addConfig(path string) error {
+	f, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	m.Config = f
+	return nil
+}
+
+// addReload records the -config file as reloaded.
+func (m *runManifest) addReload(path string) error {
+	f, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.Reloads = append(m.Reloads, ManifestReload{Timestamp{time.Now().UTC()}, *f})
+	m.mu.Unlock()
+	return nil
+}
+
+// addDictionaries records the built-in dictionaries and the -dict-dir
+// files loaded, rx telling whether the Rx commands were added.
+func (m *runManifest) addDictionaries(plugins *dictPlugins, rx bool) error {
+	m.Dictionaries = []ManifestDictionary{{Name: "go-diameter " + or(m.Tool.GoDiameter, "(unknown version)")}}
+	builtin := []struct{ name, xml string }{{"charging", chargingDictionary}}
+	if rx {
+		builtin = append(builtin, struct{ name, xml string }{"rx-commands", rxCommandDictionary})
+	}
+	for _, b := range builtin {
+		sum := sha256.Sum256([]byte(b.xml))
+		m.Dictionaries = append(m.Dictionaries, ManifestDictionary{Name: b.name, SHA256: hex.EncodeToString(sum[:])})
+	}
+	if plugins == nil {
+		return nil
+	}
+	var paths []string
+	for path := range plugins.loaded {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		f, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		m.Dictionaries = append(m.Dictionaries, ManifestDictionary{Name: filepath.Base(path), Path: path, SHA256: f.SHA256})
+	}
+	return nil
+}
+
+// addInputs records the inputs, with the hash of the capture files read,
+// once their streams are closed.
+func (m *runManifest) addInputs(inputs []*input) error {
+	m.Inputs = m.Inputs[:0]
+	for _, in := range inputs {
+		mi := ManifestInput{Path: in.path, Live: in.live, Follow: in.follow}
+		if in.offset != 0 {
+			mi.TimeOffset = in.offset.String()
+		}
+		if d := in.digest; d != nil && d.done {
+			if d.err != nil {
+				return d.err
+			}
+			mi.Size, mi.SHA256 = d.size, hex.EncodeToString(d.h.Sum(nil))
+		}
+		m.Inputs = append(m.Inputs, mi)
+	}
+	return nil
+}
+
+// addOutputs records the -out destinations, once closed.
+func (m *runManifest) addOutputs(sinks recordSinks) error {
+	for _, s := range sinks {
+		o := ManifestOutput{Spec: s.spec, Format: s.format, Records: s.records, Dropped: s.w.dropped()}
+		if w, ok := s.w.(*streamWriter); ok && w.f != nil {
+			f, err := hashFile(s.dest)
+			if err != nil {
+				return err
+			}
+			o.Size, o.SHA256 = f.Size, f.SHA256
+		}
+		m.Outputs = append(m.Outputs, o)
+	}
+	return nil
+}
+
+// save writes the manifest, finished now with the exit code of the run.
+func (m *runManifest) save(path string, code int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Finished = Timestamp{time.Now().UTC()}
+	m.ExitCode = code
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// countedStream counts the packets read from a stream, for the manifest
+// and the watchdog.
+type countedStream struct {
+	packetStream
+	packets atomic.Int64
+}
+
+func (s *countedStream) next() (*rawPacket, error) {
+	p, err := s.packetStream.next()
+	if err == nil {
+		s.packets.Add(1)
+	}
+	return p, err
+}
+
+func (s *countedStream) read() int64 {
+	return s.packets.Load()
+}
+
+// inputDigest hashes a capture file as its stream reads it: after each
+// packet, the bytes of its record in a pcap file, and what is left when
+// the stream ends or is closed. The file is so read once, alongside
+// libpcap, rather than again after the run, when it may have changed.
+type inputDigest struct {
+	f    *os.File // while the stream reads
+	h    hash.Hash
+	size int64
+	err  error
+	done bool
+}
+
+// pcapRecordHeader is the length of the header of a pcap record.
+const pcapRecordHeader = 16
+
+// start opens the file for hashing, unless it was by an earlier stream.
+func (d *inputDigest) start(path string) bool {
+	if d.f != nil || d.done {
+		return false
+	}
+	d.h = sha256.New()
+	d.f, d.err = os.Open(path)
+	if d.err != nil {
+		d.f, d.done = nil, true
+		return false
+	}
+	return true
+}
+
+// advance hashes the next n bytes, a packet record read by libpcap.
+func (d *inputDigest) advance(n int64) {
+	if d.err == nil {
+		var read int64
+		read, d.err = io.CopyN(d.h, d.f, n)
+		d.size += read
+		if d.err == io.EOF {
+			d.err = nil
+		}
+	}
+}
+
+// finish hashes the rest of the file.
+func (d *inputDigest) finish() {
+	if d.f == nil {
+		return
+	}
+	if d.err == nil {
+		var read int64
+		read, d.err = io.Copy(d.h, d.f)
+		d.size += read
+	}
+	d.f.Close()
+	d.f, d.done = nil, true
+}
+
+func hashFile(path string) (*ManifestFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestFile{Path: path, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// sortBuffer is the number of packets held in memory per sorted run when
+// an unordered capture has to be sorted through temporary files.
+var sortBuffer = 100000
+
+// maxRunFiles is the number of sorted runs of a level merged into one run
+// of the next level, so that sorting holds a few such files open at a
+// time rather than one per sortBuffer packets of the capture.
+const maxRunFiles = 64
+
+// errStopped is returned by streams when the run is interrupted.
+var errStopped = errors.New("stopped")
+
+// rawPacket is a captured frame not yet decoded, tagged with its origin.
+type rawPacket struct {
+	in    *input
+	frame int       // 1-based frame number within in
+	ts    time.Time // capture time corrected by in.offset
+	ci    gopacket.CaptureInfo
+	data  []byte
+}
+
+// decode dissects the frame with the link type of its input.
+func (p *rawPacket) decode() gopacket.Packet {
+	packet := gopacket.NewPacket(p.data, p.in.linkType, gopacket.Default)
+	packet.Metadata().CaptureInfo = p.ci
+	return packet
+}
+
+// packetStream yields packets until io.EOF.
+type packetStream interface {
+	next() (*rawPacket, error)
+	close()
+}
+
+// openStream opens every input and returns a single stream over all of
+// them. With several inputs the packets are merged into capture time
+// order; inputs that are not time-ordered themselves are first sorted
+// through temporary files, so captures larger than memory can be merged.
+func openStream(inputs []*input, c *canceller) (packetStream, error) {
+	if len(inputs) == 1 {
+		if inputs[0].live {
+			return openLiveStream(inputs[0], c)
+		}
+		if inputs[0].follow {
+			return openFollowStream(inputs[0], c)
+		}
+		return openHandleStream(inputs[0], c)
+	}
+	var streams []packetStream
+	fail := func(err error) (packetStream, error) {
+		for _, s := range streams {
+			s.close()
+		}
+		return nil, err
+	}
+	for _, in := range inputs {
+		var s packetStream
+		ordered := true
+		if !in.live {
+			var err error
+			if ordered, err = isTimeOrdered(in, c); err != nil {
+				return fail(err)
+			}
+		}
+		if ordered {
+			hs, err := openHandleStream(in, c)
+			if err != nil {
+				return fail(err)
+			}
+			s = hs
+		} else {
+			ss, err := sortInput(in, c)
+			if err != nil {
+				return fail(err)
+			}
+			s = ss
+		}
+		streams = append(streams, s)
+	}
+	return newMergeStream(streams)
+}
+
+// handleStream reads the packets of one input in file order.
+type handleStream struct {
+	in     *input
+	handle *pcap.Handle
+	frame  int
+	c      *canceller
+	digest *inputDigest // hashing the file as it is read, if asked
+}
+
+func openHandleStream(in *input, c *canceller) (*handleStream, error) {
+	h, err := in.open()
+	if err != nil {
+		return nil, err
+	}
+	in.linkType = h.LinkType()
+	if !c.add(h) {
+		return nil, errStopped
+	}
+	s := &handleStream{in: in, handle: h, c: c}
+	if in.digest != nil && in.digest.start(in.path) {
+		s.digest = in.digest
+	}
+	return s, nil
+}
+
+func (s *handleStream) next() (*rawPacket, error) {
+	for {
+		if s.c.isStopped() {
+			return nil, errStopped
+		}
+		data, ci, err := s.handle.ReadPacketData()
+		if err == nil {
+			s.frame++
+			if s.digest != nil {
+				s.digest.advance(pcapRecordHeader + int64(ci.CaptureLength))
+			}
+			return &rawPacket{in: s.in, frame: s.frame, ts: ci.Timestamp.Add(s.in.offset), ci: ci, data: data}, nil
+		}
+		if !retryableReadError(err) {
+			if s.c.isStopped() {
+				return nil, errStopped
+			}
+			if s.digest != nil {
+				s.digest.finish()
+			}
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			// A corrupt or truncated file, or a capture that failed.
+			return nil, fmt.Errorf("%s: frame %d: %v", s.in.path, s.frame+1, err)
+		}
+	}
+}
+
+func (s *handleStream) close() {
+	s.handle.Close()
+	if s.digest != nil {
+		s.digest.finish()
+	}
+}
+
+// retryableReadError reports whether a read can be retried, following
+// gopacket.PacketSource: timeouts and EAGAIN are retried, errors that mean
+// the end of the capture or a closed handle are not.
+func retryableReadError(err error) bool {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return true
+	}
+	if err == pcap.NextErrorTimeoutExpired || err == syscall.EAGAIN {
+		return true
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrNoProgress ||
+		err == io.ErrClosedPipe || err == io.ErrShortBuffer || err == syscall.EBADF ||
+		strings.Contains(err.Error(), "use of closed file") {
+		return false
+	}
+	time.Sleep(5 * time.Millisecond)
+	return true
+}
+
+// isTimeOrdered scans a capture file for timestamps going backwards.
+func isTimeOrdered(in *input, c *canceller) (bool, error) {
+	s, err := openHandleStream(in, c)
+	if err != nil {
+		return false, err
+	}
+	defer s.close()
+	var last time.Time
+	for {
+		p, err := s.next()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if p.ts.Before(last) {
+			return false, nil
+		}
+		last = p.ts
+	}
+}
+
+// sortInput sorts an unordered capture into runs of sortBuffer packets
+// written to temporary files, and returns the merge of those runs. Every
+// maxRunFiles runs of a level are merged into a run of the next level.
+func sortInput(in *input, c *canceller) (packetStream, error) {
+	s, err := openHandleStream(in, c)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	var levels [][]packetStream // runs of sortBuffer packets, then of maxRunFiles runs...
+	fail := func(err error) (packetStream, error) {
+		for _, runs := range levels {
+			for _, r := range runs {
+				r.close()
+			}
+		}
+		return nil, err
+	}
+	var add func(r packetStream, level int) error
+	add = func(r packetStream, level int) error {
+		if level == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], r)
+		if len(levels[level]) < maxRunFiles {
+			return nil
+		}
+		runs := levels[level]
+		levels[level] = nil
+		merged, err := mergeRuns(runs)
+		if err != nil {
+			return err
+		}
+		return add(merged, level+1)
+	}
+	chunk := make([]*rawPacket, 0, sortBuffer)
+	spill := func() error {
+		sort.SliceStable(chunk, func(i, j int) bool { return chunk[i].ts.Before(chunk[j].ts) })
+		r, err := writeRun(chunk[0].in, func(w *bufio.Writer) error {
+			for _, p := range chunk {
+				writeRunRecord(w, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		chunk = chunk[:0]
+		return add(r, 0)
+	}
+	for {
+		p, err := s.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		chunk = append(chunk, p)
+		if len(chunk) == sortBuffer {
+			if err := spill(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if len(chunk) > 0 {
+		if err := spill(); err != nil {
+			return fail(err)
+		}
+	}
+	// The runs of a higher level hold earlier packets, which go first on
+	// equal timestamps.
+	var runs []packetStream
+	for l := len(levels) - 1; l >= 0; l-- {
+		runs = append(runs, levels[l]...)
+	}
+	return newMergeStream(runs)
+}
+
+// mergeRuns writes the merge of runs to a new run, and removes them.
+func mergeRuns(runs []packetStream) (*runStream, error) {
+	m, err := newMergeStream(runs)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close()
+	var in *input
+	if len(m.heads) > 0 {
+		in = m.heads[0].p.in
+	}
+	return writeRun(in, func(w *bufio.Writer) error {
+		for {
+			p, err := m.next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			writeRunRecord(w, p)
+		}
+	})
+}
+
+// runStream reads back a sorted run written by writeRun. Each record is
+// the frame number, capture timestamp, capture length, wire length and
+// interface index, followed by the frame data.
+type runStream struct {
+	in *input
+	f  *os.File
+	r  *bufio.Reader
+}
+
+const runHeaderLen = 8 + 8 + 4 + 4 + 4
+
+// writeRun creates a run of the packets of in that write writes with
+// writeRunRecord.
+func writeRun(in *input, write func(w *bufio.Writer) error) (*runStream, error) {
+	f, err := os.CreateTemp("", "diameter-parser-run-*")
+	if err != nil {
+		return nil, err
+	}
+	rs := &runStream{in: in, f: f}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		rs.close()
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		rs.close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		rs.close()
+		return nil, err
+	}
+	rs.r = bufio.NewReader(f)
+	return rs, nil
+}
+
+// writeRunRecord writes p to a run; errors are those of the final flush.
+func writeRunRecord(w *bufio.Writer, p *rawPacket) {
+	var hdr [runHeaderLen]byte
+	binary.BigEndian.PutUint64(hdr[0:], uint64(p.frame))
+	binary.BigEndian.PutUint64(hdr[8:], uint64(p.ci.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(hdr[16:], uint32(len(p.data)))
+	binary.BigEndian.PutUint32(hdr[20:], uint32(p.ci.Length))
+	binary.BigEndian.PutUint32(hdr[24:], uint32(p.ci.InterfaceIndex))
+	w.Write(hdr[:])
+	w.Write(p.data)
+}
+
+func (s *runStream) next() (*rawPacket, error) {
+	var hdr [runHeaderLen]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	p := &rawPacket{in: s.in, frame: int(binary.BigEndian.Uint64(hdr[0:]))}
+	p.ci.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:])))
+	p.ci.CaptureLength = int(binary.BigEndian.Uint32(hdr[16:]))
+	p.ci.Length = int(binary.BigEndian.Uint32(hdr[20:]))
+	p.ci.InterfaceIndex = int(binary.BigEndian.Uint32(hdr[24:]))
+	p.ts = p.ci.Timestamp.Add(s.in.offset)
+	p.data = make([]byte, p.ci.CaptureLength)
+	if _, err := io.ReadFull(s.r, p.data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return p, nil
+}
+
+func (s *runStream) close() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+// mergeStream merges time-ordered streams into one, with ties going to
+// the stream listed first.
+type mergeStream struct {
+	streams []packetStream
+	heads   mergeHeap
+}
+
+type mergeHead struct {
+	p   *rawPacket
+	src int
+}
+
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].p.ts.Equal(h[j].p.ts) {
+		return h[i].p.ts.Before(h[j].p.ts)
+	}
+	return h[i].src < h[j].src
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func newMergeStream(streams []packetStream) (*mergeStream, error) {
+	m := &mergeStream{streams: streams}
+	for i, s := range streams {
+		p, err := s.next()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.heads = append(m.heads, mergeHead{p, i})
+	}
+	heap.Init(&m.heads)
+	return m, nil
+}
+
+func (m *mergeStream) next() (*rawPacket, error) {
+	if len(m.heads) == 0 {
+		return nil, io.EOF
+	}
+	head := m.heads[0]
+	p, err := m.streams[head.src].next()
+	switch {
+	case err == nil:
+		m.heads[0].p = p
+		heap.Fix(&m.heads, 0)
+	case err == io.EOF:
+		heap.Pop(&m.heads)
+	default:
+		return nil, err
+	}
+	return head.p, nil
+}
+
+func (m *mergeStream) close() {
+	for _, s := range m.streams {
+		s.close()
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// sliceStream yields packets from a slice, then err or io.EOF.
+type sliceStream struct {
+	packets []*rawPacket
+	err     error
+	closed  bool
+}
+
+func (s *sliceStream) next() (*rawPacket, error) {
+	if len(s.packets) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	p := s.packets[0]
+	s.packets = s.packets[1:]
+	return p, nil
+}
+
+func (s *sliceStream) close() { s.closed = true }
+
+// packetsAt returns packets of in at the given seconds, numbered from 1.
+func packetsAt(in *input, secs ...int) []*rawPacket {
+	out := make([]*rawPacket, len(secs))
+	for i, s := range secs {
+		ts := time.Unix(int64(s), 0)
+		out[i] = &rawPacket{in: in, frame: i + 1, ts: ts, ci: gopacket.CaptureInfo{Timestamp: ts}}
+	}
+	return out
+}
+
+type packetID struct {
+	path  string
+	frame int
+}
+
+func drain(t *testing.T, s packetStream) []packetID {
+	t.Helper()
+	var out []packetID
+	for {
+		p, err := s.next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, packetID{p.in.path, p.frame})
+	}
+}
+
+func TestMergeStreamOrder(t *testing.T) {
+	a, b, c := &input{path: "a"}, &input{path: "b"}, &input{path: "c"}
+	for _, tc := range []struct {
+		name    string
+		streams [][]*rawPacket
+		want    []packetID
+	}{
+		{
+			name:    "interleaved",
+			streams: [][]*rawPacket{packetsAt(a, 1, 3, 5), packetsAt(b, 2, 4, 6)},
+			want:    []packetID{{"a", 1}, {"b", 1}, {"a", 2}, {"b", 2}, {"a", 3}, {"b", 3}},
+		},
+		{
+			name:    "ties go to the stream listed first",
+			streams: [][]*rawPacket{packetsAt(a, 2, 2), packetsAt(b, 1, 2), packetsAt(c, 2)},
+			want:    []packetID{{"b", 1}, {"a", 1}, {"a", 2}, {"b", 2}, {"c", 1}},
+		},
+		{
+			name:    "empty streams",
+			streams: [][]*rawPacket{nil, packetsAt(b, 1), nil},
+			want:    []packetID{{"b", 1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var streams []packetStream
+			for _, packets := range tc.streams {
+				streams = append(streams, &sliceStream{packets: packets})
+			}
+			m, err := newMergeStream(streams)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := drain(t, m)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", got, tc.want)
+				}
+			}
+			m.close()
+			for i, s := range streams {
+				if !s.(*sliceStream).closed {
+					t.Errorf("stream %d not closed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeStreamReadError(t *testing.T) {
+	failure := errors.New("frame 3: unexpected EOF")
+	a, b := &input{path: "a"}, &input{path: "b"}
+	m, err := newMergeStream([]packetStream{
+		&sliceStream{packets: packetsAt(a, 1, 2), err: failure},
+		&sliceStream{packets: packetsAt(b, 5)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, err := m.next()
+		if err == io.EOF {
+			t.Fatal("read error taken for the end of the stream")
+		}
+		if err != nil {
+			if err != failure {
+				t.Errorf("got %v, want %v", err, failure)
+			}
+			return
+		}
+	}
+}
+
+// writeCapture writes an Ethernet capture with a packet at each of the
+// given seconds, the frame number as payload.
+func writeCapture(t *testing.T, path string, secs []int) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriterNanos(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range secs {
+		data := make([]byte, 14, 16)
+		data = append(data, byte((i+1)>>8), byte(i+1))
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(s), 0), CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSortInput(t *testing.T) {
+	defer func(n int) { sortBuffer = n }(sortBuffer)
+	// 300 packets, timestamps going back every 7 and repeated 7 frames
+	// apart, so that equal timestamps fall into different runs.
+	var secs []int
+	for i := 0; i < 300; i++ {
+		secs = append(secs, (i%7)*10+i/30)
+	}
+	for _, buffer := range []int{1, 4, 1000} { // 300 runs over two levels, 75 runs, one
+		t.Run("buffer "+strconv.Itoa(buffer), func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("TMPDIR", dir)
+			path := filepath.Join(dir, "unordered.pcap")
+			writeCapture(t, path, secs)
+			sortBuffer = buffer
+
+			in := &input{path: path}
+			ordered, err := isTimeOrdered(in, &canceller{})
+			if err != nil || ordered {
+				t.Fatalf("isTimeOrdered = %v, %v, want false", ordered, err)
+			}
+			s, err := sortInput(in, &canceller{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var last *rawPacket
+			n := 0
+			for {
+				p, err := s.next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := secs[p.frame-1]; p.ts.Unix() != int64(want) {
+					t.Errorf("frame %d at %d, want %d", p.frame, p.ts.Unix(), want)
+				}
+				if got := int(p.data[14])<<8 | int(p.data[15]); got != p.frame {
+					t.Errorf("frame %d carries the data of frame %d", p.frame, got)
+				}
+				if last != nil && (p.ts.Before(last.ts) || p.ts.Equal(last.ts) && p.frame < last.frame) {
+					t.Errorf("frame %d at %v after frame %d at %v", p.frame, p.ts, last.frame, last.ts)
+				}
+				last = p
+				n++
+			}
+			s.close()
+			if n != len(secs) {
+				t.Errorf("%d packets, want %d", n, len(secs))
+			}
+			if runs, _ := filepath.Glob(filepath.Join(dir, "diameter-parser-run-*")); len(runs) != 0 {
+				t.Errorf("runs left behind: %v", runs)
+			}
+		})
+	}
+}
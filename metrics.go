@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics holds the internal counters of a run. Counters and distinct
+// counts are cumulative; latencies and the error ratio cover the interval
+// since the last push. Distinct counts and latencies are estimated, so that
+// memory stays constant however long the run.
+type metrics struct {
+	mu sync.Mutex
+
+	messages, requests, answers, errors, bytes uint64
+	peers                                      map[string]*peerMetrics
+	subscribers, sessions                      *hyperLogLog
+
+	latencies                       *tdigest // nanoseconds
+	intervalAnswers, intervalErrors uint64
+
+	// Server-initiated requests (RAR, ASR, IDR, CLR...) are answered by
+	// clients: their latency is kept apart from that of the servers.
+	serverRequests, serverAnswers, serverErrors uint64
+	serverLatencies                             *tdigest
+
+	// The packet counts of a live capture, with those of the last push.
+	capture     func() CaptureStats
+	lastCapture CaptureStats
+
+	sinks []metricsSink
+}
+
+// peerMetrics is the volume sent by one Origin-Host.
+type peerMetrics struct {
+	messages, bytes uint64
+}
+
+// metricsSnapshot is a consistent copy of the counters taken for a push.
+type metricsSnapshot struct {
+	time                                       time.Time
+	messages, requests, answers, errors, bytes uint64
+	peers                                      map[string]peerMetrics
+	subscribers, sessions                      uint64
+	latencyP50, latencyP90, latencyP99         time.Duration
+	errorRatio                                 float64
+
+	serverRequests, serverAnswers, serverErrors          uint64
+	serverLatencyP50, serverLatencyP90, serverLatencyP99 time.Duration
+
+	capture          *CaptureStats // nil unless capturing live
+	captureInterval  CaptureStats  // since the last push
+	captureDropRatio float64       // of the interval
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		peers:       make(map[string]*peerMetrics),
+		subscribers: newHyperLogLog(),
+		sessions:    newHyperLogLog(),
+		latencies:   newTDigest(),
+
+		serverLatencies: newTDigest(),
+	}
+}
+
+// observe accounts for one decoded message; req is the matching request
+// of an answer, if it was seen.
+func (m *metrics) observe(mi *MessageInfo, req *MessageInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages++
+	m.bytes += uint64(mi.MessageLength)
+	peer := mi.str("Origin-Host")
+	if peer == "" {
+		peer = "unknown"
+	}
+	p := m.peers[peer]
+	if p == nil {
+		p = &peerMetrics{}
+		m.peers[peer] = p
+	}
+	p.messages++
+	p.bytes += uint64(mi.MessageLength)
+	if sub := mi.subscriberID(); sub != "" {
+		m.subscribers.add(sub)
+	}
+	if sid := mi.str("Session-Id"); sid != "" {
+		m.sessions.add(sid)
+	}
+
+	if mi.isRequest() {
+		m.requests++
+		if mi.ServerInitiated {
+			m.serverRequests++
+		}
+		return
+	}
+	m.answers++
+	m.intervalAnswers++
+	failed := false
+	if rc, ok := mi.resultCode(); ok && rc.isError() {
+		m.errors++
+		m.intervalErrors++
+		failed = true
+	}
+	latencies := m.latencies
+	if mi.ServerInitiated {
+		m.serverAnswers++
+		if failed {
+			m.serverErrors++
+		}
+		latencies = m.serverLatencies
+	}
+	if req != nil {
+		latencies.add(float64(mi.Timestamp.Sub(req.Timestamp.Time)))
+	}
+}
+
+// snapshot copies the counters and starts a new latency interval.
+func (m *metrics) snapshot() *metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := &metricsSnapshot{
+		time:        time.Now(),
+		messages:    m.messages,
+		requests:    m.requests,
+		answers:     m.answers,
+		errors:      m.errors,
+		bytes:       m.bytes,
+		peers:       make(map[string]peerMetrics, len(m.peers)),
+		subscribers: m.subscribers.count(),
+		sessions:    m.sessions.count(),
+
+		serverRequests: m.serverRequests,
+		serverAnswers:  m.serverAnswers,
+		serverErrors:   m.serverErrors,
+	}
+	for name, p := range m.peers {
+		s.peers[name] = *p
+	}
+	if m.intervalAnswers > 0 {
+		s.errorRatio = float64(m.intervalErrors) / float64(m.intervalAnswers)
+	}
+	s.latencyP50 = time.Duration(m.latencies.quantile(0.50))
+	s.latencyP90 = time.Duration(m.latencies.quantile(0.90))
+	s.latencyP99 = time.Duration(m.latencies.quantile(0.99))
+	m.latencies.reset()
+	s.serverLatencyP50 = time.Duration(m.serverLatencies.quantile(0.50))
+	s.serverLatencyP90 = time.Duration(m.serverLatencies.quantile(0.90))
+	s.serverLatencyP99 = time.Duration(m.serverLatencies.quantile(0.99))
+	m.serverLatencies.reset()
+	m.intervalAnswers, m.intervalErrors = 0, 0
+	if m.capture != nil {
+		c := m.capture()
+		s.capture = &c
+		s.captureInterval = c.sub(m.lastCapture)
+		s.captureDropRatio = s.captureInterval.dropRatio()
+		m.lastCapture = c
+	}
+	return s
+}
+
+// setCapture makes the pushes include the packet counts of a live capture.
+func (m *metrics) setCapture(counts func() CaptureStats) {
+	m.mu.Lock()
+	m.capture = counts
+	m.mu.Unlock()
+}
+
+// setSinks replaces the sinks of the following pushes.
+func (m *metrics) setSinks(sinks []metricsSink) {
+	m.mu.Lock()
+	m.sinks = sinks
+	m.mu.Unlock()
+}
+
+// pushEvery sends a snapshot to every sink at each interval. The returned
+// function stops the pushes after a final one.
+func (m *metrics) pushEvery(interval time.Duration, sinks []metricsSink) (stop func()) {
+	m.setSinks(sinks)
+	push := func() {
+		s := m.snapshot()
+		m.mu.Lock()
+		sinks := m.sinks
+		m.mu.Unlock()
+		for _, sink := range sinks {
+			if err := sink.push(s); err != nil {
+				log.Println("metrics push error:", err)
+			}
+		}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				push()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		push()
+	}
+}
+
+// metricsSink receives metrics pushes.
+type metricsSink interface {
+	push(s *metricsSnapshot) error
+}
+
+// influxSink posts InfluxDB line protocol to a write endpoint.
+type influxSink struct {
+	url    string
+	client *http.Client
+}
+
+func newInfluxSink(url string) metricsSink {
+	return &influxSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *influxSink) push(m *metricsSnapshot) error {
+	var buf bytes.Buffer
+	ts := m.time.UnixNano()
+	tags := runLabels.influxTags()
+	fmt.Fprintf(&buf, "diameter%s messages=%di,requests=%di,answers=%di,errors=%di,bytes=%di,subscribers=%di,sessions=%di,error_ratio=%g,latency_p50_ms=%g,latency_p90_ms=%g,latency_p99_ms=%g %d\n",
+		tags, m.messages, m.requests, m.answers, m.errors, m.bytes, m.subscribers, m.sessions, m.errorRatio,
+		millis(m.latencyP50), millis(m.latencyP90), millis(m.latencyP99), ts)
+	fmt.Fprintf(&buf, "diameter_server_initiated%s requests=%di,answers=%di,errors=%di,latency_p50_ms=%g,latency_p90_ms=%g,latency_p99_ms=%g %d\n",
+		tags, m.serverRequests, m.serverAnswers, m.serverErrors,
+		millis(m.serverLatencyP50), millis(m.serverLatencyP90), millis(m.serverLatencyP99), ts)
+	if c := m.capture; c != nil {
+		d := m.captureInterval
+		fmt.Fprintf(&buf, "diameter_capture%s captured=%di,kernel_dropped=%di,interface_dropped=%di,queue_dropped=%di,"+
+			"captured_interval=%di,kernel_dropped_interval=%di,interface_dropped_interval=%di,queue_dropped_interval=%di,drop_ratio=%g %d\n",
+			tags, c.Captured, c.KernelDropped, c.InterfaceDropped, c.QueueDropped,
+			d.Captured, d.KernelDropped, d.InterfaceDropped, d.QueueDropped, m.captureDropRatio, ts)
+	}
+	for _, name := range sortedPeers(m.peers) {
+		p := m.peers[name]
+		fmt.Fprintf(&buf, "diameter_peer,peer=%s%s messages=%di,bytes=%di %d\n", influxTag(name), tags, p.messages, p.bytes, ts)
+	}
+
+	resp, err := s.client.Post(s.url, "text/plain; charset=utf-8", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx write: %s", resp.Status)
+	}
+	return nil
+}
+
+// graphiteSink writes the Carbon plaintext protocol over TCP.
+type graphiteSink struct {
+	addr string
+}
+
+func newGraphiteSink(addr string) metricsSink {
+	return &graphiteSink{addr: addr}
+}
+
+func (s *graphiteSink) push(m *metricsSnapshot) error {
+	conn, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	w := bufio.NewWriter(conn)
+	ts := m.time.Unix()
+	tags := runLabels.graphiteTags()
+	line := func(path string, v interface{}) {
+		fmt.Fprintf(w, "diameter.%s%s %v %d\n", path, tags, v, ts)
+	}
+	line("messages", m.messages)
+	line("requests", m.requests)
+	line("answers", m.answers)
+	line("errors", m.errors)
+	line("bytes", m.bytes)
+	line("subscribers", m.subscribers)
+	line("sessions", m.sessions)
+	line("error_ratio", m.errorRatio)
+	line("latency.p50_ms", millis(m.latencyP50))
+	line("latency.p90_ms", millis(m.latencyP90))
+	line("latency.p99_ms", millis(m.latencyP99))
+	line("server_initiated.requests", m.serverRequests)
+	line("server_initiated.answers", m.serverAnswers)
+	line("server_initiated.errors", m.serverErrors)
+	line("server_initiated.latency.p50_ms", millis(m.serverLatencyP50))
+	line("server_initiated.latency.p90_ms", millis(m.serverLatencyP90))
+	line("server_initiated.latency.p99_ms", millis(m.serverLatencyP99))
+	if c := m.capture; c != nil {
+		line("capture.captured", c.Captured)
+		line("capture.kernel_dropped", c.KernelDropped)
+		line("capture.interface_dropped", c.InterfaceDropped)
+		line("capture.queue_dropped", c.QueueDropped)
+		d := m.captureInterval
+		line("capture.interval.captured", d.Captured)
+		line("capture.interval.kernel_dropped", d.KernelDropped)
+		line("capture.interval.interface_dropped", d.InterfaceDropped)
+		line("capture.interval.queue_dropped", d.QueueDropped)
+		line("capture.drop_ratio", m.captureDropRatio)
+	}
+	for _, name := range sortedPeers(m.peers) {
+		p := m.peers[name]
+		line("peer."+graphiteNode(name)+".messages", p.messages)
+		line("peer."+graphiteNode(name)+".bytes", p.bytes)
+	}
+	return w.Flush()
+}
+
+// graphiteNode makes s usable as a single node of a Graphite path.
+var graphiteNode = strings.NewReplacer(".", "_", " ", "_").Replace
+
+func sortedPeers(peers map[string]peerMetrics) []string {
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
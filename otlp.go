@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	otlpQueue         = 16 // batches waiting to be posted
+
+	// Session spans are emitted when their session ends, or after an hour
+	// of capture time without a transaction, and sessions beyond
+	// otlpMaxSessions are emitted from the least recently active.
+	otlpSessionIdle = time.Hour
+	otlpMaxSessions = 100000
+)
+
+// imsiHashKey is the secret keying the IMSI hashes of spans (the content of
+// -otlp-hash-key-file). Without it spans carry no IMSI hash, as an unkeyed
+// hash of an IMSI is easily reversed by hashing every IMSI of the network.
+var imsiHashKey []byte
+
+// traceExporter turns each request/answer pair into an OpenTelemetry span
+// and posts them to an OTLP/HTTP collector using the JSON encoding. With
+// sessions enabled, every transaction of a Session-Id shares one trace
+// under a session span emitted when the session ends. Batches are posted
+// by a goroutine of their own, so that a slow collector does not hold up
+// decoding: when otlpQueue batches are waiting, further ones are dropped.
+type traceExporter struct {
+	url       string
+	client    *http.Client
+	sessions  map[string]*sessionSpan // nil unless session spans are enabled
+	spans     []otlpSpan
+	lastFlush time.Time
+	observed  int
+
+	batches chan []otlpSpan
+	queued  atomic.Int64 // spans in batches not yet posted
+	dropped int
+	done    sync.WaitGroup
+}
+
+// sessionSpan tracks the extent of a session until its span is emitted.
+type sessionSpan struct {
+	first, last time.Time
+	attrs       []otlpAttr
+}
+
+// newTraceExporter exports to the collector at endpoint, e.g.
+// http://localhost:4318.
+func newTraceExporter(endpoint string, sessions bool) *traceExporter {
+	e := &traceExporter{
+		url:       strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:    &http.Client{Timeout: 10 * time.Second},
+		lastFlush: time.Now(),
+		batches:   make(chan []otlpSpan, otlpQueue),
+	}
+	if sessions {
+		e.sessions = make(map[string]*sessionSpan)
+	}
+	e.done.Add(1)
+	go func() {
+		defer e.done.Done()
+		for spans := range e.batches {
+			if err := e.post(spans); err != nil {
+				log.Println("otlp export error:", err)
+			}
+			e.queued.Add(-int64(len(spans)))
+		}
+	}()
+	return e
+}
+
+// observe emits a span for every answer whose request was seen.
+func (e *traceExporter) observe(mi *MessageInfo, req *MessageInfo) {
+	if req == nil {
+		return
+	}
+	sid := req.str("Session-Id")
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(traceID(req, sid, e.sessions != nil)),
+		SpanID:            hex.EncodeToString(hashID(8, "tx", req.str("Origin-Host"), strconv.FormatUint(uint64(req.EndToEndID), 10), req.Timestamp.String())),
+		Name:              commandLabel(mi.CommandCode),
+		Kind:              3, // SPAN_KIND_CLIENT
+		StartTimeUnixNano: strconv.FormatInt(req.Timestamp.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(mi.Timestamp.UnixNano(), 10),
+		Attributes:        transactionAttrs(mi, req, sid),
+	}
+	if rc, ok := mi.resultCode(); ok && rc.isError() {
+		span.Status = &otlpStatus{Code: 2, Message: resultCodeName(rc)} // STATUS_CODE_ERROR
+	}
+
+	if e.sessions != nil && sid != "" {
+		s := e.sessions[sid]
+		if s == nil {
+			if len(e.sessions) >= otlpMaxSessions {
+				e.evictSessions()
+			}
+			s = &sessionSpan{first: req.Timestamp.Time, attrs: sessionAttrs(req, sid)}
+			e.sessions[sid] = s
+		}
+		s.last = mi.Timestamp.Time
+		span.ParentSpanID = hex.EncodeToString(hashID(8, "session", sid))
+		if sessionEnded(mi, req) {
+			e.spans = append(e.spans, s.span(sid))
+			delete(e.sessions, sid)
+		}
+	}
+
+	e.spans = append(e.spans, span)
+	e.observed++
+	if e.sessions != nil && e.observed%10000 == 0 {
+		e.expireSessions(mi.Timestamp.Time)
+	}
+	if len(e.spans) >= otlpBatchSize || time.Since(e.lastFlush) >= otlpFlushInterval {
+		e.flush()
+	}
+}
+
+// expireSessions emits the spans of the sessions idle for otlpSessionIdle
+// at capture time now.
+func (e *traceExporter) expireSessions(now time.Time) {
+	for sid, s := range e.sessions {
+		if now.Sub(s.last) > otlpSessionIdle {
+			e.spans = append(e.spans, s.span(sid))
+			delete(e.sessions, sid)
+		}
+	}
+}
+
+// evictSessions emits the spans of the tenth of the sessions least
+// recently active, to make room for new ones.
+func (e *traceExporter) evictSessions() {
+	sids := make([]string, 0, len(e.sessions))
+	for sid := range e.sessions {
+		sids = append(sids, sid)
+	}
+	sort.Slice(sids, func(i, j int) bool { return e.sessions[sids[i]].last.Before(e.sessions[sids[j]].last) })
+	for _, sid := range sids[:len(sids)/10+1] {
+		e.spans = append(e.spans, e.sessions[sid].span(sid))
+		delete(e.sessions, sid)
+	}
+}
+
+// pending returns the number of spans waiting to be exported.
+func (e *traceExporter) pending() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.spans) + int(e.queued.Load())
+}
+
+// close emits the spans of sessions still open, flushes and waits for the
+// batches queued to be posted.
+func (e *traceExporter) close() {
+	for sid, s := range e.sessions {
+		e.spans = append(e.spans, s.span(sid))
+	}
+	e.sessions = nil
+	e.flush()
+	close(e.batches)
+	e.done.Wait()
+	if e.dropped > 0 {
+		log.Printf("otlp: %d spans dropped, the collector not keeping up", e.dropped)
+	}
+}
+
+// flush queues the spans for posting, or drops them if the queue is full.
+func (e *traceExporter) flush() {
+	e.lastFlush = time.Now()
+	if len(e.spans) == 0 {
+		return
+	}
+	e.queued.Add(int64(len(e.spans)))
+	select {
+	case e.batches <- e.spans:
+	default:
+		e.queued.Add(-int64(len(e.spans)))
+		e.dropped += len(e.spans)
+	}
+	e.spans = nil
+}
+
+func (e *traceExporter) post(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: resourceAttrs()},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "diameter-parser"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export: %s", resp.Status)
+	}
+	return nil
+}
+
+// resourceAttrs describes the exporting process; run labels become
+// resource attributes.
+func resourceAttrs() []otlpAttr {
+	attrs := []otlpAttr{strAttr("service.name", "diameter-parser")}
+	for _, k := range runLabels.keys() {
+		attrs = append(attrs, strAttr(k, runLabels[k]))
+	}
+	return attrs
+}
+
+func (s *sessionSpan) span(sid string) otlpSpan {
+	return otlpSpan{
+		TraceID:           hex.EncodeToString(hashID(16, "session", sid)),
+		SpanID:            hex.EncodeToString(hashID(8, "session", sid)),
+		Name:              "Diameter session",
+		Kind:              1, // SPAN_KIND_INTERNAL
+		StartTimeUnixNano: strconv.FormatInt(s.first.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.last.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+}
+
+// sessionEnded reports whether an answer closes its session: an STA, or
+// the CCA of a CCR-Terminate.
+func sessionEnded(mi *MessageInfo, req *MessageInfo) bool {
+	switch mi.CommandCode {
+	case 275:
+		return true
+	case 272:
+		if a := req.avp("CC-Request-Type"); a != nil {
+			v, _ := a.uint()
+			return v == 3 // TERMINATION_REQUEST
+		}
+	}
+	return false
+}
+
+// traceID is derived from the Session-Id when spans are grouped by session,
+// else from the transaction itself.
+func traceID(req *MessageInfo, sid string, bySession bool) []byte {
+	if bySession && sid != "" {
+		return hashID(16, "session", sid)
+	}
+	return hashID(16, "tx", req.str("Origin-Host"), strconv.FormatUint(uint64(req.EndToEndID), 10), req.Timestamp.String())
+}
+
+// hashID hashes parts into a stable identifier of n bytes, so re-running
+// the export over the same capture produces the same trace.
+func hashID(n int, parts ...string) []byte {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return sum[:n]
+}
+
+// imsiHash identifies a subscriber in spans without exposing the IMSI: the
+// first 8 bytes of its HMAC-SHA256 under imsiHashKey.
+func imsiHash(imsi string) string {
+	mac := hmac.New(sha256.New, imsiHashKey)
+	mac.Write([]byte(imsi))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func transactionAttrs(mi *MessageInfo, req *MessageInfo, sid string) []otlpAttr {
+	attrs := []otlpAttr{
+		intAttr("diameter.command_code", uint64(mi.CommandCode)),
+		intAttr("diameter.application_id", uint64(mi.ApplicationID)),
+		intAttr("diameter.hop_by_hop_id", uint64(mi.HopByHopID)),
+		intAttr("diameter.end_to_end_id", uint64(mi.EndToEndID)),
+	}
+	add := func(key, v string) {
+		if v != "" {
+			attrs = append(attrs, strAttr(key, v))
+		}
+	}
+	add("diameter.command", commandCodeName(mi.CommandCode))
+	add("diameter.application", applicationName(mi.ApplicationID))
+	add("diameter.origin_host", req.str("Origin-Host"))
+	add("diameter.origin_realm", req.str("Origin-Realm"))
+	add("diameter.destination_host", mi.str("Origin-Host"))
+	add("diameter.destination_realm", mi.str("Origin-Realm"))
+	add("diameter.session_id", sid)
+	if req.ServerInitiated {
+		attrs = append(attrs, otlpAttr{Key: "diameter.server_initiated", Value: otlpValue{BoolValue: &req.ServerInitiated}})
+	}
+	if rc, ok := mi.resultCode(); ok {
+		attrs = append(attrs, intAttr("diameter.result_code", uint64(rc.Code)))
+		if rc.Experimental {
+			attrs = append(attrs, otlpAttr{Key: "diameter.experimental_result", Value: otlpValue{BoolValue: &rc.Experimental}})
+		}
+	}
+	sub := mi.subscriberID()
+	if sub == "" {
+		sub = req.subscriberID()
+	}
+	if sub != "" && imsiHashKey != nil {
+		add("diameter.imsi_hash", imsiHash(sub))
+	}
+	return attrs
+}
+
+func sessionAttrs(req *MessageInfo, sid string) []otlpAttr {
+	attrs := []otlpAttr{
+		strAttr("diameter.session_id", sid),
+		intAttr("diameter.application_id", uint64(req.ApplicationID)),
+	}
+	if sub := req.subscriberID(); sub != "" && imsiHashKey != nil {
+		attrs = append(attrs, strAttr("diameter.imsi_hash", imsiHash(sub)))
+	}
+	return attrs
+}
+
+// OTLP/HTTP JSON encoding of ExportTraceServiceRequest. Trace and span IDs
+// are hex strings and 64-bit integers are decimal strings, as the
+// protocol's JSON mapping requires.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func strAttr(key, v string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: &v}}
+}
+
+func intAttr(key string, v uint64) otlpAttr {
+	s := strconv.FormatUint(v, 10)
+	return otlpAttr{Key: key, Value: otlpValue{IntValue: &s}}
+}
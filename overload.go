@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Diameter Overload Indication Conveyance (DOIC, RFC 7683): a reacting
+// node advertises the abatement algorithms it supports in
+// OC-Supported-Features of its requests, and an overloaded reporting node
+// answers with an OC-OLR asking for a reduction of the traffic sent to it.
+
+// defaultOCValidity is the OC-Validity-Duration of an OLR without one
+// (RFC 7683, 7.4).
+const defaultOCValidity = 30
+
+// ocFeatures are the bits of OC-Feature-Vector (RFC 7683, 7.3).
+var ocFeatures = []struct {
+	bit  uint64
+	name string
+}{
+	{1, "OLR_DEFAULT_ALGO"},
+}
+
+// ocReportTypes are the values of OC-Report-Type (RFC 7683, 7.6; PEER_REPORT
+// from RFC 8581).
+var ocReportTypes = map[uint64]string{0: "HOST_REPORT", 1: "REALM_REPORT", 2: "PEER_REPORT"}
+
+// OverloadInfo is the DOIC content of a message, given with the decoders
+// of the full profile.
+type OverloadInfo struct {
+	SupportedFeatures *OCFeatures     `json:"supported_features,omitempty"`
+	OLR               *OverloadReport `json:"olr,omitempty"`
+}
+
+// OCFeatures is a decoded OC-Supported-Features.
+type OCFeatures struct {
+	Vector   uint64   `json:"vector"`
+	Features []string `json:"features"`
+}
+
+// OverloadReport is a decoded OC-OLR. A reduction of 0 or a validity of
+// 0 ends the overload.
+type OverloadReport struct {
+	SequenceNumber      uint64 `json:"sequence_number"`
+	ReportType          string `json:"report_type"`
+	ReductionPercentage uint64 `json:"reduction_percentage"`
+	ValidityDuration    uint64 `json:"validity_duration"` // seconds
+}
+
+// overloadOf decodes the DOIC AVPs of a message, or returns nil if it has
+// none.
+func overloadOf(mi *MessageInfo) *OverloadInfo {
+	sf, olr := mi.avp("OC-Supported-Features"), mi.avp("OC-OLR")
+	if sf == nil && olr == nil {
+		return nil
+	}
+	o := &OverloadInfo{}
+	if sf != nil {
+		f := &OCFeatures{Vector: avpUint(sf.children(), "OC-Feature-Vector"), Features: []string{}}
+		for _, b := range ocFeatures {
+			if f.Vector&b.bit != 0 {
+				f.Features = append(f.Features, b.name)
+			}
+		}
+		o.SupportedFeatures = f
+	}
+	if olr != nil {
+		c := olr.children()
+		r := &OverloadReport{
+			SequenceNumber:      avpUint(c, "OC-Sequence-Number"),
+			ReductionPercentage: avpUint(c, "OC-Reduction-Percentage"),
+			ValidityDuration:    defaultOCValidity,
+		}
+		if v := avpOptUint(c, "OC-Validity-Duration"); v != nil {
+			r.ValidityDuration = *v
+		}
+		t := avpUint(c, "OC-Report-Type")
+		if r.ReportType = ocReportTypes[t]; r.ReportType == "" {
+			r.ReportType = fmt.Sprintf("%d", t)
+		}
+		o.OLR = r
+	}
+	return o
+}
+
+// ended reports whether the OLR cancels the overload.
+func (r *OverloadReport) ended() bool {
+	return r.ReductionPercentage == 0 || r.ValidityDuration == 0
+}
+
+// overloadReport is the overload timeline of every reporting node: the
+// OLRs it sent, in which the sequence number changed, and the periods of
+// requested reduction they make up, with the traffic answered by the node
+// before and during each period, to check the reacting nodes abated.
+type overloadReport struct {
+	nodes map[string]*overloadNode
+	last  time.Time
+}
+
+type overloadNode struct {
+	name      string
+	reports   int // answers carrying an OLR
+	reacting  counter
+	timeline  []OverloadEvent
+	periods   []*OverloadPeriod
+	current   *OverloadPeriod // nil when not overloaded
+	seq       uint64
+	expires   time.Time
+	perSecond map[int64]int // answered requests by second of the request
+	first     time.Time     // of the first answered request
+}
+
+// OverloadEvent is an OLR with a new sequence number, or the expiry of
+// the last one.
+type OverloadEvent struct {
+	Frame               int       `json:"frame,omitempty"`
+	Timestamp           Timestamp `json:"timestamp"`
+	Event               string    `json:"event"` // start, update, end or expired
+	SequenceNumber      uint64    `json:"sequence_number"`
+	ReportType          string    `json:"report_type,omitempty"`
+	ReductionPercentage uint64    `json:"reduction_percentage"`
+	ValidityDuration    uint64    `json:"validity_duration"`
+	ReactingNode        string    `json:"reacting_node,omitempty"`
+}
+
+// OverloadPeriod is a time during which the node asked for a reduction.
+// Traffic is in answered requests per second; the window before the
+// period is as long as the period, at most a minute, and starts no
+// earlier than the traffic of the node in the capture.
+type OverloadPeriod struct {
+	Start             Timestamp `json:"start"`
+	End               Timestamp `json:"end"`
+	EndReason         string    `json:"end_reason"` // end, expired or ongoing
+	MaxReduction      uint64    `json:"max_reduction_percentage"`
+	TrafficBefore     float64   `json:"traffic_before_tps"`
+	TrafficDuring     float64   `json:"traffic_during_tps"`
+	ObservedReduction *float64  `json:"observed_reduction_percentage,omitempty"`
+	Reports           int       `json:"reports"` // OLRs received during the period
+}
+
+// OverloadNodeStats is the timeline of one reporting node.
+type OverloadNodeStats struct {
+	Node              string            `json:"node"`
+	Reports           int               `json:"reports"`
+	OverloadedSeconds float64           `json:"overloaded_seconds"`
+	ReactingNodes     []NameCount       `json:"reacting_nodes"`
+	Periods           []*OverloadPeriod `json:"periods"`
+	Timeline          []OverloadEvent   `json:"timeline"`
+}
+
+func newOverloadReport() (report, error) {
+	return &overloadReport{nodes: make(map[string]*overloadNode)}, nil
+}
+
+func (r *overloadReport) add(mi *MessageInfo, req *MessageInfo) {
+	if mi.Timestamp.After(r.last) {
+		r.last = mi.Timestamp.Time
+	}
+	if mi.isRequest() || req == nil {
+		return
+	}
+	host := mi.str("Origin-Host")
+	n := r.nodes[host]
+	if n == nil {
+		// Only the nodes that report overload are listed, but traffic
+		// is counted from the start for the comparison.
+		n = &overloadNode{name: host, reacting: make(counter), perSecond: make(map[int64]int)}
+		r.nodes[host] = n
+	}
+	if n.first.IsZero() || req.Timestamp.Before(n.first) {
+		n.first = req.Timestamp.Time
+	}
+	n.perSecond[req.Timestamp.Unix()]++
+	n.expire(mi.Timestamp.Time)
+
+	o := mi.Overload
+	if o == nil {
+		o = overloadOf(mi)
+	}
+	if o == nil || o.OLR == nil {
+		return
+	}
+	olr := o.OLR
+	n.reports++
+	n.reacting.inc(req.str("Origin-Host"))
+	if n.current != nil {
+		n.current.Reports++
+	}
+	if n.seq != 0 && olr.SequenceNumber <= n.seq {
+		return // repeated, or older than the one in force
+	}
+	n.seq = olr.SequenceNumber
+	ev := OverloadEvent{
+		Frame:               mi.Frame,
+		Timestamp:           mi.Timestamp,
+		SequenceNumber:      olr.SequenceNumber,
+		ReportType:          olr.ReportType,
+		ReductionPercentage: olr.ReductionPercentage,
+		ValidityDuration:    olr.ValidityDuration,
+		ReactingNode:        req.str("Origin-Host"),
+	}
+	switch {
+	case olr.ended():
+		if n.current == nil {
+			return
+		}
+		ev.Event = "end"
+		n.endPeriod(mi.Timestamp.Time, "end")
+	case n.current == nil:
+		ev.Event = "start"
+		n.current = &OverloadPeriod{Start: mi.Timestamp, MaxReduction: olr.ReductionPercentage, Reports: 1}
+		n.periods = append(n.periods, n.current)
+	default:
+		ev.Event = "update"
+		n.current.MaxReduction = max(n.current.MaxReduction, olr.ReductionPercentage)
+	}
+	n.expires = mi.Timestamp.Add(time.Duration(olr.ValidityDuration) * time.Second)
+	n.timeline = append(n.timeline, ev)
+}
+
+// expire ends the current period if its last OLR ran out before t.
+func (n *overloadNode) expire(t time.Time) {
+	if n.current == nil || !t.After(n.expires) {
+		return
+	}
+	n.timeline = append(n.timeline, OverloadEvent{Timestamp: Timestamp{n.expires}, Event: "expired", SequenceNumber: n.seq})
+	n.endPeriod(n.expires, "expired")
+}
+
+func (n *overloadNode) endPeriod(t time.Time, reason string) {
+	n.current.End, n.current.EndReason = Timestamp{t}, reason
+	n.current = nil
+}
+
+// traffic returns the answered requests per second in the whole seconds
+// from from to to, at least one.
+func (n *overloadNode) traffic(from, to time.Time) float64 {
+	start := from.Unix()
+	end := max(to.Unix(), start+1)
+	count := 0
+	for s := start; s < end; s++ {
+		count += n.perSecond[s]
+	}
+	return math.Round(float64(count)/float64(end-start)*100) / 100
+}
+
+func (r *overloadReport) write(w io.Writer) error {
+	nodes := make([]OverloadNodeStats, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		if n.reports == 0 {
+			continue
+		}
+		n.expire(r.last)
+		if n.current != nil {
+			n.current.End, n.current.EndReason = Timestamp{r.last}, "ongoing"
+		}
+		s := OverloadNodeStats{Node: n.name, Reports: n.reports, ReactingNodes: n.reacting.top(reportTop), Periods: n.periods, Timeline: n.timeline}
+		for _, p := range n.periods {
+			d := p.End.Sub(p.Start.Time)
+			s.OverloadedSeconds += d.Seconds()
+			window := min(max(d, time.Second), time.Minute)
+			from := p.Start.Add(-window)
+			if from.Before(n.first) {
+				from = n.first
+			}
+			p.TrafficBefore = n.traffic(from, p.Start.Time)
+			p.TrafficDuring = n.traffic(p.Start.Time, p.End.Time)
+			if p.TrafficBefore > 0 {
+				v := math.Round((1-p.TrafficDuring/p.TrafficBefore)*10000) / 100
+				p.ObservedReduction = &v
+			}
+		}
+		s.OverloadedSeconds = math.Round(s.OverloadedSeconds*1000) / 1000
+		nodes = append(nodes, s)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	return writeJSON(w, struct {
+		Labels   map[string]string   `json:"labels,omitempty"`
+		Warnings []string            `json:"warnings,omitempty"`
+		Nodes    []OverloadNodeStats `json:"nodes"`
+	}{runLabels, reportWarnings(), nodes})
+}
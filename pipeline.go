@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// pipelineDepth is the number of packets queued per decode worker.
+const pipelineDepth = 64
+
+// decodedRecord is the outcome of decoding the packet of sequence number
+// seq; mi is nil when the packet carried no Diameter message.
+type decodedRecord struct {
+	seq uint64
+	mi  *MessageInfo
+	err error
+}
+
+type sequencedPacket struct {
+	seq uint64
+	p   *rawPacket
+}
+
+// runPipeline decodes the packets of stream on workers goroutines and
+// hands the messages to handle on the calling goroutine, nil for the
+// packets carrying none. Packets are
+// numbered in capture order and each message gets its number as Seq.
+// Unordered, messages are handled as soon as decoded; ordered, they are
+// held back until all earlier packets have been handled. A decode error
+// stops the reading and no later message is handled. It returns the
+// decode error, or the read error that ended the stream if not io.EOF or
+// errStopped.
+func runPipeline(stream packetStream, workers int, ordered bool, decode func(*rawPacket) (*MessageInfo, error), handle func(*MessageInfo)) error {
+	packets := make(chan sequencedPacket, workers*pipelineDepth)
+	records := make(chan decodedRecord, workers*pipelineDepth)
+	stop := make(chan struct{})
+
+	var readErr, decodeErr error
+	go func() {
+		defer close(packets)
+		for seq := uint64(1); ; seq++ {
+			p, err := stream.next()
+			if err == io.EOF || err == errStopped {
+				return
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+			select {
+			case packets <- sequencedPacket{seq, p}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sp := range packets {
+				mi, err := decode(sp.p)
+				records <- decodedRecord{sp.seq, mi, err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(records)
+	}()
+
+	emit := func(r decodedRecord) {
+		if r.err != nil && decodeErr == nil {
+			decodeErr = r.err
+			close(stop)
+		}
+		if decodeErr != nil {
+			return
+		}
+		if r.mi != nil {
+			r.mi.Seq = r.seq
+		}
+		handle(r.mi)
+	}
+	pending := make(map[uint64]decodedRecord)
+	next := uint64(1)
+	for r := range records {
+		if !ordered {
+			emit(r)
+			continue
+		}
+		pending[r.seq] = r
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			emit(r)
+		}
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+	// readErr is written before packets is closed, which happens before
+	// records is closed.
+	return readErr
+}
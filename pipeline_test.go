@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// transactionPackets returns n request/answer pairs: the odd frames are
+// requests, each answered by the next frame.
+func transactionPackets(n int) []*rawPacket {
+	in := &input{path: "pipeline"}
+	out := make([]*rawPacket, 2*n)
+	for i := range out {
+		out[i] = &rawPacket{in: in, frame: i + 1, ts: time.Unix(int64(i), 0)}
+	}
+	return out
+}
+
+// decodeTransaction decodes the packets of transactionPackets, requests
+// more slowly than answers so that decoded answers overtake them.
+func decodeTransaction(p *rawPacket) (*MessageInfo, error) {
+	mi := &MessageInfo{Frame: p.frame, Timestamp: Timestamp{p.ts}, HopByHopID: uint32((p.frame + 1) / 2)}
+	if p.frame%2 == 1 {
+		mi.CommandFlags = 0x80
+		time.Sleep(100 * time.Microsecond)
+	}
+	return mi, nil
+}
+
+func TestRunPipelineCorrelation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		workers int
+		ordered bool
+	}{
+		{"ordered", 4, true},
+		{"unordered", 4, false},
+		{"one worker", 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const pairs = 500
+			corr := newCorrelator()
+			seen := make(map[uint64]bool)
+			var last uint64
+			matched, handled, inOrder := 0, 0, true
+			err := runPipeline(&sliceStream{packets: transactionPackets(pairs)}, tc.workers, tc.ordered, decodeTransaction, func(mi *MessageInfo) {
+				handled++
+				if seen[mi.Seq] || mi.Seq != uint64(mi.Frame) {
+					t.Errorf("frame %d handled as seq %d", mi.Frame, mi.Seq)
+				}
+				seen[mi.Seq] = true
+				inOrder = inOrder && mi.Seq > last
+				last = mi.Seq
+				if corr.match(mi) != nil {
+					matched++
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if handled != 2*pairs {
+				t.Errorf("%d messages handled, want %d", handled, 2*pairs)
+			}
+			// Ordered, every answer is handled after its request and
+			// matches it; unordered, nothing is promised but every message.
+			if tc.ordered && (!inOrder || matched != pairs) {
+				t.Errorf("in order %v, %d of %d answers matched", inOrder, matched, pairs)
+			}
+		})
+	}
+}
+
+func TestRunPipelineErrors(t *testing.T) {
+	readErr := errors.New("read error")
+	decodeErr := errors.New("decode error")
+	for _, tc := range []struct {
+		name     string
+		streamed error
+		failAt   int // frame failing to decode
+		want     error
+		maxFrame int // last frame handled, ordered
+	}{
+		{"end of stream", nil, 0, nil, 20},
+		{"read error", readErr, 0, readErr, 20},
+		{"decode error", nil, 7, decodeErr, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decode := func(p *rawPacket) (*MessageInfo, error) {
+				if p.frame == tc.failAt {
+					return nil, decodeErr
+				}
+				return decodeTransaction(p)
+			}
+			last := 0
+			err := runPipeline(&sliceStream{packets: transactionPackets(10), err: tc.streamed}, 3, true, decode, func(mi *MessageInfo) {
+				last = mi.Frame
+			})
+			if err != tc.want {
+				t.Errorf("runPipeline = %v, want %v", err, tc.want)
+			}
+			if last != tc.maxFrame {
+				t.Errorf("last frame handled %d, want %d", last, tc.maxFrame)
+			}
+		})
+	}
+}
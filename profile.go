@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// decodeProfile selects the enrichment stages run on every message, to
+// trade detail for throughput.
+type decodeProfile struct {
+	names     bool // command, application and AVP names from the dictionaries
+	decoders  bool // numbers, PLMNs and charging identifiers
+	grouped   bool // expand the members of grouped AVPs
+	correlate bool // match answers to their requests
+	validate  bool // check the messages for protocol violations
+}
+
+// decodeProfiles maps -profile names to their stages.
+var decodeProfiles = map[string]decodeProfile{
+	"minimal":  {},
+	"standard": {names: true, grouped: true, correlate: true, validate: true},
+	"full":     {names: true, decoders: true, grouped: true, correlate: true, validate: true},
+}
+
+// profile is the decode profile of the run.
+var profile = decodeProfiles["full"]
+
+// setProfile selects the profile called name.
+func setProfile(name string) error {
+	p, ok := decodeProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(decodeProfiles))
+		for n := range decodeProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	profile = p
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Thresholds of the gy-quota report: a session re-authorizing the quota
+// of a rating group more often than quotaMaxRate CCR-Updates per minute,
+// or sending quotaStorm CCR-Updates within a minute, is flagged.
+var (
+	quotaMaxRate = 2.0
+	quotaStorm   = 10
+)
+
+const gyApplicationID = 4
+
+// ccRequestUpdate and ccRequestTermination are CC-Request-Type values
+// (RFC 4006, 8.3).
+const (
+	ccRequestUpdate      = 2
+	ccRequestTermination = 3
+)
+
+// reportingReasons are the values of Reporting-Reason (TS 32.299, 7.2.175).
+var reportingReasons = map[uint64]string{
+	0: "THRESHOLD",
+	1: "QHT",
+	2: "FINAL",
+	3: "QUOTA_EXHAUSTED",
+	4: "VALIDITY_TIME",
+	5: "OTHER_QUOTA_TYPE",
+	6: "RATING_CONDITION_CHANGE",
+	7: "FORCED_REAUTHORISATION",
+	8: "POOL_EXHAUSTED",
+	9: "UNUSED_QUOTA_TIMER",
+}
+
+// finalUnitActions are the values of Final-Unit-Action (RFC 4006, 8.35).
+var finalUnitActions = map[uint64]string{0: "TERMINATE", 1: "REDIRECT", 2: "RESTRICT_ACCESS"}
+
+// quotaReport analyzes the credit control of Gy sessions per rating group:
+// how often the quota is re-authorized and why, the units and validity
+// granted, and the final unit indications, to tell an OCS granting too
+// little quota or too short a validity from subscribers running out of
+// credit.
+type quotaReport struct {
+	sessions map[string]*quotaSession // open sessions, by Session-Id
+	groups   map[string]*quotaGroup   // by rating group
+	flagged  []QuotaFlow
+}
+
+type quotaSession struct {
+	subscriber string
+	flows      map[string]*quotaFlow // by rating group
+}
+
+// quotaFlow is the credit control of one rating group in one session.
+type quotaFlow struct {
+	first, last time.Time
+	updates     []time.Time // of the CCR-Updates reporting the group
+	reasons     counter
+	grantedOct  []float64
+	grantedTime []float64
+	validity    []float64
+	fui         string // Final-Unit-Action of the last indication
+}
+
+type quotaGroup struct {
+	flows, updates     int
+	minutes            float64
+	subscribers        map[string]bool
+	reasons, fui       counter
+	granted, gtime, vt *tdigest
+	intervals          *tdigest // seconds between CCR-Updates
+	flagged            int
+}
+
+// QuotaGroupStats summarizes a rating group over all sessions. Granted
+// units and intervals are medians.
+type QuotaGroupStats struct {
+	RatingGroup           string      `json:"rating_group"`
+	Sessions              int         `json:"sessions"`
+	Subscribers           int         `json:"subscribers"`
+	Updates               int         `json:"ccr_updates"`
+	UpdatesPerMinute      float64     `json:"ccr_updates_per_session_minute"`
+	ReportingReasons      []NameCount `json:"reporting_reasons"`
+	FinalUnitIndications  []NameCount `json:"final_unit_indications,omitempty"`
+	GrantedOctets         *float64    `json:"granted_octets_median,omitempty"`
+	GrantedTime           *float64    `json:"granted_time_median,omitempty"`
+	ValidityTime          *float64    `json:"validity_time_median,omitempty"`
+	UpdateIntervalSeconds *float64    `json:"update_interval_median_seconds,omitempty"`
+	FlaggedSessions       int         `json:"flagged_sessions"`
+}
+
+// QuotaFlow is a rating group of a session flagged for abnormal
+// re-authorization: "rate" above the rate threshold, "storm" for a burst
+// of CCR-Updates, with the likely cause: "small-grants" when the quota
+// is mostly reported exhausted, "validity-cadence" when the updates follow
+// the expiry of a short Validity-Time.
+type QuotaFlow struct {
+	Subscriber            string      `json:"subscriber,omitempty"`
+	SessionID             string      `json:"session_id"`
+	RatingGroup           string      `json:"rating_group"`
+	Updates               int         `json:"ccr_updates"`
+	DurationSeconds       float64     `json:"duration_seconds"`
+	UpdatesPerMinute      float64     `json:"ccr_updates_per_minute"`
+	MaxUpdatesPerMinute   int         `json:"max_ccr_updates_in_a_minute"`
+	ReportingReasons      []NameCount `json:"reporting_reasons"`
+	GrantedOctets         *float64    `json:"granted_octets_median,omitempty"`
+	ValidityTime          *float64    `json:"validity_time_median,omitempty"`
+	UpdateIntervalSeconds *float64    `json:"update_interval_median_seconds,omitempty"`
+	FinalUnitAction       string      `json:"final_unit_action,omitempty"`
+	Flags                 []string    `json:"flags"`
+}
+
+func newQuotaReport() (report, error) {
+	if quotaMaxRate <= 0 || quotaStorm <= 0 {
+		return nil, fmt.Errorf("the thresholds must be positive")
+	}
+	return &quotaReport{sessions: make(map[string]*quotaSession), groups: make(map[string]*quotaGroup)}, nil
+}
+
+func (r *quotaReport) add(mi *MessageInfo, req *MessageInfo) {
+	if mi.ApplicationID != gyApplicationID || mi.CommandCode != 272 {
+		return
+	}
+	sid := mi.str("Session-Id")
+	if sid == "" {
+		return
+	}
+	s := r.sessions[sid]
+	if s == nil {
+		s = &quotaSession{flows: make(map[string]*quotaFlow)}
+		r.sessions[sid] = s
+	}
+	if s.subscriber == "" {
+		if s.subscriber = mi.subscriberID(); s.subscriber == "" && req != nil {
+			s.subscriber = req.subscriberID()
+		}
+	}
+	requestType := avpUint(mi.AVPs, "CC-Request-Type")
+
+	for _, a := range avpAll(mi.AVPs, "Multiple-Services-Credit-Control") {
+		c := a.children()
+		m := newMSCC(c)
+		rg := "none"
+		if m.RatingGroup != nil {
+			rg = strconv.FormatUint(*m.RatingGroup, 10)
+		}
+		f := s.flows[rg]
+		if f == nil {
+			f = &quotaFlow{first: mi.Timestamp.Time, reasons: make(counter)}
+			s.flows[rg] = f
+		}
+		f.last = mi.Timestamp.Time
+		if mi.isRequest() {
+			if requestType == ccRequestUpdate {
+				f.updates = append(f.updates, mi.Timestamp.Time)
+			}
+			// Reporting-Reason is in the MSCC, or in each Used-Service-Unit.
+			reasons := avpAll(c, "Reporting-Reason")
+			for _, u := range avpAll(c, "Used-Service-Unit") {
+				reasons = append(reasons, avpAll(u.children(), "Reporting-Reason")...)
+			}
+			for _, rr := range reasons {
+				if v, ok := rr.uint(); ok {
+					f.reasons.inc(enumLabel(reportingReasons, v))
+				}
+			}
+			continue
+		}
+		if m.Granted != nil {
+			if m.Granted.TotalOctets > 0 || m.Granted.InputOctets > 0 || m.Granted.OutputOctets > 0 {
+				f.grantedOct = append(f.grantedOct, float64(m.Granted.TotalOctets+m.Granted.InputOctets+m.Granted.OutputOctets))
+			}
+			if m.Granted.Time > 0 {
+				f.grantedTime = append(f.grantedTime, float64(m.Granted.Time))
+			}
+		}
+		if m.ValidityTime > 0 {
+			f.validity = append(f.validity, float64(m.ValidityTime))
+		}
+		if m.FinalUnitAction != nil {
+			f.fui = enumLabel(finalUnitActions, *m.FinalUnitAction)
+		}
+	}
+	if !mi.isRequest() && requestType == ccRequestTermination {
+		r.close(sid, s)
+	}
+}
+
+func enumLabel(names map[uint64]string, v uint64) string {
+	if n, ok := names[v]; ok {
+		return n
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// close accounts the flows of an ended session.
+func (r *quotaReport) close(sid string, s *quotaSession) {
+	delete(r.sessions, sid)
+	for rg, f := range s.flows {
+		g := r.groups[rg]
+		if g == nil {
+			g = &quotaGroup{subscribers: make(map[string]bool), reasons: make(counter), fui: make(counter),
+				granted: newTDigest(), gtime: newTDigest(), vt: newTDigest(), intervals: newTDigest()}
+			r.groups[rg] = g
+		}
+		g.flows++
+		g.updates += len(f.updates)
+		g.minutes += f.last.Sub(f.first).Minutes()
+		if s.subscriber != "" {
+			g.subscribers[s.subscriber] = true
+		}
+		for n, c := range f.reasons {
+			g.reasons[n] += c
+		}
+		if f.fui != "" {
+			g.fui.inc(f.fui)
+		}
+		for _, v := range f.grantedOct {
+			g.granted.add(v)
+		}
+		for _, v := range f.grantedTime {
+			g.gtime.add(v)
+		}
+		for _, v := range f.validity {
+			g.vt.add(v)
+		}
+		for i := 1; i < len(f.updates); i++ {
+			g.intervals.add(f.updates[i].Sub(f.updates[i-1]).Seconds())
+		}
+		if q, ok := f.flag(s.subscriber, sid, rg); ok {
+			g.flagged++
+			r.flagged = append(r.flagged, q)
+		}
+	}
+}
+
+// flag returns the flow as flagged when its re-authorization rate is
+// abnormal. The rate is taken over at least a minute, so that the few
+// updates of a short session do not count as a high rate.
+func (f *quotaFlow) flag(sub, sid, rg string) (QuotaFlow, bool) {
+	n := len(f.updates)
+	if n == 0 {
+		return QuotaFlow{}, false
+	}
+	d := f.last.Sub(f.first)
+	rate := float64(n) / math.Max(d.Minutes(), 1)
+	burst := 0
+	for i, j := 0, 0; j < n; j++ {
+		for f.updates[j].Sub(f.updates[i]) >= time.Minute {
+			i++
+		}
+		burst = max(burst, j-i+1)
+	}
+	var flags []string
+	if rate > quotaMaxRate {
+		flags = append(flags, "rate")
+	}
+	if burst >= quotaStorm {
+		flags = append(flags, "storm")
+	}
+	if flags == nil {
+		return QuotaFlow{}, false
+	}
+	var intervals []float64
+	for i := 1; i < n; i++ {
+		intervals = append(intervals, f.updates[i].Sub(f.updates[i-1]).Seconds())
+	}
+	reported := 0
+	for _, c := range f.reasons {
+		reported += c
+	}
+	if reported > 0 && 2*(f.reasons["QUOTA_EXHAUSTED"]+f.reasons["THRESHOLD"]) > reported {
+		flags = append(flags, "small-grants")
+	}
+	iv, vt := median(intervals), median(f.validity)
+	if reported > 0 && 2*f.reasons["VALIDITY_TIME"] > reported ||
+		iv != nil && vt != nil && *iv <= *vt*1.1 && *iv >= *vt*0.9 {
+		flags = append(flags, "validity-cadence")
+	}
+	return QuotaFlow{
+		Subscriber:            sub,
+		SessionID:             sid,
+		RatingGroup:           rg,
+		Updates:               n,
+		DurationSeconds:       math.Round(d.Seconds()*1000) / 1000,
+		UpdatesPerMinute:      math.Round(rate*100) / 100,
+		MaxUpdatesPerMinute:   burst,
+		ReportingReasons:      f.reasons.top(0),
+		GrantedOctets:         median(f.grantedOct),
+		ValidityTime:          vt,
+		UpdateIntervalSeconds: iv,
+		FinalUnitAction:       f.fui,
+		Flags:                 flags,
+	}, true
+}
+
+// median returns the median of xs, or nil when empty; xs is sorted.
+func median(xs []float64) *float64 {
+	if len(xs) == 0 {
+		return nil
+	}
+	sort.Float64s(xs)
+	m := xs[len(xs)/2]
+	if len(xs)%2 == 0 {
+		m = (xs[len(xs)/2-1] + m) / 2
+	}
+	m = math.Round(m*1000) / 1000
+	return &m
+}
+
+// medianOf is median for a digest.
+func medianOf(t *tdigest) *float64 {
+	if t.total == 0 && len(t.buffer) == 0 {
+		return nil
+	}
+	v := math.Round(t.quantile(0.5)*1000) / 1000
+	return &v
+}
+
+func (r *quotaReport) write(w io.Writer) error {
+	// Sessions still open at the end of the capture count as they are.
+	for sid, s := range r.sessions {
+		r.close(sid, s)
+	}
+
+	groups := make([]QuotaGroupStats, 0, len(r.groups))
+	for rg, g := range r.groups {
+		s := QuotaGroupStats{
+			RatingGroup:           rg,
+			Sessions:              g.flows,
+			Subscribers:           len(g.subscribers),
+			Updates:               g.updates,
+			ReportingReasons:      g.reasons.top(0),
+			FinalUnitIndications:  g.fui.top(0),
+			GrantedOctets:         medianOf(g.granted),
+			GrantedTime:           medianOf(g.gtime),
+			ValidityTime:          medianOf(g.vt),
+			UpdateIntervalSeconds: medianOf(g.intervals),
+			FlaggedSessions:       g.flagged,
+		}
+		if g.minutes > 0 {
+			s.UpdatesPerMinute = math.Round(float64(g.updates)/g.minutes*100) / 100
+		}
+		groups = append(groups, s)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Updates != groups[j].Updates {
+			return groups[i].Updates > groups[j].Updates
+		}
+		return groups[i].RatingGroup < groups[j].RatingGroup
+	})
+
+	flagged := r.flagged
+	sort.Slice(flagged, func(i, j int) bool {
+		if flagged[i].UpdatesPerMinute != flagged[j].UpdatesPerMinute {
+			return flagged[i].UpdatesPerMinute > flagged[j].UpdatesPerMinute
+		}
+		return flagged[i].SessionID < flagged[j].SessionID
+	})
+	if reportTop > 0 && len(flagged) > reportTop {
+		flagged = flagged[:reportTop]
+	}
+	if flagged == nil {
+		flagged = []QuotaFlow{}
+	}
+	return writeJSON(w, struct {
+		Labels           map[string]string `json:"labels,omitempty"`
+		Warnings         []string          `json:"warnings,omitempty"`
+		MaxUpdatesPerMin float64           `json:"threshold_ccr_updates_per_minute"`
+		Storm            int               `json:"threshold_storm"`
+		RatingGroups     []QuotaGroupStats `json:"rating_groups"`
+		Flagged          []QuotaFlow       `json:"flagged"`
+		FlaggedTotal     int               `json:"flagged_total"`
+	}{runLabels, reportWarnings(), quotaMaxRate, quotaStorm, groups, flagged, len(r.flagged)})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// reportTop is the number of entries listed per breakdown in reports.
+var reportTop = 5
+
+// report aggregates messages over a whole capture and writes a summary.
+type report interface {
+	// add is called for every decoded message, in capture order. For
+	// answers, req is the matching request if it was seen, else nil.
+	add(mi *MessageInfo, req *MessageInfo)
+	// write prints the summary once the capture has been read.
+	write(w io.Writer) error
+}
+
+// reportCapture is the packet counts of a live capture, set before the
+// reports are written.
+var reportCapture *CaptureStats
+
+// reportWarnings warns that a report misses the messages of the packets a
+// live capture lost.
+func reportWarnings() []string {
+	if c := reportCapture; c != nil && c.dropped() > 0 {
+		return []string{"incomplete, the capture lost packets: " + c.summary()}
+	}
+	return nil
+}
+
+// reportFactories maps -report names to their constructors.
+var reportFactories = map[string]func() (report, error){
+	"associations":     newAssociationsReport,
+	"conversations":    newConversationReport,
+	"dra-audit":        newDRAAuditReport,
+	"duplicate-e2e":    newDuplicateE2EReport,
+	"gy-quota":         newQuotaReport,
+	"hop-latency":      newHopLatencyReport,
+	"overload":         newOverloadReport,
+	"realm-accounting": newRealmAccountingReport,
+	"resultcodes":      newResultCodeReport,
+	"server-initiated": newServerInitiatedReport,
+	"sizes":            newSizesReport,
+	"timeseries":       newTimeSeriesReport,
+	"topology":         newTopologyReport,
+	"values":           newValuesReport,
+}
+
+// reportNames returns the sorted names accepted by -report.
+func reportNames() []string {
+	names := make([]string, 0, len(reportFactories))
+	for n := range reportFactories {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newReports builds the reports named in a comma-separated list.
+func newReports(list string) ([]report, error) {
+	var reports []report
+	for _, n := range strings.Split(list, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		f, ok := reportFactories[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown report %q (available: %s)", n, strings.Join(reportNames(), ", "))
+		}
+		r, err := f()
+		if err != nil {
+			return nil, fmt.Errorf("report %s: %v", n, err)
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// writeJSON prints v as indented JSON, the same way messages are printed.
+func writeJSON(w io.Writer, v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// NameCount is one entry of a ranked breakdown.
+type NameCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// counter counts occurrences of names.
+type counter map[string]int
+
+func (c counter) inc(name string) {
+	if name == "" {
+		name = "unknown"
+	}
+	c[name]++
+}
+
+// top returns the n most frequent names, ties broken by name.
+func (c counter) top(n int) []NameCount {
+	out := make([]NameCount, 0, len(c))
+	for name, count := range c {
+		out = append(out, NameCount{Name: name, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// commandLabel returns the command name, or its code when it is unknown.
+func commandLabel(code uint32) string {
+	if name := commandCodeName(code); name != "" {
+		return name
+	}
+	return fmt.Sprintf("%d", code)
+}
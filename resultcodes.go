@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// resultCodeReport breaks down error answers by Result-Code and
+// Experimental-Result-Code, for post-incident analysis.
+type resultCodeReport struct {
+	codes map[ResultCode]*resultCodeStats
+}
+
+type resultCodeStats struct {
+	count       int
+	first, last time.Time
+	origins     counter // Origin-Host of the request
+	dests       counter // Origin-Host of the answer, i.e. the node returning the code
+	commands    counter
+	subscribers map[string]struct{}
+	frames      []int
+}
+
+// ResultCodeEntry is the breakdown of a single error code.
+type ResultCodeEntry struct {
+	ResultCode
+	Name             string      `json:"name,omitempty"`
+	Count            int         `json:"count"`
+	FirstSeen        Timestamp   `json:"first_seen"`
+	LastSeen         Timestamp   `json:"last_seen"`
+	Subscribers      int         `json:"subscribers"`
+	OriginHosts      []NameCount `json:"origin_hosts"`
+	DestinationHosts []NameCount `json:"destination_hosts"`
+	Commands         []NameCount `json:"commands"`
+	ExampleFrames    []int       `json:"example_frames"`
+}
+
+func newResultCodeReport() (report, error) {
+	return &resultCodeReport{codes: make(map[ResultCode]*resultCodeStats)}, nil
+}
+
+func (r *resultCodeReport) add(mi *MessageInfo, req *MessageInfo) {
+	if mi.isRequest() {
+		return
+	}
+	rc, ok := mi.resultCode()
+	if !ok || !rc.isError() {
+		return
+	}
+	s := r.codes[rc]
+	if s == nil {
+		s = &resultCodeStats{
+			first:       mi.Timestamp.Time,
+			origins:     counter{},
+			dests:       counter{},
+			commands:    counter{},
+			subscribers: map[string]struct{}{},
+		}
+		r.codes[rc] = s
+	}
+	s.count++
+	s.last = mi.Timestamp.Time
+
+	origin := mi.str("Destination-Host")
+	sub := mi.subscriberID()
+	if req != nil {
+		origin = req.str("Origin-Host")
+		if sub == "" {
+			sub = req.subscriberID()
+		}
+	}
+	s.origins.inc(origin)
+	s.dests.inc(mi.str("Origin-Host"))
+	s.commands.inc(commandLabel(mi.CommandCode))
+	if sub != "" {
+		s.subscribers[sub] = struct{}{}
+	}
+	if len(s.frames) < reportTop {
+		s.frames = append(s.frames, mi.Frame)
+	}
+}
+
+func (r *resultCodeReport) write(w io.Writer) error {
+	entries := make([]ResultCodeEntry, 0, len(r.codes))
+	for rc, s := range r.codes {
+		entries = append(entries, ResultCodeEntry{
+			ResultCode:       rc,
+			Name:             resultCodeName(rc),
+			Count:            s.count,
+			FirstSeen:        Timestamp{s.first},
+			LastSeen:         Timestamp{s.last},
+			Subscribers:      len(s.subscribers),
+			OriginHosts:      s.origins.top(reportTop),
+			DestinationHosts: s.dests.top(reportTop),
+			Commands:         s.commands.top(reportTop),
+			ExampleFrames:    s.frames,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Code < entries[j].Code
+	})
+	return writeJSON(w, struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Warnings    []string          `json:"warnings,omitempty"`
+		ResultCodes []ResultCodeEntry `json:"result_codes"`
+	}{runLabels, reportWarnings(), entries})
+}
+
+// resultCodeName returns the name of a result code (RFC 6733, RFC 4006,
+// 3GPP TS 29.272/29.212/29.229).
+func resultCodeName(rc ResultCode) string {
+	if rc.Experimental && rc.VendorID == 10415 {
+		switch rc.Code {
+		case 4181:
+			return "DIAMETER_AUTHENTICATION_DATA_UNAVAILABLE"
+		case 5001:
+			return "DIAMETER_ERROR_USER_UNKNOWN"
+		case 5002:
+			return "DIAMETER_ERROR_IDENTITIES_DONT_MATCH"
+		case 5003:
+			return "DIAMETER_ERROR_IDENTITY_NOT_REGISTERED"
+		case 5004:
+			return "DIAMETER_ERROR_ROAMING_NOT_ALLOWED"
+		case 5140:
+			return "DIAMETER_ERROR_INITIAL_PARAMETERS"
+		case 5143:
+			return "DIAMETER_ERROR_CONFLICTING_REQUEST"
+		case 5420:
+			return "DIAMETER_ERROR_UNKNOWN_EPS_SUBSCRIPTION"
+		case 5421:
+			return "DIAMETER_ERROR_RAT_NOT_ALLOWED"
+		case 5422:
+			return "DIAMETER_ERROR_EQUIPMENT_UNKNOWN"
+		case 5423:
+			return "DIAMETER_ERROR_UNKNOWN_SERVING_NODE"
+		default:
+			return ""
+		}
+	}
+	if rc.Experimental {
+		return ""
+	}
+	switch rc.Code {
+	case 2001:
+		return "DIAMETER_SUCCESS"
+	case 2002:
+		return "DIAMETER_LIMITED_SUCCESS"
+	case 3001:
+		return "DIAMETER_COMMAND_UNSUPPORTED"
+	case 3002:
+		return "DIAMETER_UNABLE_TO_DELIVER"
+	case 3003:
+		return "DIAMETER_REALM_NOT_SERVED"
+	case 3004:
+		return "DIAMETER_TOO_BUSY"
+	case 3005:
+		return "DIAMETER_LOOP_DETECTED"
+	case 3006:
+		return "DIAMETER_REDIRECT_INDICATION"
+	case 3007:
+		return "DIAMETER_APPLICATION_UNSUPPORTED"
+	case 3008:
+		return "DIAMETER_INVALID_HDR_BITS"
+	case 3009:
+		return "DIAMETER_INVALID_AVP_BITS"
+	case 3010:
+		return "DIAMETER_UNKNOWN_PEER"
+	case 4001:
+		return "DIAMETER_AUTHENTICATION_REJECTED"
+	case 4002:
+		return "DIAMETER_OUT_OF_SPACE"
+	case 4003:
+		return "ELECTION_LOST"
+	case 4010:
+		return "DIAMETER_END_USER_SERVICE_DENIED"
+	case 4011:
+		return "DIAMETER_CREDIT_CONTROL_NOT_APPLICABLE"
+	case 4012:
+		return "DIAMETER_CREDIT_LIMIT_REACHED"
+	case 5001:
+		return "DIAMETER_AVP_UNSUPPORTED"
+	case 5002:
+		return "DIAMETER_UNKNOWN_SESSION_ID"
+	case 5003:
+		return "DIAMETER_AUTHORIZATION_REJECTED"
+	case 5004:
+		return "DIAMETER_INVALID_AVP_VALUE"
+	case 5005:
+		return "DIAMETER_MISSING_AVP"
+	case 5006:
+		return "DIAMETER_RESOURCES_EXCEEDED"
+	case 5007:
+		return "DIAMETER_CONTRADICTING_AVPS"
+	case 5008:
+		return "DIAMETER_AVP_NOT_ALLOWED"
+	case 5009:
+		return "DIAMETER_AVP_OCCURS_TOO_MANY_TIMES"
+	case 5010:
+		return "DIAMETER_NO_COMMON_APPLICATION"
+	case 5011:
+		return "DIAMETER_UNSUPPORTED_VERSION"
+	case 5012:
+		return "DIAMETER_UNABLE_TO_COMPLY"
+	case 5013:
+		return "DIAMETER_INVALID_BIT_IN_HEADER"
+	case 5014:
+		return "DIAMETER_INVALID_AVP_LENGTH"
+	case 5015:
+		return "DIAMETER_INVALID_MESSAGE_LENGTH"
+	case 5016:
+		return "DIAMETER_INVALID_AVP_BIT_COMBO"
+	case 5017:
+		return "DIAMETER_NO_COMMON_SECURITY"
+	case 5030:
+		return "DIAMETER_USER_UNKNOWN"
+	case 5031:
+		return "DIAMETER_RATING_FAILED"
+	default:
+		return ""
+	}
+}
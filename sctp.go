@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// associations tracks the SCTP associations of the capture, when
+// -associations or the associations report is used.
+var associations *associationTracker
+
+// sctpPacket is what the association tracker needs from an SCTP packet.
+type sctpPacket struct {
+	src, dst     string
+	sport, dport uint16
+	vtag         uint32
+	init         *sctpInit // INIT or INIT ACK chunk
+	data         bool      // carries a DATA chunk
+	control      bool      // carries no Diameter message
+}
+
+// sctpInit is the Initiate Tag and the addresses announced by an endpoint
+// in its INIT or INIT ACK (RFC 4960, 3.3.2).
+type sctpInit struct {
+	ack   bool
+	tag   uint32
+	addrs []string
+}
+
+// sctpPacketOf returns the SCTP fields of packet, or nil if it is not SCTP.
+func sctpPacketOf(packet gopacket.Packet) *sctpPacket {
+	sc, ok := packet.Layer(layers.LayerTypeSCTP).(*layers.SCTP)
+	if !ok || packet.NetworkLayer() == nil {
+		return nil
+	}
+	src, dst := packet.NetworkLayer().NetworkFlow().Endpoints()
+	p := &sctpPacket{
+		src:   src.String(),
+		dst:   dst.String(),
+		sport: uint16(sc.SrcPort),
+		dport: uint16(sc.DstPort),
+		vtag:  sc.VerificationTag,
+		data:  packet.Layer(layers.LayerTypeSCTPData) != nil,
+	}
+	for _, t := range []gopacket.LayerType{layers.LayerTypeSCTPInit, layers.LayerTypeSCTPInitAck} {
+		in, ok := packet.Layer(t).(*layers.SCTPInit)
+		if !ok {
+			continue
+		}
+		p.init = &sctpInit{ack: t == layers.LayerTypeSCTPInitAck, tag: in.InitiateTag}
+		for _, param := range in.Parameters {
+			// IPv4 Address (5) and IPv6 Address (6) parameters.
+			if (param.Type == 5 && len(param.Value) == net.IPv4len) || (param.Type == 6 && len(param.Value) == net.IPv6len) {
+				p.init.addrs = append(p.init.addrs, net.IP(param.Value).String())
+			}
+		}
+	}
+	return p
+}
+
+// associationTracker groups SCTP packets into associations by their
+// verification tags, which stay the same whichever addresses of a
+// multi-homed endpoint a packet uses. Each endpoint chooses the tag of the
+// packets sent to it: from the INIT and INIT ACK when the capture has the
+// handshake, else learnt from the first packets of each direction.
+type associationTracker struct {
+	assocs []*SCTPAssociation
+	byTag  map[tagKey]*SCTPAssociation
+}
+
+type tagKey struct {
+	vtag         uint32
+	lport, hport uint16 // ports, lowest first
+}
+
+func newTagKey(vtag uint32, a, b uint16) tagKey {
+	return tagKey{vtag, min(a, b), max(a, b)}
+}
+
+// SCTPAssociation is one association: its two endpoints, the paths
+// (source and destination address pairs) that carried Diameter messages,
+// and the changes of path seen in each direction.
+type SCTPAssociation struct {
+	ID          int              `json:"id"`
+	Endpoints   [2]SCTPEndpoint  `json:"endpoints"`
+	Handshake   bool             `json:"handshake"` // INIT and INIT ACK captured
+	FirstSeen   Timestamp        `json:"first_seen"`
+	LastSeen    Timestamp        `json:"last_seen"`
+	Messages    int              `json:"messages"`
+	Paths       []*SCTPPath      `json:"paths"`
+	Switchovers []PathSwitchover `json:"switchovers"`
+	current     [2]*SCTPPath     // last path used by each endpoint
+}
+
+// SCTPEndpoint is one side of an association. Tag is the verification tag
+// of the packets sent to it, 0 until known.
+type SCTPEndpoint struct {
+	Addresses []string `json:"addresses"`
+	Port      uint16   `json:"port"`
+	Tag       uint32   `json:"tag"`
+}
+
+// SCTPPath is a source and destination address pair of an association.
+type SCTPPath struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Messages    int       `json:"messages"`
+	FirstSeen   Timestamp `json:"first_seen"`
+	LastSeen    Timestamp `json:"last_seen"`
+}
+
+// String names the path as SOURCE-DESTINATION.
+func (p *SCTPPath) String() string {
+	return p.Source + "-" + p.Destination
+}
+
+// PathSwitchover is an endpoint sending on another path than before, as
+// when its primary path fails (RFC 4960, 6.4).
+type PathSwitchover struct {
+	Frame     int       `json:"frame"`
+	Timestamp Timestamp `json:"timestamp"`
+	Endpoint  int       `json:"endpoint"` // index in Endpoints of the sender
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+}
+
+// AssociationRef attributes a message to an association and path.
+type AssociationRef struct {
+	ID   int    `json:"id"`
+	Path string `json:"path"`
+}
+
+func newAssociationTracker() *associationTracker {
+	return &associationTracker{byTag: make(map[tagKey]*SCTPAssociation)}
+}
+
+// observe accounts for an SCTP packet and returns the association and
+// path it belongs to.
+func (t *associationTracker) observe(p *sctpPacket, frame int, ts time.Time) *AssociationRef {
+	a, to := t.lookup(p, ts)
+	from := 1 - to
+	a.Endpoints[from].addAddress(p.src)
+	a.Endpoints[to].addAddress(p.dst)
+	if ts.After(a.LastSeen.Time) {
+		a.LastSeen = Timestamp{ts}
+	}
+	if !p.data {
+		return &AssociationRef{ID: a.ID}
+	}
+
+	path := a.path(p.src, p.dst, ts)
+	if !p.control {
+		a.Messages++
+		path.Messages++
+	}
+	if cur := a.current[from]; cur != nil && cur != path {
+		a.Switchovers = append(a.Switchovers, PathSwitchover{Frame: frame, Timestamp: Timestamp{ts}, Endpoint: from, From: cur.String(), To: path.String()})
+	}
+	a.current[from] = path
+	return &AssociationRef{ID: a.ID, Path: path.String()}
+}
+
+// lookup returns the association of p and the index of the endpoint p is
+// sent to, creating the association if needed.
+func (t *associationTracker) lookup(p *sctpPacket, ts time.Time) (*SCTPAssociation, int) {
+	if p.init != nil && !p.init.ack {
+		// INIT, sent with tag 0: the sender announces its own tag.
+		k := newTagKey(p.init.tag, p.sport, p.dport)
+		if a := t.byTag[k]; a != nil {
+			return a, 1 // retransmission
+		}
+		a := t.add(ts)
+		a.Handshake = true
+		a.Endpoints[0] = SCTPEndpoint{Port: p.sport, Tag: p.init.tag, Addresses: p.init.addrs}
+		a.Endpoints[1] = SCTPEndpoint{Port: p.dport}
+		t.byTag[k] = a
+		return a, 1
+	}
+
+	if a := t.byTag[newTagKey(p.vtag, p.sport, p.dport)]; a != nil {
+		to := 0
+		if a.Endpoints[1].Tag == p.vtag && a.Endpoints[1].Port == p.dport {
+			to = 1
+		}
+		if p.init != nil && a.Endpoints[1-to].Tag == 0 {
+			// INIT ACK: the answering endpoint announces its tag.
+			a.Endpoints[1-to].Tag = p.init.tag
+			for _, addr := range p.init.addrs {
+				a.Endpoints[1-to].addAddress(addr)
+			}
+			t.byTag[newTagKey(p.init.tag, p.sport, p.dport)] = a
+		}
+		return a, to
+	}
+
+	// Without the handshake, the first packet of the other direction
+	// gives the missing tag: it comes from an address the association's
+	// packets were sent to, on the same ports.
+	for _, a := range t.assocs {
+		for s := 0; s < 2; s++ {
+			e, peer := &a.Endpoints[s], &a.Endpoints[1-s]
+			if e.Tag != 0 || peer.Tag == 0 || e.Port != p.dport || peer.Port != p.sport {
+				continue
+			}
+			if slices.Contains(peer.Addresses, p.src) || slices.Contains(e.Addresses, p.dst) {
+				e.Tag = p.vtag
+				t.byTag[newTagKey(p.vtag, p.sport, p.dport)] = a
+				return a, s
+			}
+		}
+	}
+
+	a := t.add(ts)
+	a.Endpoints[0] = SCTPEndpoint{Port: p.sport}
+	a.Endpoints[1] = SCTPEndpoint{Port: p.dport, Tag: p.vtag}
+	t.byTag[newTagKey(p.vtag, p.sport, p.dport)] = a
+	return a, 1
+}
+
+func (t *associationTracker) add(ts time.Time) *SCTPAssociation {
+	a := &SCTPAssociation{ID: len(t.assocs) + 1, FirstSeen: Timestamp{ts}, LastSeen: Timestamp{ts}, Paths: []*SCTPPath{}, Switchovers: []PathSwitchover{}}
+	t.assocs = append(t.assocs, a)
+	return a
+}
+
+func (e *SCTPEndpoint) addAddress(addr string) {
+	if !slices.Contains(e.Addresses, addr) {
+		e.Addresses = append(e.Addresses, addr)
+	}
+}
+
+func (a *SCTPAssociation) path(src, dst string, ts time.Time) *SCTPPath {
+	for _, p := range a.Paths {
+		if p.Source == src && p.Destination == dst {
+			p.LastSeen = Timestamp{ts}
+			return p
+		}
+	}
+	p := &SCTPPath{Source: src, Destination: dst, FirstSeen: Timestamp{ts}, LastSeen: Timestamp{ts}}
+	a.Paths = append(a.Paths, p)
+	return p
+}
+
+// associationsReport lists the SCTP associations of the capture.
+type associationsReport struct {
+	t *associationTracker
+}
+
+func newAssociationsReport() (report, error) {
+	if associations == nil {
+		associations = newAssociationTracker()
+	}
+	return &associationsReport{t: associations}, nil
+}
+
+// add does nothing: the tracker sees every SCTP packet, not only the
+// Diameter messages.
+func (r *associationsReport) add(mi *MessageInfo, req *MessageInfo) {}
+
+func (r *associationsReport) write(w io.Writer) error {
+	for _, a := range r.t.assocs {
+		for i := range a.Endpoints {
+			sort.Strings(a.Endpoints[i].Addresses)
+		}
+	}
+	return writeJSON(w, struct {
+		Labels       map[string]string  `json:"labels,omitempty"`
+		Warnings     []string           `json:"warnings,omitempty"`
+		Associations []*SCTPAssociation `json:"associations"`
+	}{runLabels, reportWarnings(), r.t.assocs})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exit codes, so that a service manager can tell a configuration to fix
+// from a failure worth a restart.
+const (
+	exitOK      = 0
+	exitRuntime = 1  // writing the output failed
+	exitUsage   = 2  // invalid command line, as the flag package
+	exitInput   = 66 // the input cannot be opened or read (EX_NOINPUT)
+	exitConfig  = 78 // invalid config file, list or dictionary (EX_CONFIG)
+)
+
+// fatal logs v and exits with code.
+func fatal(code int, v ...interface{}) {
+	log.Println(v...)
+	os.Exit(code)
+}
+
+// failed logs v and returns code, for the errors ending the run once
+// it has deferred cleanups, which os.Exit would skip.
+func failed(code int, v ...interface{}) int {
+	log.Println(v...)
+	return code
+}
+
+// exitError is an error ending the run with an exit code other than
+// exitInput, such as a dictionary failing to load when first needed.
+type exitError struct {
+	code int
+	msg  string
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.msg + " " + e.err.Error()
+}
+
+// runError logs the error that ended the packet loop and returns the exit
+// code of the run: that of an exitError, exitInput for read errors.
+func runError(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return failed(e.code, e.msg, e.err)
+	}
+	return failed(exitInput, "read error:", err)
+}
+
+// serviceMode reports readiness, reloads and shutdown to systemd.
+var serviceMode bool
+
+// sdNotify sends state to the service manager (sd_notify(3)) in service
+// mode, when started with a NOTIFY_SOCKET.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if !serviceMode || addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Println("sd_notify error:", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Println("sd_notify error:", err)
+	}
+}
+
+// watchdog pings the service manager at half the WatchdogSec interval
+// while h is healthy and the packet loop moves, so that a stalled parser
+// gets restarted.
+func watchdog(h *health) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if !serviceMode || err != nil || usec <= 0 {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond
+	go func() {
+		for range time.Tick(interval / 2) {
+			if ok, _ := h.status(); ok && h.moving(interval) {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// health tracks how far behind the capture the parser is, for /healthz.
+type health struct {
+	mu       sync.Mutex
+	live     bool
+	maxLag   time.Duration
+	started  time.Time
+	messages uint64
+	lag      time.Duration // handling time minus capture time, last message
+	last     time.Time     // handling time of the last message
+	backlog  SinkBacklog
+	capture  func() CaptureStats // of a live capture
+
+	read        func() int64 // packets read from the input
+	packetsDone int64        // packets done with by the packet loop
+	moved       time.Time    // when the last of them was done
+}
+
+// HealthStatus is the /healthz response.
+type HealthStatus struct {
+	Status          string        `json:"status"`
+	UptimeSeconds   float64       `json:"uptime_seconds"`
+	Messages        uint64        `json:"messages"`
+	InputLagSeconds float64       `json:"input_lag_seconds"`
+	LastMessageAge  float64       `json:"last_message_age_seconds,omitempty"`
+	SinkBacklog     SinkBacklog   `json:"sink_backlog"`
+	Capture         *CaptureStats `json:"capture,omitempty"`
+}
+
+// SinkBacklog counts the data buffered for sinks and not yet sent.
+type SinkBacklog struct {
+	OTLPSpans int `json:"otlp_spans"`
+	Records   int `json:"records"`         // of -out kafka destinations
+	Dropped   int `json:"records_dropped"` // by them, their queue full or the brokers failing
+}
+
+func newHealth(live bool, maxLag time.Duration) *health {
+	return &health{live: live, maxLag: maxLag, started: time.Now()}
+}
+
+// observe records a handled message and the data still to be exported.
+func (h *health) observe(mi *MessageInfo, backlog SinkBacklog) {
+	now := time.Now()
+	h.mu.Lock()
+	h.messages++
+	h.lag = now.Sub(mi.Timestamp.Time)
+	h.last = now
+	h.backlog = backlog
+	h.mu.Unlock()
+}
+
+// setInput sets the count of packets read from the input, against which
+// the progress of the packet loop is measured.
+func (h *health) setInput(read func() int64) {
+	h.mu.Lock()
+	h.read, h.moved = read, time.Now()
+	h.mu.Unlock()
+}
+
+// done records a packet the packet loop is done with, whether or not it
+// carried a message.
+func (h *health) done() {
+	h.mu.Lock()
+	h.packetsDone++
+	h.moved = time.Now()
+	h.mu.Unlock()
+}
+
+// moving reports whether the packet loop keeps up: it is waiting for
+// input, or was last done with a packet within the given time. A loop
+// blocked on a message or a sink holds packets read and not done with,
+// and stops moving even though the lag of the last message looks fine.
+func (h *health) moving(within time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.read == nil || h.packetsDone >= h.read() || time.Since(h.moved) <= within
+}
+
+// setCapture adds the packet counts of a live capture to the status.
+func (h *health) setCapture(counts func() CaptureStats) {
+	h.mu.Lock()
+	h.capture = counts
+	h.mu.Unlock()
+}
+
+// status reports whether the parser keeps up with a live capture: the
+// input lag stays within maxLag. Capture files are always healthy.
+func (h *health) status() (bool, HealthStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	s := HealthStatus{
+		Status:        "ok",
+		UptimeSeconds: now.Sub(h.started).Seconds(),
+		Messages:      h.messages,
+		SinkBacklog:   h.backlog,
+	}
+	if h.capture != nil {
+		c := h.capture()
+		s.Capture = &c
+	}
+	if h.messages > 0 {
+		s.InputLagSeconds = h.lag.Seconds()
+		s.LastMessageAge = now.Sub(h.last).Seconds()
+	}
+	ok := !h.live || h.maxLag <= 0 || h.lag <= h.maxLag
+	if !ok {
+		s.Status = "lagging"
+	}
+	return ok, s
+}
+
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ok, s := h.status()
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+// serve listens on addr and serves /healthz in the background.
+func (h *health) serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Println("health endpoint error:", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordFormats are the formats of -format and of the -out prefixes:
+// indented JSON records, one compact record per line (ndjson), the tshark
+// ek layout, or a summary line per message for a console.
+var recordFormats = []string{"json", "ndjson", "ek", "summary"}
+
+// recordWriter writes the records of messages to one destination.
+type recordWriter interface {
+	write(mi *MessageInfo, req *MessageInfo) error
+	backlog() int // records buffered, not yet sent
+	dropped() int // records not sent, the destination not keeping up
+	close() error
+}
+
+// recordSink is an -out destination with the -out-filter queries its
+// messages must all match.
+type recordSink struct {
+	spec    string
+	dest    string
+	format  string
+	queries []sinkQuery
+	w       recordWriter
+	records int // written
+}
+
+// sinkQuery is an -out-filter query, AVP ~ REGEXP as for grep, where the
+// AVP may also be "command" (ULR, ULA or the code) or "application" (ID
+// or name).
+type sinkQuery struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// parseSink reads an -out specification: stdout (or -), a file, each
+// optionally prefixed by a record format and a colon, or kafka:BROKERS/TOPIC
+// with BROKERS a comma-separated list of host:port. Without a prefix,
+// records are written in the -format.
+func parseSink(spec, defaultFormat string) (*recordSink, error) {
+	s := &recordSink{spec: spec, dest: spec, format: defaultFormat}
+	if prefix, rest, ok := strings.Cut(spec, ":"); ok {
+		for _, f := range append([]string{"kafka"}, recordFormats...) {
+			if prefix == f {
+				s.format, s.dest = f, rest
+			}
+		}
+	}
+	if s.dest == "" {
+		return nil, fmt.Errorf("-out %s: no destination", spec)
+	}
+	if brokers, topic, ok := strings.Cut(s.dest, "/"); s.format == "kafka" && (!ok || brokers == "" || topic == "") {
+		return nil, fmt.Errorf("-out %s: kafka destinations are kafka:HOST:PORT[,HOST:PORT...]/TOPIC", spec)
+	}
+	return s, nil
+}
+
+// destination identifies where the sink writes, whatever its format.
+func (s *recordSink) destination() string {
+	switch {
+	case s.format == "kafka":
+		return "kafka:" + s.dest
+	case s.dest == "stdout" || s.dest == "-":
+		return "stdout"
+	}
+	return filepath.Clean(s.dest)
+}
+
+// open creates the destination of the sink.
+func (s *recordSink) open() error {
+	if s.format == "kafka" {
+		brokers, topic, _ := strings.Cut(s.dest, "/")
+		s.w = newKafkaWriter(strings.Split(brokers, ","), topic)
+		return nil
+	}
+	if s.dest == "stdout" || s.dest == "-" {
+		s.w = &streamWriter{format: s.format, out: os.Stdout}
+		return nil
+	}
+	f, err := os.Create(s.dest)
+	if err != nil {
+		return err
+	}
+	w := &streamWriter{format: s.format, out: f, f: f, bw: bufio.NewWriterSize(f, 1<<16)}
+	w.ticker = startFlushTicker(time.Second, func() {
+		w.mu.Lock()
+		w.bw.Flush()
+		w.mu.Unlock()
+	})
+	s.w = w
+	return nil
+}
+
+// addQuery adds an -out-filter query.
+func (s *recordSink) addQuery(q string) error {
+	name, re, err := parseGrepQuery(q)
+	if err != nil {
+		return err
+	}
+	s.queries = append(s.queries, sinkQuery{name, re})
+	return nil
+}
+
+// selects reports whether a message matches every query of the sink. The
+// AVPs of the request of an answer are searched too, so that a query on
+// the IMSI also selects the answers, which do not carry it.
+func (s *recordSink) selects(mi *MessageInfo, req *MessageInfo) bool {
+	for _, q := range s.queries {
+		if !q.matches(mi) && (req == nil || !q.matches(req)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q sinkQuery) matches(mi *MessageInfo) bool {
+	switch q.name {
+	case "command":
+		return q.re.MatchString(shortCommandName(mi.CommandCode, mi.isRequest())) ||
+			q.re.MatchString(strconv.FormatUint(uint64(mi.CommandCode), 10))
+	case "application":
+		return q.re.MatchString(strconv.FormatUint(uint64(mi.ApplicationID), 10)) ||
+			q.re.MatchString(mi.ApplicationName)
+	}
+	return q.matchAVPs(mi.ApplicationID, mi.AVPs)
+}
+
+// matchAVPs matches the values of the AVPs at any depth, as the values
+// report labels them, and enumerated values by name.
+func (q sinkQuery) matchAVPs(appID uint32, avps []AVPInfo) bool {
+	for i := range avps {
+		a := &avps[i]
+		if g, ok := a.Data.(GroupedData); ok {
+			if q.matchAVPs(appID, g.AVPs) {
+				return true
+			}
+			continue
+		}
+		if a.Name != q.name && strconv.FormatUint(uint64(a.Code), 10) != q.name {
+			continue
+		}
+		if q.re.MatchString(valueLabel(a.Data)) {
+			return true
+		}
+		if name := valueName(appID, a); name != "" && q.re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRecordSinks parses the -out destinations, standard output when none
+// is given, and attaches to them the -out-filter queries, given as
+// SINK=QUERY where SINK is the -out value or its destination.
+func newRecordSinks(outs, filters []string, defaultFormat string) (recordSinks, error) {
+	if len(outs) == 0 {
+		outs = []string{"stdout"}
+	}
+	var ss recordSinks
+	seen := make(map[string]string)
+	for _, o := range outs {
+		s, err := parseSink(o, defaultFormat)
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := seen[s.destination()]; ok {
+			return nil, fmt.Errorf("-out %s: same destination as -out %s", o, prev)
+		}
+		seen[s.destination()] = o
+		ss = append(ss, s)
+	}
+	for _, f := range filters {
+		name, q, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("-out-filter %s: expected SINK=QUERY", f)
+		}
+		found := false
+		for _, s := range ss {
+			if name == s.spec || name == s.dest {
+				if err := s.addQuery(q); err != nil {
+					return nil, fmt.Errorf("-out-filter %s: %v", f, err)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("-out-filter %s: no -out %s", f, name)
+		}
+	}
+	return ss, nil
+}
+
+// open creates the destinations of the sinks.
+func (ss recordSinks) open() error {
+	for _, s := range ss {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formats reports whether a sink writes records in format.
+func (ss recordSinks) formats(format string) bool {
+	for _, s := range ss {
+		if s.format == format {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSinks are the -out destinations of a run.
+type recordSinks []*recordSink
+
+// write sends a message to the sinks selecting it; the first error is
+// returned after every sink had the message.
+func (ss recordSinks) write(mi *MessageInfo, req *MessageInfo) error {
+	var first error
+	for _, s := range ss {
+		if !s.selects(mi, req) {
+			continue
+		}
+		err := s.w.write(mi, req)
+		if err == nil {
+			s.records++
+		} else if first == nil {
+			first = fmt.Errorf("%s: %v", s.spec, err)
+		}
+	}
+	return first
+}
+
+func (ss recordSinks) backlog() int {
+	n := 0
+	for _, s := range ss {
+		n += s.w.backlog()
+	}
+	return n
+}
+
+func (ss recordSinks) dropped() int {
+	n := 0
+	for _, s := range ss {
+		n += s.w.dropped()
+	}
+	return n
+}
+
+func (ss recordSinks) close() error {
+	var first error
+	for _, s := range ss {
+		if err := s.w.close(); err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", s.spec, err)
+		}
+	}
+	return first
+}
+
+// streamWriter writes records to standard output or a file. File output is
+// buffered, and flushed every second for readers following it; an error
+// flushing is kept by the buffer and returned by the next write.
+type streamWriter struct {
+	format string
+	out    io.Writer
+	f      *os.File // nil for standard output
+
+	mu     sync.Mutex // of bw, shared with the ticker
+	bw     *bufio.Writer
+	ticker *flushTicker
+}
+
+func (s *streamWriter) write(mi *MessageInfo, req *MessageInfo) error {
+	if s.bw == nil {
+		return writeRecord(s.out, s.format, mi, req)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeRecord(s.bw, s.format, mi, req)
+}
+
+func (s *streamWriter) backlog() int {
+	return 0
+}
+
+func (s *streamWriter) dropped() int {
+	return 0
+}
+
+func (s *streamWriter) close() error {
+	if s.f == nil {
+		return nil
+	}
+	s.ticker.close()
+	err := s.bw.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flushTicker flushes a writer every interval from a goroutine of its own,
+// so that what is buffered goes out while no message arrives to write.
+type flushTicker struct {
+	stop, stopped chan struct{}
+}
+
+func startFlushTicker(interval time.Duration, flush func()) *flushTicker {
+	t := &flushTicker{stop: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(t.stopped)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				flush()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// close stops the ticker, waiting for a flush under way.
+func (t *flushTicker) close() {
+	close(t.stop)
+	<-t.stopped
+}
+
+// writeRecord writes the record of a message in one of the recordFormats.
+func writeRecord(w io.Writer, format string, mi *MessageInfo, req *MessageInfo) error {
+	switch format {
+	case "ek":
+		return writeEK(w, mi, req)
+	case "summary":
+		_, err := fmt.Fprintln(w, summaryLine(mi, req))
+		return err
+	case "ndjson":
+		out, err := json.Marshal(mi.record())
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	}
+	out, err := json.MarshalIndent(mi.record(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
+
+// summaryLine is a message on one line: frame, time, command, origin and
+// destination hosts, then for answers the result and the answer time.
+func summaryLine(mi *MessageInfo, req *MessageInfo) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\t%s\t%s\t%s -> %s", mi.Frame, formatTime(mi.Timestamp.Time),
+		shortCommandName(mi.CommandCode, mi.isRequest()), or(mi.str("Origin-Host"), "-"), or(mi.str("Destination-Host"), "-"))
+	if mi.isRequest() {
+		if sub := mi.subscriberID(); sub != "" {
+			fmt.Fprintf(&b, "\t%s", sub)
+		}
+		return b.String()
+	}
+	if rc, ok := mi.resultCode(); ok {
+		fmt.Fprintf(&b, "\t%s", or(resultCodeName(rc), strconv.FormatUint(uint64(rc.Code), 10)))
+	}
+	if req != nil {
+		fmt.Fprintf(&b, "\t%.3fms", float64(mi.Timestamp.Sub(req.Timestamp.Time))/float64(time.Millisecond))
+	}
+	return b.String()
+}
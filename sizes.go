@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// sizeThreshold is the message length (bytes) above which the sizes
+// report lists a message as an outlier. The default leaves room for the
+// IP and SCTP headers in a 1500-byte MTU.
+var sizeThreshold = 1400
+
+// sizesReport gives the distribution of message lengths and AVP counts per
+// command and direction, and the largest messages above sizeThreshold:
+// oversized answers such as a ULA with a large Subscription-Data get
+// fragmented or exceed the peer's limits.
+type sizesReport struct {
+	threshold int
+	commands  map[commandKey]*commandSizes
+}
+
+type commandKey struct {
+	code    uint32
+	request bool
+}
+
+type commandSizes struct {
+	count, over      int
+	sizes, avps      *tdigest
+	minSize, maxSize uint32
+	minAVPs, maxAVPs int
+	largest          []SizeOutlier // largest first, at most reportTop if set
+}
+
+// SizeStats is the distribution of the messages of one command and
+// direction.
+type SizeStats struct {
+	CommandCode     uint32        `json:"command_code"`
+	Command         string        `json:"command"`
+	Request         bool          `json:"request"`
+	Count           int           `json:"count"`
+	Size            Distribution  `json:"size"`
+	AVPs            Distribution  `json:"avps"`
+	OverThreshold   int           `json:"over_threshold"`
+	LargestOutliers []SizeOutlier `json:"largest_outliers,omitempty"`
+}
+
+// Distribution summarizes a set of values; percentiles are estimated.
+type Distribution struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// SizeOutlier is a message longer than the threshold.
+type SizeOutlier struct {
+	Frame      int       `json:"frame"`
+	Timestamp  Timestamp `json:"timestamp"`
+	Size       uint32    `json:"size"`
+	AVPs       int       `json:"avps"`
+	Subscriber string    `json:"subscriber,omitempty"`
+}
+
+func newSizesReport() (report, error) {
+	if sizeThreshold < 0 {
+		return nil, fmt.Errorf("threshold must not be negative, got %d", sizeThreshold)
+	}
+	return &sizesReport{threshold: sizeThreshold, commands: make(map[commandKey]*commandSizes)}, nil
+}
+
+func (r *sizesReport) add(mi *MessageInfo, req *MessageInfo) {
+	k := commandKey{mi.CommandCode, mi.isRequest()}
+	s := r.commands[k]
+	if s == nil {
+		s = &commandSizes{sizes: newTDigest(), avps: newTDigest(), minSize: math.MaxUint32, minAVPs: math.MaxInt}
+		r.commands[k] = s
+	}
+	size, n := mi.MessageLength, countAVPs(mi.AVPs)
+	s.count++
+	s.sizes.add(float64(size))
+	s.avps.add(float64(n))
+	s.minSize, s.maxSize = min(s.minSize, size), max(s.maxSize, size)
+	s.minAVPs, s.maxAVPs = min(s.minAVPs, n), max(s.maxAVPs, n)
+
+	if r.threshold == 0 || int(size) <= r.threshold {
+		return
+	}
+	s.over++
+	if reportTop > 0 && len(s.largest) == reportTop && size <= s.largest[len(s.largest)-1].Size {
+		return
+	}
+	sub := mi.subscriberID()
+	if sub == "" && req != nil {
+		sub = req.subscriberID()
+	}
+	o := SizeOutlier{Frame: mi.Frame, Timestamp: mi.Timestamp, Size: size, AVPs: n, Subscriber: sub}
+	i := sort.Search(len(s.largest), func(i int) bool { return s.largest[i].Size < size })
+	s.largest = append(s.largest, SizeOutlier{})
+	copy(s.largest[i+1:], s.largest[i:])
+	s.largest[i] = o
+	if reportTop > 0 && len(s.largest) > reportTop {
+		s.largest = s.largest[:reportTop]
+	}
+}
+
+// countAVPs counts avps and their members at any depth, including the
+// AVPs left out by the expansion limits.
+func countAVPs(avps []AVPInfo) int {
+	n := 0
+	for _, a := range avps {
+		switch d := a.Data.(type) {
+		case GroupedData:
+			n += 1 + countAVPs(d.AVPs)
+		case Truncated:
+			n += d.Omitted
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+func (r *sizesReport) write(w io.Writer) error {
+	stats := make([]SizeStats, 0, len(r.commands))
+	for k, s := range r.commands {
+		stats = append(stats, SizeStats{
+			CommandCode:     k.code,
+			Command:         shortCommandName(k.code, k.request),
+			Request:         k.request,
+			Count:           s.count,
+			Size:            distribution(s.sizes, float64(s.minSize), float64(s.maxSize)),
+			AVPs:            distribution(s.avps, float64(s.minAVPs), float64(s.maxAVPs)),
+			OverThreshold:   s.over,
+			LargestOutliers: s.largest,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.CommandCode != b.CommandCode {
+			return a.CommandCode < b.CommandCode
+		}
+		return a.Request && !b.Request
+	})
+	return writeJSON(w, struct {
+		Labels    map[string]string `json:"labels,omitempty"`
+		Warnings  []string          `json:"warnings,omitempty"`
+		Threshold int               `json:"threshold"`
+		Commands  []SizeStats       `json:"commands"`
+	}{runLabels, reportWarnings(), r.threshold, stats})
+}
+
+func distribution(t *tdigest, lo, hi float64) Distribution {
+	return Distribution{
+		Min: lo,
+		P50: math.Round(t.quantile(0.50)),
+		P90: math.Round(t.quantile(0.90)),
+		P99: math.Round(t.quantile(0.99)),
+		Max: hi,
+	}
+}
+
+// shortCommandName returns the abbreviation of a request or answer, e.g.
+// ULA, from the command name, else the command label.
+func shortCommandName(code uint32, request bool) string {
+	name := commandCodeName(code)
+	open, end := strings.LastIndexByte(name, '('), strings.LastIndexByte(name, ')')
+	if open < 0 || end < open {
+		return commandLabel(code)
+	}
+	req, ans, ok := strings.Cut(name[open+1:end], "/")
+	if !ok {
+		return commandLabel(code)
+	}
+	if request {
+		return req
+	}
+	return ans
+}
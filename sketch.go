@@ -0,0 +1,175 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// The metrics of a long-running capture must not grow with the traffic:
+// distinct counts use a HyperLogLog and latency percentiles a t-digest,
+// both of fixed size.
+
+// hllPrecision is the number of index bits of the HyperLogLog: 2^14
+// one-byte registers, a standard error of about 0.8%.
+const hllPrecision = 14
+
+// hyperLogLog estimates the number of distinct strings added (Flajolet et
+// al., with the small-range correction of Heule et al.).
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+func (h *hyperLogLog) add(s string) {
+	x := hash64(s)
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// count returns the estimated number of distinct strings.
+func (h *hyperLogLog) count() uint64 {
+	const m = float64(len(h.registers))
+	var sum float64
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros)) // linear counting
+	}
+	return uint64(est + 0.5)
+}
+
+// hash64 is FNV-1a finished with the MurmurHash3 mixer, so that all bits
+// of the result depend on the whole input.
+func hash64(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// tdigestCompression sets the accuracy of a t-digest, best at the extreme
+// quantiles, and bounds its size: a few hundred centroids whatever the
+// number of values.
+const tdigestCompression = 100
+
+// tdigest estimates quantiles of a stream of values (Dunning, merging
+// variant): values are buffered, then merged into centroids whose weight
+// is limited by their quantile.
+type tdigest struct {
+	centroids []centroid
+	buffer    []centroid
+	total     float64
+	min, max  float64
+}
+
+type centroid struct {
+	mean, weight float64
+}
+
+func newTDigest() *tdigest {
+	return &tdigest{buffer: make([]centroid, 0, 5*tdigestCompression)}
+}
+
+func (t *tdigest) add(x float64) {
+	if t.total == 0 && len(t.buffer) == 0 {
+		t.min, t.max = x, x
+	}
+	t.min, t.max = math.Min(t.min, x), math.Max(t.max, x)
+	t.buffer = append(t.buffer, centroid{x, 1})
+	if len(t.buffer) == cap(t.buffer) {
+		t.compress()
+	}
+}
+
+// compress merges the buffered values into the centroids.
+func (t *tdigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	var total float64
+	for _, c := range all {
+		total += c.weight
+	}
+
+	merged := make([]centroid, 0, len(t.centroids)+1)
+	cur := all[0]
+	var before float64 // weight of the centroids before cur
+	for _, c := range all[1:] {
+		w := cur.weight + c.weight
+		q := (before + w/2) / total
+		if w <= 4*total*q*(1-q)/tdigestCompression {
+			cur.mean += (c.mean - cur.mean) * c.weight / w
+			cur.weight = w
+			continue
+		}
+		merged = append(merged, cur)
+		before += cur.weight
+		cur = c
+	}
+	t.centroids = append(merged, cur)
+	t.total = total
+	t.buffer = t.buffer[:0]
+}
+
+// quantile returns the estimated value at q (0 to 1), or 0 when empty.
+func (t *tdigest) quantile(q float64) float64 {
+	t.compress()
+	n := len(t.centroids)
+	switch {
+	case n == 0:
+		return 0
+	case n == 1 || q <= 0:
+		if q >= 1 {
+			return t.max
+		}
+		return t.min
+	case q >= 1:
+		return t.max
+	}
+	// Each centroid is centered on its mean: interpolate between the
+	// centers around the target rank, and with min or max at the ends.
+	target := q * t.total
+	first := t.centroids[0]
+	if target < first.weight/2 {
+		return t.min + (first.mean-t.min)*target/(first.weight/2)
+	}
+	cum := first.weight / 2
+	for i := 0; i < n-1; i++ {
+		a, b := t.centroids[i], t.centroids[i+1]
+		step := (a.weight + b.weight) / 2
+		if target < cum+step {
+			return a.mean + (b.mean-a.mean)*(target-cum)/step
+		}
+		cum += step
+	}
+	last := t.centroids[n-1]
+	return last.mean + (t.max-last.mean)*(target-cum)/(last.weight/2)
+}
+
+// reset empties the digest, keeping its buffers.
+func (t *tdigest) reset() {
+	t.centroids = t.centroids[:0]
+	t.buffer = t.buffer[:0]
+	t.total = 0
+}
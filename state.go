@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// stateVersion is the format of the -state file.
+const stateVersion = 2
+
+// runState is what a run hands to the next one when a capture is rotated
+// into several files: the requests still waiting for their answer and the
+// session decisions, so that answers and sessions straddling the file
+// boundary are handled as in a single capture.
+type runState struct {
+	Version    int                      `json:"version"`
+	TimeFormat string                   `json:"time_format,omitempty"` // of the times of the file
+	Pending    []pendingRequest         `json:"pending"`
+	Filter     map[string]filterSession `json:"filter_sessions,omitempty"`
+	Sessions   []savedSession           `json:"otlp_sessions,omitempty"`
+}
+
+// pendingRequest is an unanswered request. The message is kept as
+// captured and decoded again on load, with the dictionaries and options of
+// the new run.
+type pendingRequest struct {
+	Input      string    `json:"input"`
+	Frame      int       `json:"frame"`
+	Timestamp  Timestamp `json:"timestamp"`
+	TimeOffset string    `json:"time_offset,omitempty"`
+	Message    []byte    `json:"message"`
+}
+
+// savedSession is a session span not emitted yet.
+type savedSession struct {
+	SessionID  string     `json:"session_id"`
+	First      Timestamp  `json:"first"`
+	Last       Timestamp  `json:"last"`
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+// loadState reads the state left by a previous run. A missing file is the
+// first run of a series and returns an empty state.
+func loadState(path string) (*runState, error) {
+	s := &runState{Version: stateVersion}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The times are read in the format they were written in.
+	var head struct {
+		TimeFormat string `json:"time_format"`
+	}
+	if err := json.Unmarshal(b, &head); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	readTimeFormat = head.TimeFormat
+	defer func() { readTimeFormat = "" }()
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if s.Version != stateVersion {
+		return nil, fmt.Errorf("%s: state version %d, expected %d", path, s.Version, stateVersion)
+	}
+	return s, nil
+}
+
+// applications returns the application IDs of the pending requests, whose
+// dictionaries must be loaded before they are decoded.
+func (s *runState) applications() []uint32 {
+	var ids []uint32
+	for _, p := range s.Pending {
+		if id, ok := applicationIDOf(p.Message); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// requests decodes the pending requests. They keep the input and frame
+// they were captured in.
+func (s *runState) requests(d *dict.Parser, utc bool) ([]*MessageInfo, error) {
+	out := make([]*MessageInfo, 0, len(s.Pending))
+	for _, p := range s.Pending {
+		msg, err := diam.ReadMessage(bytes.NewReader(p.Message), d)
+		if err != nil {
+			return nil, fmt.Errorf("pending request of %s frame %d: %v", p.Input, p.Frame, err)
+		}
+		mi := newMessageInfo(d, msg)
+		if profile.validate || strictMode {
+			mi.Warnings = checkMessage(d, msg)
+		}
+		mi.Input, mi.Frame, mi.Timestamp, mi.TimeOffset = p.Input, p.Frame, p.Timestamp, p.TimeOffset
+		if utc {
+			mi.Timestamp = Timestamp{mi.Timestamp.UTC()}
+		}
+		mi.Labels = runLabels
+		mi.raw, mi.rawInput = p.Message, p.Input
+		out = append(out, &mi)
+	}
+	return out, nil
+}
+
+// save writes s to path, through a temporary file renamed over it so that
+// an interrupted run leaves the previous state intact.
+func (s *runState) save(path string) error {
+	s.TimeFormat = timeFormat
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// restore adds requests to the pending ones.
+func (c *correlator) restore(requests []*MessageInfo) {
+	for _, req := range requests {
+		c.pending[txKey{req.HopByHopID, req.EndToEndID}] = req
+	}
+}
+
+// export returns the pending requests seen within maxAge of the last
+// message, oldest first; older ones are taken as never answered and
+// dropped, so the state does not grow from file to file.
+func (c *correlator) export(last time.Time, maxAge time.Duration) []pendingRequest {
+	out := make([]pendingRequest, 0, len(c.pending))
+	for _, req := range c.pending {
+		if req.raw == nil || (maxAge > 0 && last.Sub(req.Timestamp.Time) > maxAge) {
+			continue
+		}
+		out = append(out, pendingRequest{
+			Input:      req.rawInput,
+			Frame:      req.Frame,
+			Timestamp:  req.Timestamp,
+			TimeOffset: req.TimeOffset,
+			Message:    req.raw,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Timestamp.Equal(out[j].Timestamp.Time) {
+			return out[i].Timestamp.Before(out[j].Timestamp.Time)
+		}
+		return out[i].Frame < out[j].Frame
+	})
+	return out
+}
+
+// detachSessions removes the open session spans, to be carried over to
+// the next run instead of emitted by close.
+func (e *traceExporter) detachSessions() []savedSession {
+	var out []savedSession
+	for sid, s := range e.sessions {
+		out = append(out, savedSession{SessionID: sid, First: Timestamp{s.first}, Last: Timestamp{s.last}, Attributes: s.attrs})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SessionID < out[j].SessionID })
+	if e.sessions != nil {
+		e.sessions = make(map[string]*sessionSpan)
+	}
+	return out
+}
+
+// attachSessions reopens the session spans of a previous run.
+func (e *traceExporter) attachSessions(saved []savedSession) {
+	if e.sessions == nil {
+		return
+	}
+	for _, s := range saved {
+		e.sessions[s.SessionID] = &sessionSpan{first: s.First.Time, last: s.Last.Time, attrs: s.Attributes}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeFormat and timeZone select how the times of records and reports are
+// printed: timeFormat is "rfc3339", "epoch-s" (seconds, with the fraction
+// as captured) or "epoch-ms" (milliseconds), and timeZone, when set, is
+// the zone RFC 3339 times are given in. Epoch times count from 1970 UTC in
+// any zone. timesFormatted is set when either is given: the values of
+// Time AVPs then follow them too.
+var (
+	timeFormat     = "rfc3339"
+	timeZone       *time.Location
+	timesFormatted bool
+)
+
+var timeFormats = []string{"rfc3339", "epoch-s", "epoch-ms"}
+
+// setTimeFormat validates and applies -time-format and -time-zone. The
+// zone is a name of the IANA database, "UTC" or "Local".
+func setTimeFormat(format, zone string) error {
+	valid := false
+	for _, f := range timeFormats {
+		valid = valid || f == format
+	}
+	if !valid {
+		return fmt.Errorf("unknown time format %q (available: rfc3339, epoch-s, epoch-ms)", format)
+	}
+	if zone != "" && format != "rfc3339" {
+		return fmt.Errorf("-time-zone applies to rfc3339 times; %s times count from 1970 UTC", format)
+	}
+	timeFormat = format
+	timesFormatted = format != "rfc3339" || zone != ""
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return fmt.Errorf("-time-zone: %v", err)
+		}
+		timeZone = loc
+	}
+	return nil
+}
+
+// formatTime prints a time in the selected format and zone.
+func formatTime(t time.Time) string {
+	switch timeFormat {
+	case "epoch-s":
+		// Before 1970, the fraction is counted back from the second
+		// after: -1.25 is 1.25 s before the epoch.
+		sec, ns := t.Unix(), t.Nanosecond()
+		sign := ""
+		if sec < 0 {
+			if ns != 0 {
+				sec, ns = sec+1, 1e9-ns
+			}
+			sign, sec = "-", -sec
+		}
+		s := sign + strconv.FormatInt(sec, 10)
+		if ns != 0 {
+			s += strings.TrimRight(fmt.Sprintf(".%09d", ns), "0")
+		}
+		return s
+	case "epoch-ms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	if timeZone != nil {
+		t = t.In(timeZone)
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// Timestamp is a time of the records, reports, manifest and state,
+// marshalled to JSON in the selected format and zone: an RFC 3339 string,
+// or a number of seconds or milliseconds for the epoch formats.
+type Timestamp struct {
+	time.Time
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	s := formatTime(t.Time)
+	if timeFormat == "rfc3339" {
+		return json.Marshal(s)
+	}
+	return []byte(s), nil
+}
+
+// readTimeFormat is the format epoch numbers are read in, when not the
+// -time-format of the run: that of the -state file being loaded.
+var readTimeFormat string
+
+// UnmarshalJSON reads an RFC 3339 string, or an epoch number in the unit
+// of readTimeFormat, else of the -time-format of the run.
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &t.Time)
+	}
+	format := readTimeFormat
+	if format == "" {
+		format = timeFormat
+	}
+	if format == "epoch-ms" {
+		ms, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid time %s", b)
+		}
+		t.Time = time.UnixMilli(ms)
+		return nil
+	}
+	sec, frac, _ := strings.Cut(string(b), ".")
+	n, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid time %s", b)
+	}
+	var ns int64
+	if frac != "" {
+		if ns, err = strconv.ParseInt((frac + "000000000")[:9], 10, 64); err != nil || ns < 0 {
+			return fmt.Errorf("invalid time %s", b)
+		}
+	}
+	if strings.HasPrefix(sec, "-") {
+		ns = -ns
+	}
+	t.Time = time.Unix(n, ns)
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// withTimeFormat sets -time-format and -time-zone for the rest of the
+// test, as a run would.
+func withTimeFormat(t *testing.T, format, zone string) {
+	t.Helper()
+	saved := []interface{}{timeFormat, timeZone, timesFormatted}
+	t.Cleanup(func() {
+		timeFormat, timeZone, timesFormatted = saved[0].(string), saved[1].(*time.Location), saved[2].(bool)
+	})
+	timeZone = nil // set by setTimeFormat only when given
+	if err := setTimeFormat(format, zone); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	at := func(sec, ns int64) time.Time { return time.Unix(sec, ns).UTC() }
+	for _, tc := range []struct {
+		format, zone string
+		t            time.Time
+		want         string
+	}{
+		{"rfc3339", "", at(1790856000, 3000000), "2026-10-01T12:00:00.003Z"},
+		{"rfc3339", "", at(1790856000, 0), "2026-10-01T12:00:00Z"},
+		{"rfc3339", "Europe/Rome", at(1790856000, 3000000), "2026-10-01T14:00:00.003+02:00"},
+		{"rfc3339", "", at(-1, 500000000), "1969-12-31T23:59:59.5Z"},
+		{"epoch-s", "", at(1790856000, 3000000), "1790856000.003"},
+		{"epoch-s", "", at(1790856000, 123456789), "1790856000.123456789"},
+		{"epoch-s", "", at(1790856000, 0), "1790856000"},
+		{"epoch-s", "", at(0, 0), "0"},
+		{"epoch-s", "", at(-1, 0), "-1"},
+		{"epoch-s", "", at(-1, 500000000), "-0.5"},
+		{"epoch-s", "", at(-2, 750000000), "-1.25"},
+		{"epoch-s", "", at(-86400, 1), "-86399.999999999"},
+		{"epoch-ms", "", at(1790856000, 3000000), "1790856000003"},
+		{"epoch-ms", "", at(1790856000, 3999999), "1790856000003"},
+		{"epoch-ms", "", at(-1, 500000000), "-500"},
+		{"epoch-ms", "", at(-2, 0), "-2000"},
+	} {
+		withTimeFormat(t, tc.format, tc.zone)
+		if got := formatTime(tc.t); got != tc.want {
+			t.Errorf("%s %s: formatTime(%v) = %s, want %s", tc.format, tc.zone, tc.t, got, tc.want)
+		}
+	}
+}
+
+func TestTimestampJSON(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		t      time.Time
+		json   string
+	}{
+		{"rfc3339", time.Unix(1790856000, 3000000).UTC(), `"2026-10-01T12:00:00.003Z"`},
+		{"rfc3339", time.Unix(-1, 500000000).UTC(), `"1969-12-31T23:59:59.5Z"`},
+		{"epoch-s", time.Unix(1790856000, 3000000), `1790856000.003`},
+		{"epoch-s", time.Unix(1790856000, 0), `1790856000`},
+		{"epoch-s", time.Unix(-2, 750000000), `-1.25`},
+		{"epoch-s", time.Unix(-1, 500000000), `-0.5`},
+		{"epoch-s", time.Unix(12, 0), `12`},
+		{"epoch-ms", time.Unix(1790856000, 3000000), `1790856000003`},
+		{"epoch-ms", time.Unix(-2, 500000000), `-1500`},
+		{"epoch-ms", time.Unix(12, 0), `12000`},
+	} {
+		withTimeFormat(t, tc.format, "")
+		b, err := json.Marshal(Timestamp{tc.t})
+		if err != nil || string(b) != tc.json {
+			t.Errorf("%s: marshal %v = %s, %v, want %s", tc.format, tc.t, b, err, tc.json)
+		}
+		var got Timestamp
+		if err := json.Unmarshal([]byte(tc.json), &got); err != nil || !got.Equal(tc.t) {
+			t.Errorf("%s: unmarshal %s = %v, %v, want %v", tc.format, tc.json, got.Time, err, tc.t)
+		}
+	}
+}
+
+// TestTimestampReadFormat checks that numbers are read in the unit of
+// the file, not of the run, and that RFC 3339 strings are read in any.
+func TestTimestampReadFormat(t *testing.T) {
+	defer func() { readTimeFormat = "" }()
+	withTimeFormat(t, "rfc3339", "")
+	for _, tc := range []struct {
+		read, json string
+		want       time.Time
+	}{
+		{"epoch-ms", `1790856000003`, time.Unix(1790856000, 3000000)},
+		{"epoch-ms", `12`, time.Unix(0, 12000000)},
+		{"epoch-s", `12`, time.Unix(12, 0)},
+		{"epoch-s", `1790856000003`, time.Unix(1790856000003, 0)},
+		{"", `12.5`, time.Unix(12, 500000000)},
+		{"epoch-ms", `"2026-10-01T12:00:00.003Z"`, time.Unix(1790856000, 3000000)},
+	} {
+		readTimeFormat = tc.read
+		var got Timestamp
+		if err := json.Unmarshal([]byte(tc.json), &got); err != nil || !got.Equal(tc.want) {
+			t.Errorf("%s: unmarshal %s = %v, %v, want %v", tc.read, tc.json, got.Time, err, tc.want)
+		}
+	}
+	for _, bad := range []string{`1.5`, `x`, `1e3`} {
+		readTimeFormat = "epoch-ms"
+		var got Timestamp
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("epoch-ms: unmarshal %s = %v, want an error", bad, got.Time)
+		}
+	}
+	readTimeFormat = "epoch-s"
+	var got Timestamp
+	if err := json.Unmarshal([]byte(`1.-5`), &got); err == nil {
+		t.Errorf("epoch-s: unmarshal 1.-5 = %v, want an error", got.Time)
+	}
+}
+
+func TestSetTimeFormat(t *testing.T) {
+	withTimeFormat(t, "rfc3339", "")
+	for _, tc := range []struct {
+		format, zone string
+		ok           bool
+	}{
+		{"rfc3339", "UTC", true},
+		{"epoch-s", "", true},
+		{"epoch-ms", "", true},
+		{"epoch-ns", "", false},
+		{"epoch-s", "UTC", false},
+		{"rfc3339", "Nowhere/Here", false},
+	} {
+		if err := setTimeFormat(tc.format, tc.zone); (err == nil) != tc.ok {
+			t.Errorf("setTimeFormat(%q, %q) = %v", tc.format, tc.zone, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// timeSeriesBucket is the interval messages are counted over.
+	timeSeriesBucket = 10 * time.Second
+	// timeSeriesFormat is "csv" or "influx" (InfluxDB line protocol).
+	timeSeriesFormat = "csv"
+)
+
+// timeSeriesReport counts requests, answers and errors per interval,
+// command and peer, for plotting the traffic profile of a capture.
+type timeSeriesReport struct {
+	bucket time.Duration
+	format string
+	rows   map[timeSeriesKey]*timeSeriesRow
+}
+
+// timeSeriesKey identifies one row. The peer is the Origin-Host of the
+// message, so requests count against the client and answers against the
+// server that produced them.
+type timeSeriesKey struct {
+	start   int64 // bucket start, Unix nanoseconds
+	command uint32
+	peer    string
+}
+
+type timeSeriesRow struct {
+	requests, answers, errors int
+}
+
+func newTimeSeriesReport() (report, error) {
+	if timeSeriesBucket <= 0 {
+		return nil, fmt.Errorf("bucket must be positive, got %v", timeSeriesBucket)
+	}
+	switch timeSeriesFormat {
+	case "csv", "influx":
+	default:
+		return nil, fmt.Errorf("unknown format %q (available: csv, influx)", timeSeriesFormat)
+	}
+	return &timeSeriesReport{
+		bucket: timeSeriesBucket,
+		format: timeSeriesFormat,
+		rows:   make(map[timeSeriesKey]*timeSeriesRow),
+	}, nil
+}
+
+func (r *timeSeriesReport) add(mi *MessageInfo, req *MessageInfo) {
+	k := timeSeriesKey{
+		start:   mi.Timestamp.Truncate(r.bucket).UnixNano(),
+		command: mi.CommandCode,
+		peer:    mi.str("Origin-Host"),
+	}
+	if k.peer == "" {
+		k.peer = "unknown"
+	}
+	row := r.rows[k]
+	if row == nil {
+		row = &timeSeriesRow{}
+		r.rows[k] = row
+	}
+	if mi.isRequest() {
+		row.requests++
+		return
+	}
+	row.answers++
+	if rc, ok := mi.resultCode(); ok && rc.isError() {
+		row.errors++
+	}
+}
+
+// sortedKeys returns the rows in time, command, peer order.
+func (r *timeSeriesReport) sortedKeys() []timeSeriesKey {
+	keys := make([]timeSeriesKey, 0, len(r.rows))
+	for k := range r.rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		if a.command != b.command {
+			return a.command < b.command
+		}
+		return a.peer < b.peer
+	})
+	return keys
+}
+
+func (r *timeSeriesReport) write(w io.Writer) error {
+	if r.format == "influx" {
+		return r.writeInflux(w)
+	}
+	return r.writeCSV(w)
+}
+
+// writeCSV writes the rows, and logs the warnings, which have no place in
+// CSV.
+func (r *timeSeriesReport) writeCSV(w io.Writer) error {
+	for _, warning := range reportWarnings() {
+		log.Println("timeseries:", warning)
+	}
+	cw := csv.NewWriter(w)
+	labelKeys := runLabels.keys()
+	cw.Write(append([]string{"timestamp", "command_code", "command", "peer", "requests", "answers", "errors"}, labelKeys...))
+	for _, k := range r.sortedKeys() {
+		row := r.rows[k]
+		rec := []string{
+			formatTime(time.Unix(0, k.start).UTC()),
+			strconv.FormatUint(uint64(k.command), 10),
+			commandLabel(k.command),
+			k.peer,
+			strconv.Itoa(row.requests),
+			strconv.Itoa(row.answers),
+			strconv.Itoa(row.errors),
+		}
+		for _, l := range labelKeys {
+			rec = append(rec, runLabels[l])
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *timeSeriesReport) writeInflux(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, warning := range reportWarnings() {
+		fmt.Fprintf(bw, "# %s\n", warning)
+	}
+	tags := runLabels.influxTags()
+	for _, k := range r.sortedKeys() {
+		row := r.rows[k]
+		fmt.Fprintf(bw, "diameter_messages,command_code=%d,command=%s,peer=%s%s requests=%di,answers=%di,errors=%di %d\n",
+			k.command, influxTag(commandLabel(k.command)), influxTag(k.peer), tags,
+			row.requests, row.answers, row.errors, k.start)
+	}
+	return bw.Flush()
+}
+
+// influxTagEscaper escapes the characters that are special in line
+// protocol tag keys and values.
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func influxTag(s string) string {
+	return influxTagEscaper.Replace(s)
+}
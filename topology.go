@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// topologyFormat is "json" or "dot" (Graphviz).
+var topologyFormat = "json"
+
+// topologyReport models the signaling network: the hosts and realms seen,
+// the applications each host advertises in CER/CEA, and the traffic edges
+// from requesting to answering hosts.
+type topologyReport struct {
+	format string
+	hosts  map[string]*TopologyHost
+	edges  map[conversationKey]*TopologyEdge
+	// pending holds requests until answered, so that the edge goes to the
+	// host that actually answered.
+	pending map[txKey]*MessageInfo
+}
+
+// TopologyHost is a Diameter identity (Origin-Host).
+type TopologyHost struct {
+	Host         string         `json:"host"`
+	Realm        string         `json:"realm,omitempty"`
+	ProductName  string         `json:"product_name,omitempty"`
+	VendorID     uint32         `json:"vendor_id,omitempty"`
+	Addresses    []string       `json:"addresses,omitempty"`
+	Applications []TopologyApp  `json:"applications"`
+	FirstSeen    Timestamp      `json:"first_seen"`
+	LastSeen     Timestamp      `json:"last_seen"`
+	apps         map[uint32]int // index in Applications
+}
+
+// TopologyApp is an application advertised in a CER or CEA.
+type TopologyApp struct {
+	ID   uint32 `json:"id"`
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"` // auth or acct
+}
+
+// TopologyRealm lists the hosts of a realm.
+type TopologyRealm struct {
+	Realm string   `json:"realm"`
+	Hosts []string `json:"hosts"`
+}
+
+// TopologyEdge is the traffic of one application from a requesting host
+// to an answering host; Destination is "unknown" for requests never
+// answered and without Destination-Host.
+type TopologyEdge struct {
+	Origin          string `json:"origin"`
+	Destination     string `json:"destination"`
+	ApplicationID   uint32 `json:"application_id"`
+	ApplicationName string `json:"application_name,omitempty"`
+	Requests        int    `json:"requests"`
+	Answers         int    `json:"answers"`
+	Errors          int    `json:"errors"`
+}
+
+func newTopologyReport() (report, error) {
+	switch topologyFormat {
+	case "json", "dot":
+	default:
+		return nil, fmt.Errorf("unknown format %q (available: json, dot)", topologyFormat)
+	}
+	return &topologyReport{
+		format:  topologyFormat,
+		hosts:   make(map[string]*TopologyHost),
+		edges:   make(map[conversationKey]*TopologyEdge),
+		pending: make(map[txKey]*MessageInfo),
+	}, nil
+}
+
+func (r *topologyReport) add(mi *MessageInfo, req *MessageInfo) {
+	h := r.host(mi.str("Origin-Host"), mi.Timestamp.Time)
+	if h != nil {
+		if realm := mi.str("Origin-Realm"); realm != "" {
+			h.Realm = realm
+		}
+		if mi.CommandCode == 257 {
+			h.capabilities(mi)
+		}
+	}
+
+	if mi.isRequest() {
+		r.pending[txKey{mi.HopByHopID, mi.EndToEndID}] = mi
+		for _, old := range evictOldest(r.pending, messageTime) {
+			r.edge(or(old.str("Origin-Host"), "unknown"), or(old.str("Destination-Host"), "unknown"), old.ApplicationID).Requests++
+		}
+		return
+	}
+	origin := "unknown"
+	if req != nil {
+		k := txKey{req.HopByHopID, req.EndToEndID}
+		if r.pending[k] == req {
+			delete(r.pending, k)
+		}
+		origin = or(req.str("Origin-Host"), origin)
+	}
+	e := r.edge(origin, or(mi.str("Origin-Host"), "unknown"), mi.ApplicationID)
+	if req != nil {
+		e.Requests++
+	}
+	e.Answers++
+	if rc, ok := mi.resultCode(); ok && rc.isError() {
+		e.Errors++
+	}
+}
+
+// host returns the host named name, created if needed, or nil for "".
+func (r *topologyReport) host(name string, ts time.Time) *TopologyHost {
+	if name == "" {
+		return nil
+	}
+	h := r.hosts[name]
+	if h == nil {
+		h = &TopologyHost{Host: name, Applications: []TopologyApp{}, FirstSeen: Timestamp{ts}, apps: make(map[uint32]int)}
+		r.hosts[name] = h
+	}
+	if ts.Before(h.FirstSeen.Time) {
+		h.FirstSeen = Timestamp{ts}
+	}
+	if ts.After(h.LastSeen.Time) {
+		h.LastSeen = Timestamp{ts}
+	}
+	return h
+}
+
+// capabilities records what a CER or CEA advertises about its sender.
+func (h *TopologyHost) capabilities(mi *MessageInfo) {
+	if p := mi.str("Product-Name"); p != "" {
+		h.ProductName = p
+	}
+	if v, ok := dataOf(mi.avp("Vendor-Id")).(uint32); ok {
+		h.VendorID = v
+	}
+	for _, a := range avpAll(mi.AVPs, "Host-IP-Address") {
+		if s, ok := a.Data.(string); ok && !slices.Contains(h.Addresses, s) {
+			h.Addresses = append(h.Addresses, s)
+		}
+	}
+	apps := func(avps []AVPInfo) {
+		for _, t := range []string{"auth", "acct"} {
+			name := "Auth-Application-Id"
+			if t == "acct" {
+				name = "Acct-Application-Id"
+			}
+			for _, a := range avpAll(avps, name) {
+				if id, ok := a.uint(); ok {
+					h.addApp(uint32(id), t)
+				}
+			}
+		}
+	}
+	apps(mi.AVPs)
+	for _, v := range avpAll(mi.AVPs, "Vendor-Specific-Application-Id") {
+		apps(v.children())
+	}
+}
+
+func (h *TopologyHost) addApp(id uint32, t string) {
+	if _, ok := h.apps[id]; ok {
+		return
+	}
+	h.apps[id] = len(h.Applications)
+	h.Applications = append(h.Applications, TopologyApp{ID: id, Name: applicationName(id), Type: t})
+}
+
+func (r *topologyReport) edge(origin, dest string, appID uint32) *TopologyEdge {
+	k := conversationKey{origin, dest, appID}
+	e := r.edges[k]
+	if e == nil {
+		e = &TopologyEdge{Origin: origin, Destination: dest, ApplicationID: appID, ApplicationName: applicationName(appID)}
+		r.edges[k] = e
+	}
+	return e
+}
+
+// sorted flushes the unanswered requests and returns the model in a
+// stable order.
+func (r *topologyReport) sorted() ([]*TopologyHost, []TopologyRealm, []*TopologyEdge) {
+	for k, req := range r.pending {
+		r.edge(or(req.str("Origin-Host"), "unknown"), or(req.str("Destination-Host"), "unknown"), req.ApplicationID).Requests++
+		delete(r.pending, k)
+	}
+
+	hosts := make([]*TopologyHost, 0, len(r.hosts))
+	byRealm := make(map[string][]string)
+	for _, h := range r.hosts {
+		hosts = append(hosts, h)
+		byRealm[h.Realm] = append(byRealm[h.Realm], h.Host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+
+	realms := make([]TopologyRealm, 0, len(byRealm))
+	for realm, hs := range byRealm {
+		sort.Strings(hs)
+		realms = append(realms, TopologyRealm{Realm: or(realm, "unknown"), Hosts: hs})
+	}
+	sort.Slice(realms, func(i, j int) bool { return realms[i].Realm < realms[j].Realm })
+
+	edges := make([]*TopologyEdge, 0, len(r.edges))
+	for _, e := range r.edges {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		a, b := edges[i], edges[j]
+		if a.Origin != b.Origin {
+			return a.Origin < b.Origin
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		return a.ApplicationID < b.ApplicationID
+	})
+	return hosts, realms, edges
+}
+
+func (r *topologyReport) write(w io.Writer) error {
+	hosts, realms, edges := r.sorted()
+	if r.format == "dot" {
+		return writeTopologyDOT(w, hosts, realms, edges)
+	}
+	return writeJSON(w, struct {
+		Labels   map[string]string `json:"labels,omitempty"`
+		Warnings []string          `json:"warnings,omitempty"`
+		Hosts    []*TopologyHost   `json:"hosts"`
+		Realms   []TopologyRealm   `json:"realms"`
+		Edges    []*TopologyEdge   `json:"edges"`
+	}{runLabels, reportWarnings(), hosts, realms, edges})
+}
+
+// writeTopologyDOT draws realms as clusters of hosts, labelled with their
+// advertised applications, and edges labelled with application and counts.
+func writeTopologyDOT(w io.Writer, hosts []*TopologyHost, realms []TopologyRealm, edges []*TopologyEdge) error {
+	bw := bufio.NewWriter(w)
+	byName := make(map[string]*TopologyHost, len(hosts))
+	for _, h := range hosts {
+		byName[h.Host] = h
+	}
+	fmt.Fprintln(bw, "digraph diameter {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	fmt.Fprintln(bw, "  node [shape=box];")
+	for _, l := range runLabels.keys() {
+		fmt.Fprintf(bw, "  // %s=%s\n", l, runLabels[l])
+	}
+	for _, warning := range reportWarnings() {
+		fmt.Fprintf(bw, "  // %s\n", warning)
+	}
+	for i, realm := range realms {
+		fmt.Fprintf(bw, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(bw, "    label=%s;\n", dotQuote(realm.Realm))
+		for _, name := range realm.Hosts {
+			label := name
+			if h := byName[name]; h != nil && len(h.Applications) > 0 {
+				apps := make([]string, len(h.Applications))
+				for j, a := range h.Applications {
+					apps[j] = appLabel(a.ID, a.Name)
+				}
+				label += "\n" + strings.Join(apps, ", ")
+			}
+			fmt.Fprintf(bw, "    %s [label=%s];\n", dotQuote(name), dotQuote(label))
+		}
+		fmt.Fprintln(bw, "  }")
+	}
+	for _, e := range edges {
+		label := fmt.Sprintf("%s\n%d req / %d ans", appLabel(e.ApplicationID, e.ApplicationName), e.Requests, e.Answers)
+		attrs := ""
+		if e.Errors > 0 {
+			label += fmt.Sprintf(" / %d err", e.Errors)
+			attrs = ", color=red"
+		}
+		fmt.Fprintf(bw, "  %s -> %s [label=%s%s];\n", dotQuote(e.Origin), dotQuote(e.Destination), dotQuote(label), attrs)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// appLabel is the name of an application, or its ID when unnamed.
+func appLabel(id uint32, name string) string {
+	if name == "" || strings.HasPrefix(name, "Unknown") {
+		return strconv.FormatUint(uint64(id), 10)
+	}
+	return name
+}
+
+// or returns s, or def when s is empty.
+func or(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// dotQuote quotes s as a DOT string: quotes and backslashes are escaped,
+// line breaks written as \n, the centred line break of labels, and other
+// control characters replaced by spaces.
+func dotQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case unicode.IsControl(r):
+			b.WriteByte(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
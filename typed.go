@@ -0,0 +1,384 @@
+package main
+
+import (
+	"net"
+)
+
+// TypedFields are the fixed fields that replace the generic avps array of
+// the well-known procedures in typed output (-typed). At most one is set.
+type TypedFields struct {
+	ULR *ULRFields `json:"ulr,omitempty"`
+	ULA *ULAFields `json:"ula,omitempty"`
+	AIR *AIRFields `json:"air,omitempty"`
+	AIA *AIAFields `json:"aia,omitempty"`
+	CCR *CCRFields `json:"ccr,omitempty"`
+	CCA *CCAFields `json:"cca,omitempty"`
+}
+
+// ULRFields is an S6a Update-Location-Request (3GPP TS 29.272, 7.2.3).
+type ULRFields struct {
+	SessionID   string      `json:"session_id"`
+	UserName    string      `json:"user_name"`
+	VisitedPLMN interface{} `json:"visited_plmn,omitempty"`
+	RATType     *uint64     `json:"rat_type,omitempty"`
+	ULRFlags    uint64      `json:"ulr_flags"`
+	IMEI        string      `json:"imei,omitempty"`
+}
+
+// ULAFields is an S6a Update-Location-Answer (3GPP TS 29.272, 7.2.4).
+type ULAFields struct {
+	SessionID    string        `json:"session_id"`
+	Result       *ResultCode   `json:"result,omitempty"`
+	ULAFlags     uint64        `json:"ula_flags"`
+	Subscription *Subscription `json:"subscription,omitempty"`
+}
+
+// Subscription is the Subscription-Data of a ULA.
+type Subscription struct {
+	MSISDN                  interface{}              `json:"msisdn,omitempty"`
+	SubscriberStatus        *uint64                  `json:"subscriber_status,omitempty"`
+	NetworkAccessMode       *uint64                  `json:"network_access_mode,omitempty"`
+	AccessRestriction       *uint64                  `json:"access_restriction,omitempty"`
+	ChargingCharacteristics *ChargingCharacteristics `json:"charging_characteristics,omitempty"`
+	AMBR                    *Bandwidth               `json:"ambr,omitempty"`
+	DefaultContextID        *uint64                  `json:"default_context_id,omitempty"`
+	APN                     []APN                    `json:"apn"`
+}
+
+// APN is an APN-Configuration of the APN-Configuration-Profile.
+type APN struct {
+	ContextID               uint64                   `json:"context_id"`
+	Name                    string                   `json:"name"`
+	PDNType                 *uint64                  `json:"pdn_type,omitempty"`
+	QCI                     uint64                   `json:"qci,omitempty"`
+	ARPPriority             uint64                   `json:"arp_priority,omitempty"`
+	AMBR                    *Bandwidth               `json:"ambr,omitempty"`
+	ChargingCharacteristics *ChargingCharacteristics `json:"charging_characteristics,omitempty"`
+}
+
+// Bandwidth is an aggregate maximum bit rate, in bit/s.
+type Bandwidth struct {
+	UL  uint64 `json:"ul"`
+	DL  uint64 `json:"dl"`
+	ULH string `json:"ul_h,omitempty"` // -humanize
+	DLH string `json:"dl_h,omitempty"`
+}
+
+// AIRFields is an S6a Authentication-Information-Request (TS 29.272, 7.2.5).
+type AIRFields struct {
+	SessionID                  string      `json:"session_id"`
+	UserName                   string      `json:"user_name"`
+	VisitedPLMN                interface{} `json:"visited_plmn,omitempty"`
+	RequestedEUTRANVectors     uint64      `json:"requested_eutran_vectors,omitempty"`
+	ImmediateResponsePreferred bool        `json:"immediate_response_preferred,omitempty"`
+}
+
+// AIAFields is an S6a Authentication-Information-Answer (TS 29.272, 7.2.6).
+// Only the number of vectors is given, never their key material.
+type AIAFields struct {
+	SessionID     string      `json:"session_id"`
+	Result        *ResultCode `json:"result,omitempty"`
+	EUTRANVectors int         `json:"eutran_vectors"`
+	UTRANVectors  int         `json:"utran_vectors"`
+}
+
+// CCRFields is a Credit-Control-Request, Gx or Gy (RFC 4006, 3.1).
+type CCRFields struct {
+	SessionID        string  `json:"session_id"`
+	RequestType      uint64  `json:"request_type"`
+	RequestNumber    uint64  `json:"request_number"`
+	ServiceContextID string  `json:"service_context_id,omitempty"`
+	Subscriber       string  `json:"subscriber,omitempty"`
+	CalledStationID  string  `json:"called_station_id,omitempty"`
+	FramedIP         string  `json:"framed_ip,omitempty"`
+	RATType          *uint64 `json:"rat_type,omitempty"`
+	MSCC             []MSCC  `json:"mscc,omitempty"`
+}
+
+// CCAFields is a Credit-Control-Answer, Gx or Gy (RFC 4006, 3.2).
+type CCAFields struct {
+	SessionID     string      `json:"session_id"`
+	Result        *ResultCode `json:"result,omitempty"`
+	RequestType   uint64      `json:"request_type"`
+	RequestNumber uint64      `json:"request_number"`
+	MSCC          []MSCC      `json:"mscc,omitempty"`
+	ChargingRules []string    `json:"charging_rules,omitempty"`
+}
+
+// MSCC is a Multiple-Services-Credit-Control.
+type MSCC struct {
+	RatingGroup       *uint64 `json:"rating_group,omitempty"`
+	ServiceIdentifier *uint64 `json:"service_identifier,omitempty"`
+	Requested         *Units  `json:"requested,omitempty"`
+	Used              *Units  `json:"used,omitempty"`
+	Granted           *Units  `json:"granted,omitempty"`
+	ResultCode        uint64  `json:"result_code,omitempty"`
+	ValidityTime      uint64  `json:"validity_time,omitempty"`
+	ValidityTimeH     string  `json:"validity_time_h,omitempty"` // -humanize
+	FinalUnitAction   *uint64 `json:"final_unit_action,omitempty"`
+}
+
+// Units are the service units of a Requested/Used/Granted-Service-Unit.
+type Units struct {
+	Time         uint64 `json:"time,omitempty"`
+	TotalOctets  uint64 `json:"total_octets,omitempty"`
+	InputOctets  uint64 `json:"input_octets,omitempty"`
+	OutputOctets uint64 `json:"output_octets,omitempty"`
+
+	// With -humanize, the same in readable units.
+	TimeH         string `json:"time_h,omitempty"`
+	TotalOctetsH  string `json:"total_octets_h,omitempty"`
+	InputOctetsH  string `json:"input_octets_h,omitempty"`
+	OutputOctetsH string `json:"output_octets_h,omitempty"`
+}
+
+// typedRecord is the record of a message printed in typed fields, which
+// replace the avps array.
+type typedRecord struct {
+	*MessageInfo
+	AVPs []AVPInfo `json:"avps,omitempty"`
+}
+
+// record returns what the record of mi marshals: mi itself, or without
+// the avps array when printed in typed fields.
+func (mi *MessageInfo) record() interface{} {
+	if mi.TypedFields != nil {
+		return typedRecord{MessageInfo: mi}
+	}
+	return mi
+}
+
+// typedFields maps the AVPs of a ULR/ULA, AIR/AIA or CCR/CCA into their
+// typed fields. It returns nil for other commands.
+func typedFields(mi *MessageInfo) *TypedFields {
+	avps := mi.AVPs
+	sid := mi.str("Session-Id")
+	var result *ResultCode
+	if rc, ok := mi.resultCode(); ok {
+		result = &rc
+	}
+	switch mi.CommandCode {
+	case 316:
+		if mi.isRequest() {
+			return &TypedFields{ULR: &ULRFields{
+				SessionID:   sid,
+				UserName:    mi.str("User-Name"),
+				VisitedPLMN: dataOf(findAVP(avps, "Visited-PLMN-Id")),
+				RATType:     avpOptUint(avps, "RAT-Type"),
+				ULRFlags:    avpUint(avps, "ULR-Flags"),
+				IMEI:        avpStr(avpChildren(avps, "Terminal-Information"), "IMEI"),
+			}}
+		}
+		ula := &ULAFields{SessionID: sid, Result: result, ULAFlags: avpUint(avps, "ULA-Flags")}
+		if a := findAVP(avps, "Subscription-Data"); a != nil {
+			ula.Subscription = newSubscription(a.children())
+		}
+		return &TypedFields{ULA: ula}
+	case 318:
+		if mi.isRequest() {
+			req := avpChildren(avps, "Requested-EUTRAN-Authentication-Info")
+			return &TypedFields{AIR: &AIRFields{
+				SessionID:                  sid,
+				UserName:                   mi.str("User-Name"),
+				VisitedPLMN:                dataOf(findAVP(avps, "Visited-PLMN-Id")),
+				RequestedEUTRANVectors:     avpUint(req, "Number-Of-Requested-Vectors"),
+				ImmediateResponsePreferred: findAVP(req, "Immediate-Response-Preferred") != nil,
+			}}
+		}
+		info := avpChildren(avps, "Authentication-Info")
+		return &TypedFields{AIA: &AIAFields{
+			SessionID:     sid,
+			Result:        result,
+			EUTRANVectors: len(avpAll(info, "E-UTRAN-Vector")),
+			UTRANVectors:  len(avpAll(info, "UTRAN-Vector")),
+		}}
+	case 272:
+		var mscc []MSCC
+		for _, a := range avpAll(avps, "Multiple-Services-Credit-Control") {
+			mscc = append(mscc, newMSCC(a.children()))
+		}
+		if mi.isRequest() {
+			return &TypedFields{CCR: &CCRFields{
+				SessionID:        sid,
+				RequestType:      avpUint(avps, "CC-Request-Type"),
+				RequestNumber:    avpUint(avps, "CC-Request-Number"),
+				ServiceContextID: mi.str("Service-Context-Id"),
+				Subscriber:       mi.subscriberID(),
+				CalledStationID:  mi.str("Called-Station-Id"),
+				FramedIP:         ipString(dataOf(findAVP(avps, "Framed-IP-Address"))),
+				RATType:          avpOptUint(avps, "RAT-Type"),
+				MSCC:             mscc,
+			}}
+		}
+		cca := &CCAFields{
+			SessionID:     sid,
+			Result:        result,
+			RequestType:   avpUint(avps, "CC-Request-Type"),
+			RequestNumber: avpUint(avps, "CC-Request-Number"),
+			MSCC:          mscc,
+		}
+		for _, a := range avpAll(avps, "Charging-Rule-Install") {
+			for _, name := range []string{"Charging-Rule-Name", "Charging-Rule-Base-Name"} {
+				for _, r := range avpAll(a.children(), name) {
+					if s, ok := r.Data.(string); ok {
+						cca.ChargingRules = append(cca.ChargingRules, s)
+					} else if b, ok := r.Data.([]byte); ok {
+						cca.ChargingRules = append(cca.ChargingRules, string(b))
+					}
+				}
+			}
+		}
+		return &TypedFields{CCA: cca}
+	}
+	return nil
+}
+
+func newSubscription(avps []AVPInfo) *Subscription {
+	s := &Subscription{
+		MSISDN:                  dataOf(findAVP(avps, "MSISDN")),
+		SubscriberStatus:        avpOptUint(avps, "Subscriber-Status"),
+		NetworkAccessMode:       avpOptUint(avps, "Network-Access-Mode"),
+		AccessRestriction:       avpOptUint(avps, "Access-Restriction-Data"),
+		ChargingCharacteristics: chargingCharacteristicsOf(avps),
+		AMBR:                    newBandwidth(avpChildren(avps, "AMBR")),
+		APN:                     []APN{},
+	}
+	profile := avpChildren(avps, "APN-Configuration-Profile")
+	s.DefaultContextID = avpOptUint(profile, "Context-Identifier")
+	for _, a := range avpAll(profile, "APN-Configuration") {
+		c := a.children()
+		qos := avpChildren(c, "EPS-Subscribed-QoS-Profile")
+		s.APN = append(s.APN, APN{
+			ContextID:               avpUint(c, "Context-Identifier"),
+			Name:                    avpStr(c, "Service-Selection"),
+			PDNType:                 avpOptUint(c, "PDN-Type"),
+			QCI:                     avpUint(qos, "QoS-Class-Identifier"),
+			ARPPriority:             avpUint(avpChildren(qos, "Allocation-Retention-Priority"), "Priority-Level"),
+			AMBR:                    newBandwidth(avpChildren(c, "AMBR")),
+			ChargingCharacteristics: chargingCharacteristicsOf(c),
+		})
+	}
+	return s
+}
+
+func newBandwidth(avps []AVPInfo) *Bandwidth {
+	if avps == nil {
+		return nil
+	}
+	b := &Bandwidth{
+		UL: avpUint(avps, "Max-Requested-Bandwidth-UL"),
+		DL: avpUint(avps, "Max-Requested-Bandwidth-DL"),
+	}
+	b.ULH, b.DLH = humanOf(unitBitrate, b.UL), humanOf(unitBitrate, b.DL)
+	return b
+}
+
+func newMSCC(avps []AVPInfo) MSCC {
+	m := MSCC{
+		RatingGroup:       avpOptUint(avps, "Rating-Group"),
+		ServiceIdentifier: avpOptUint(avps, "Service-Identifier"),
+		Requested:         newUnits(avps, "Requested-Service-Unit"),
+		Used:              newUnits(avps, "Used-Service-Unit"),
+		Granted:           newUnits(avps, "Granted-Service-Unit"),
+		ResultCode:        avpUint(avps, "Result-Code"),
+		ValidityTime:      avpUint(avps, "Validity-Time"),
+		FinalUnitAction:   avpOptUint(avpChildren(avps, "Final-Unit-Indication"), "Final-Unit-Action"),
+	}
+	m.ValidityTimeH = humanOf(unitSeconds, m.ValidityTime)
+	return m
+}
+
+func newUnits(avps []AVPInfo, name string) *Units {
+	a := findAVP(avps, name)
+	if a == nil {
+		return nil
+	}
+	c := a.children()
+	u := &Units{
+		Time:         avpUint(c, "CC-Time"),
+		TotalOctets:  avpUint(c, "CC-Total-Octets"),
+		InputOctets:  avpUint(c, "CC-Input-Octets"),
+		OutputOctets: avpUint(c, "CC-Output-Octets"),
+	}
+	u.TimeH = humanOf(unitSeconds, u.Time)
+	u.TotalOctetsH, u.InputOctetsH, u.OutputOctetsH = humanOf(unitOctets, u.TotalOctets), humanOf(unitOctets, u.InputOctets), humanOf(unitOctets, u.OutputOctets)
+	return u
+}
+
+// avpAll returns every AVP in avps with the given name.
+func avpAll(avps []AVPInfo, name string) []*AVPInfo {
+	var out []*AVPInfo
+	for i := range avps {
+		if avps[i].Name == name {
+			out = append(out, &avps[i])
+		}
+	}
+	return out
+}
+
+// avpChildren returns the members of the first grouped AVP with the given
+// name, or nil.
+func avpChildren(avps []AVPInfo, name string) []AVPInfo {
+	if a := findAVP(avps, name); a != nil {
+		return a.children()
+	}
+	return nil
+}
+
+// avpUint returns the value of the first integer AVP with the given name,
+// or 0.
+func avpUint(avps []AVPInfo, name string) uint64 {
+	if v := avpOptUint(avps, name); v != nil {
+		return *v
+	}
+	return 0
+}
+
+// avpOptUint is avpUint for values where 0 differs from absent.
+func avpOptUint(avps []AVPInfo, name string) *uint64 {
+	if a := findAVP(avps, name); a != nil {
+		if v, ok := a.uint(); ok {
+			return &v
+		}
+	}
+	return nil
+}
+
+// avpStr returns the value of the first string AVP with the given name,
+// or "". Octet strings are taken as text.
+func avpStr(avps []AVPInfo, name string) string {
+	switch v := dataOf(findAVP(avps, name)).(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// chargingCharacteristicsOf returns the decoded
+// 3GPP-Charging-Characteristics of avps, nil when absent or not 4 hex
+// digits.
+func chargingCharacteristicsOf(avps []AVPInfo) *ChargingCharacteristics {
+	v := dataOf(findAVP(avps, "TGPP-Charging-Characteristics"))
+	if _, ok := v.(ChargingCharacteristics); !ok {
+		v = decodeCharging("TGPP-Charging-Characteristics", v)
+	}
+	if cc, ok := v.(ChargingCharacteristics); ok {
+		return &cc
+	}
+	return nil
+}
+
+// ipString formats an address carried as an octet string.
+func ipString(v interface{}) string {
+	switch b := v.(type) {
+	case []byte:
+		if len(b) == net.IPv4len || len(b) == net.IPv6len {
+			return net.IP(b).String()
+		}
+	case string:
+		return b
+	}
+	return ""
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Server-initiated requests flow from the server of a session or the
+// subscriber database to the client: a PCRF or OCS re-authorizing (RAR)
+// or aborting (ASR) a session, an HSS changing (IDR, DSR) or cancelling
+// (CLR) the subscription data held by an MME, or the S-CSCF registration
+// (RTR, PPR). The clients answer them, so latency and failures measure the
+// clients, not the servers.
+
+const (
+	s6aApplicationID = 16777251
+	cxApplicationID  = 16777216
+)
+
+// serverInitiatedCommands are the command codes initiated by servers in
+// any application, serverInitiatedByApp those of one application.
+var (
+	serverInitiatedCommands = map[uint32]bool{
+		258: true, // Re-Auth
+		274: true, // Abort-Session
+	}
+	serverInitiatedByApp = map[uint32]map[uint32]bool{
+		s6aApplicationID: {
+			317: true, // Cancel-Location
+			319: true, // Insert-Subscriber-Data
+			320: true, // Delete-Subscriber-Data
+		},
+		cxApplicationID: {
+			304: true, // Registration-Termination
+			305: true, // Push-Profile
+		},
+	}
+)
+
+// serverInitiated reports whether the command flows from server to
+// client; the header is enough to tell.
+func serverInitiated(appID, code uint32) bool {
+	return serverInitiatedCommands[code] || serverInitiatedByApp[appID][code]
+}
+
+// serverInitiatedReport lists the server-initiated requests per
+// initiating node, command and application: its targets, how fast and
+// how well they answered, and the requests left without answer.
+type serverInitiatedReport struct {
+	flows   map[serverFlowKey]*serverFlow
+	pending map[txKey]*MessageInfo // requests not answered yet
+}
+
+type serverFlowKey struct {
+	initiator string
+	code      uint32
+	appID     uint32
+}
+
+type serverFlow struct {
+	requests, answered, errors, unanswered, orphans int
+	targets                                         counter
+	latencies                                       *tdigest // milliseconds
+	minLatency, maxLatency                          float64
+	unansweredFrames                                []int
+}
+
+// ServerFlowStats are the server-initiated requests of one initiator,
+// command and application. Latencies are in milliseconds; answers whose
+// request is not in the capture are counted as orphans.
+type ServerFlowStats struct {
+	Initiator        string        `json:"initiator"`
+	Command          string        `json:"command"`
+	CommandCode      uint32        `json:"command_code"`
+	ApplicationID    uint32        `json:"application_id"`
+	ApplicationName  string        `json:"application_name,omitempty"`
+	Requests         int           `json:"requests"`
+	Answered         int           `json:"answered"`
+	Errors           int           `json:"errors"`
+	Unanswered       int           `json:"unanswered"`
+	OrphanAnswers    int           `json:"orphan_answers,omitempty"`
+	Targets          []NameCount   `json:"targets"`
+	LatencyMillis    *Distribution `json:"latency_ms,omitempty"`
+	UnansweredFrames []int         `json:"unanswered_frames,omitempty"`
+}
+
+func newServerInitiatedReport() (report, error) {
+	return &serverInitiatedReport{flows: make(map[serverFlowKey]*serverFlow), pending: make(map[txKey]*MessageInfo)}, nil
+}
+
+func (r *serverInitiatedReport) add(mi *MessageInfo, req *MessageInfo) {
+	if !mi.ServerInitiated {
+		return
+	}
+	if mi.isRequest() {
+		f := r.flow(mi.str("Origin-Host"), mi)
+		f.requests++
+		if dest := mi.str("Destination-Host"); dest != "" {
+			f.targets.inc(dest)
+		}
+		r.pending[txKey{mi.HopByHopID, mi.EndToEndID}] = mi
+		for _, old := range evictOldest(r.pending, messageTime) {
+			r.unanswered(old)
+		}
+		return
+	}
+	if req == nil {
+		// The initiator is the destination of the answer.
+		r.flow(mi.str("Destination-Host"), mi).orphans++
+		return
+	}
+	if k := (txKey{req.HopByHopID, req.EndToEndID}); r.pending[k] == req {
+		delete(r.pending, k)
+	}
+	f := r.flow(req.str("Origin-Host"), req)
+	f.answered++
+	if req.str("Destination-Host") == "" {
+		f.targets.inc(mi.str("Origin-Host"))
+	}
+	if rc, ok := mi.resultCode(); ok && rc.isError() {
+		f.errors++
+	}
+	ms := float64(mi.Timestamp.Sub(req.Timestamp.Time)) / float64(time.Millisecond)
+	if f.answered == 1 {
+		f.minLatency, f.maxLatency = ms, ms
+	}
+	f.minLatency, f.maxLatency = math.Min(f.minLatency, ms), math.Max(f.maxLatency, ms)
+	f.latencies.add(ms)
+}
+
+func (r *serverInitiatedReport) flow(initiator string, mi *MessageInfo) *serverFlow {
+	if initiator == "" {
+		initiator = "unknown"
+	}
+	k := serverFlowKey{initiator, mi.CommandCode, mi.ApplicationID}
+	f := r.flows[k]
+	if f == nil {
+		f = &serverFlow{targets: make(counter), latencies: newTDigest()}
+		r.flows[k] = f
+	}
+	return f
+}
+
+// unanswered counts a request left without answer.
+func (r *serverInitiatedReport) unanswered(req *MessageInfo) {
+	f := r.flow(req.str("Origin-Host"), req)
+	f.unanswered++
+	if reportTop <= 0 || len(f.unansweredFrames) < reportTop {
+		f.unansweredFrames = append(f.unansweredFrames, req.Frame)
+	}
+}
+
+func (r *serverInitiatedReport) write(w io.Writer) error {
+	pending := make([]*MessageInfo, 0, len(r.pending))
+	for _, req := range r.pending {
+		pending = append(pending, req)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Timestamp.Before(pending[j].Timestamp.Time) })
+	for _, req := range pending {
+		r.unanswered(req)
+	}
+	r.pending = make(map[txKey]*MessageInfo)
+
+	flows := make([]ServerFlowStats, 0, len(r.flows))
+	for k, f := range r.flows {
+		s := ServerFlowStats{
+			Initiator:        k.initiator,
+			Command:          shortCommandName(k.code, true),
+			CommandCode:      k.code,
+			ApplicationID:    k.appID,
+			ApplicationName:  applicationName(k.appID),
+			Requests:         f.requests,
+			Answered:         f.answered,
+			Errors:           f.errors,
+			Unanswered:       f.unanswered,
+			OrphanAnswers:    f.orphans,
+			Targets:          f.targets.top(reportTop),
+			UnansweredFrames: f.unansweredFrames,
+		}
+		if f.answered > 0 {
+			d := Distribution{
+				Min: math.Round(f.minLatency*1000) / 1000,
+				P50: math.Round(f.latencies.quantile(0.50)*1000) / 1000,
+				P90: math.Round(f.latencies.quantile(0.90)*1000) / 1000,
+				P99: math.Round(f.latencies.quantile(0.99)*1000) / 1000,
+				Max: math.Round(f.maxLatency*1000) / 1000,
+			}
+			s.LatencyMillis = &d
+		}
+		flows = append(flows, s)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		a, b := flows[i], flows[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		if a.Initiator != b.Initiator {
+			return a.Initiator < b.Initiator
+		}
+		if a.CommandCode != b.CommandCode {
+			return a.CommandCode < b.CommandCode
+		}
+		return a.ApplicationID < b.ApplicationID
+	})
+	return writeJSON(w, struct {
+		Labels   map[string]string `json:"labels,omitempty"`
+		Warnings []string          `json:"warnings,omitempty"`
+		Flows    []ServerFlowStats `json:"flows"`
+	}{runLabels, reportWarnings(), flows})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// histogramAVP is the AVP whose values the values report counts.
+var histogramAVP string
+
+// valuesReport is a histogram of the values of one AVP, found at any
+// depth, over the whole capture.
+type valuesReport struct {
+	name     string
+	values   map[string]*ValueCount
+	total    int // occurrences
+	messages int // messages carrying the AVP
+}
+
+// ValueCount is one bar of the histogram. Name is the enumerated value or
+// Result-Code name, when known.
+type ValueCount struct {
+	Value   string  `json:"value"`
+	Name    string  `json:"name,omitempty"`
+	Human   string  `json:"value_h,omitempty"` // -humanize
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+func newValuesReport() (report, error) {
+	if histogramAVP == "" {
+		return nil, fmt.Errorf("-avp names the AVP to count, e.g. -avp RAT-Type")
+	}
+	return &valuesReport{name: histogramAVP, values: make(map[string]*ValueCount)}, nil
+}
+
+func (r *valuesReport) add(mi *MessageInfo, req *MessageInfo) {
+	if n := r.count(mi, mi.AVPs); n > 0 {
+		r.messages++
+	}
+}
+
+// count adds the occurrences in avps and their members and returns how
+// many were found.
+func (r *valuesReport) count(mi *MessageInfo, avps []AVPInfo) int {
+	n := 0
+	for i := range avps {
+		a := &avps[i]
+		if g, ok := a.Data.(GroupedData); ok {
+			n += r.count(mi, g.AVPs)
+			continue
+		}
+		if a.Name != r.name {
+			continue
+		}
+		v := valueLabel(a.Data)
+		c := r.values[v]
+		if c == nil {
+			c = &ValueCount{Value: v, Name: valueName(mi.ApplicationID, a)}
+			if humanize {
+				c.Human = humanAVP(a)
+			}
+			r.values[v] = c
+		}
+		c.Count++
+		r.total++
+		n++
+	}
+	return n
+}
+
+// valueLabel is the value of an AVP as counted: strings as is, octets in
+// hex, PLMNs as MCC-MNC, numbers in E.164 and other decoded values as
+// JSON.
+func valueLabel(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return hex.EncodeToString(x)
+	case *PLMN:
+		return x.MCC + "-" + x.MNC
+	case *E164Number:
+		return or(x.E164, x.Digits)
+	case int32, uint32, int64, uint64, float32, float64:
+		return fmt.Sprint(x)
+	case Timestamp:
+		return formatTime(x.Time)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// valueName returns the name of an enumerated value or a Result-Code.
+func valueName(appID uint32, a *AVPInfo) string {
+	v, ok := a.uint()
+	if !ok {
+		return ""
+	}
+	if a.Name == "Result-Code" {
+		return resultCodeName(ResultCode{Code: uint32(v)})
+	}
+	if _, ok := a.Data.(int32); !ok {
+		return ""
+	}
+	// The definition of the AVP's vendor: vendors reuse codes.
+	def := lookupAVPDef(dict.Default, appID, a.Code, a.VendorID)
+	if def == nil || def.Data.Type != datatype.EnumeratedType {
+		return ""
+	}
+	for _, e := range def.Data.Enum {
+		if e.Code == int32(v) {
+			return e.Name
+		}
+	}
+	return ""
+}
+
+func (r *valuesReport) write(w io.Writer) error {
+	values := make([]*ValueCount, 0, len(r.values))
+	for _, c := range r.values {
+		c.Percent = math.Round(float64(c.Count)*10000/float64(r.total)) / 100
+		values = append(values, c)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	return writeJSON(w, struct {
+		Labels   map[string]string `json:"labels,omitempty"`
+		Warnings []string          `json:"warnings,omitempty"`
+		AVP      string            `json:"avp"`
+		Total    int               `json:"total"`
+		Messages int               `json:"messages"`
+		Values   []*ValueCount     `json:"values"`
+	}{runLabels, reportWarnings(), r.name, r.total, r.messages, values})
+}
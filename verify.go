@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// goldenDir is the regression corpus shipped with the sources.
+const goldenDir = "testdata/golden"
+
+// runVerify implements "verify": it decodes every small reference capture
+// of a directory and compares the records with the golden JSON file next
+// to it (NAME.pcap, NAME.json), so that a decoder change cannot alter the
+// output unnoticed. -update rewrites the golden files after an intended
+// change, to be reviewed in the diff of the commit.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("dir", goldenDir, "Directory of reference PCAP files and their golden JSON output")
+	update := fs.Bool("update", false, "Write the golden files from the current output instead of comparing")
+	fs.Parse(args)
+
+	pcaps, err := filepath.Glob(filepath.Join(*dir, "*.pcap"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pcaps) == 0 {
+		log.Fatalf("no reference captures (*.pcap) in %s", *dir)
+	}
+
+	// Applications missing from the built-in dictionaries come with the
+	// corpus, in its dict directory.
+	d := dict.Default
+	rxCommands := true
+	var plugins *dictPlugins
+	if fi, err := os.Stat(filepath.Join(*dir, "dict")); err == nil && fi.IsDir() {
+		if plugins, err = newDictPlugins(d, filepath.Join(*dir, "dict")); err != nil {
+			log.Fatal(err)
+		}
+		rxCommands = !plugins.defines(rxApplicationID)
+	}
+	if err := loadChargingDictionary(d, rxCommands); err != nil {
+		log.Fatal(err)
+	}
+	if plugins != nil {
+		if err := plugins.requireAll(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	failed := 0
+	for _, p := range pcaps {
+		golden := strings.TrimSuffix(p, ".pcap") + ".json"
+		var out bytes.Buffer
+		if err := decodeReference(d, p, &out); err != nil {
+			log.Fatalf("%s: %v", p, err)
+		}
+		if *update {
+			if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("updated %s\n", golden)
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			log.Fatalf("%v (run verify -update to create it)", err)
+		}
+		if bytes.Equal(want, out.Bytes()) {
+			fmt.Printf("ok   %s\n", p)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s\n", p)
+		writeLineDiff(os.Stdout, golden, "output", strings.Split(string(want), "\n"), strings.Split(out.String(), "\n"))
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d captures differ from their golden output\n", failed, len(pcaps))
+		os.Exit(exitRuntime)
+	}
+}
+
+// decodeReference writes the records of a reference capture as the
+// default output prints them, with timestamps in UTC so that the golden
+// files do not depend on the local time zone.
+func decodeReference(d *dict.Parser, path string, w io.Writer) error {
+	var cancel canceller
+	stream, err := openHandleStream(&input{path: path}, &cancel)
+	if err != nil {
+		return err
+	}
+	defer stream.close()
+	for {
+		p, err := stream.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg, ok := diameterMessage(d, p.decode())
+		if !ok {
+			continue
+		}
+		mi := newMessageInfo(d, msg)
+		mi.Warnings = checkMessage(d, msg)
+		mi.Frame = p.frame
+		mi.Timestamp = Timestamp{p.ts.UTC()}
+		out, err := json.MarshalIndent(mi, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(out))
+	}
+}
+
+// maxDiffCells bounds the work of writeLineDiff; larger inputs only get
+// their first differing line.
+const maxDiffCells = 1 << 24
+
+// writeLineDiff writes the lines changed between a and b in the unified
+// diff style, with three lines of context.
+func writeLineDiff(w io.Writer, aName, bName string, a, b []string) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", aName, bName)
+	if len(a)*len(b) > maxDiffCells {
+		for i := 0; i < len(a) || i < len(b); i++ {
+			if i >= len(a) || i >= len(b) || a[i] != b[i] {
+				fmt.Fprintf(w, "first difference at line %d\n", i+1)
+				return
+			}
+		}
+		return
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+		at   int // line number in a, for ' ' and '-', else in b
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i + 1})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i + 1})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], j + 1})
+			j++
+		}
+	}
+
+	// Changes closer than twice the context share a hunk.
+	const context = 3
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			k++
+			continue
+		}
+		end := k // last change of the hunk
+		for n := k + 1; n < len(edits) && n <= end+2*context; n++ {
+			if edits[n].op != ' ' {
+				end = n
+			}
+		}
+		from, to := max(k-context, 0), min(end+context+1, len(edits))
+		fmt.Fprintf(w, "@@ line %d @@\n", edits[from].at)
+		for _, e := range edits[from:to] {
+			fmt.Fprintf(w, "%c%s\n", e.op, e.line)
+		}
+		k = to
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// strictMode sends messages with protocol violations to the error output
+// instead of the normal output and reports. Otherwise they are processed
+// as usual, with their violations listed in the warnings field.
+var strictMode bool
+
+// checkMessage returns the violations of RFC 6733 and of the dictionary
+// command rules found in msg.
+func checkMessage(d *dict.Parser, msg *diam.Message) []string {
+	var w []string
+	h := msg.Header
+	request := h.CommandFlags&diam.RequestFlag != 0
+	if h.CommandFlags&0x0f != 0 {
+		w = append(w, fmt.Sprintf("reserved command flag bits set (0x%02x)", h.CommandFlags))
+	}
+	if request && h.CommandFlags&diam.ErrorFlag != 0 {
+		w = append(w, "E bit set on a request")
+	}
+	if !request && h.CommandFlags&diam.RetransmittedFlag != 0 {
+		w = append(w, "T bit set on an answer")
+	}
+	w = checkAVPs(d, h.ApplicationID, msg.AVP, w)
+
+	counts := make(map[string]int)
+	failed := false
+	for _, a := range msg.AVP {
+		def := avpDefFromDict(d, h.ApplicationID, a.Code, a.VendorID)
+		if def == nil {
+			continue
+		}
+		counts[def.Name]++
+		switch def.Name {
+		case "Result-Code":
+			failed = failed || resultFailed(a)
+		case "Experimental-Result":
+			if g, ok := a.Data.(*diam.GroupedAVP); ok {
+				for _, c := range g.AVP {
+					if c.Code == avp.ExperimentalResultCode {
+						failed = failed || resultFailed(c)
+					}
+				}
+			}
+		}
+	}
+	if !request && counts["Result-Code"] == 0 && counts["Experimental-Result"] == 0 {
+		w = append(w, "answer without Result-Code or Experimental-Result")
+	}
+
+	// Answers reporting a failure need not follow the command rules (RFC
+	// 6733, 7.2): a failed AIA has no Authentication-Info.
+	cmd, err := d.FindCommand(h.ApplicationID, h.CommandCode)
+	if err != nil || failed || h.CommandFlags&diam.ErrorFlag != 0 {
+		return w
+	}
+	rules := cmd.Answer.Rule
+	if request {
+		rules = cmd.Request.Rule
+	}
+	// Only the required AVPs are checked: the built-in dictionaries give
+	// max 1 to optional AVPs that may repeat, such as Route-Record.
+	for _, r := range rules {
+		if !r.Required {
+			continue
+		}
+		n, min := counts[r.AVP], max(r.Min, 1)
+		switch {
+		case n == 0:
+			w = append(w, "missing required AVP "+r.AVP)
+		case n < min:
+			w = append(w, fmt.Sprintf("AVP %s occurs %d times, at least %d required", r.AVP, n, min))
+		case r.Max > 0 && n > r.Max:
+			w = append(w, fmt.Sprintf("AVP %s occurs %d times, at most %d allowed", r.AVP, n, r.Max))
+		}
+	}
+	return w
+}
+
+// resultFailed reports whether a Result-Code or Experimental-Result-Code
+// is not a success (RFC 6733, 7.1).
+func resultFailed(a *diam.AVP) bool {
+	v, ok := a.Data.(datatype.Unsigned32)
+	return ok && v >= 3000
+}
+
+// checkAVPs appends the violations of the AVP headers in avps and their
+// members to w.
+func checkAVPs(d *dict.Parser, appID uint32, avps []*diam.AVP, w []string) []string {
+	for _, a := range avps {
+		def := avpDefFromDict(d, appID, a.Code, a.VendorID)
+		name := fmt.Sprintf("%d", a.Code)
+		if def != nil {
+			name = def.Name
+		}
+		if a.Flags&0x1f != 0 {
+			w = append(w, fmt.Sprintf("AVP %s: reserved flag bits set (0x%02x)", name, a.Flags))
+		}
+		if def == nil && a.Flags&avp.Mbit != 0 {
+			w = append(w, fmt.Sprintf("unknown AVP %d (vendor %d) with M bit set", a.Code, a.VendorID))
+		}
+		if g, ok := a.Data.(*diam.GroupedAVP); ok {
+			w = checkAVPs(d, appID, g.AVP, w)
+		}
+	}
+	return w
+}